@@ -2,9 +2,16 @@ package account
 
 import (
 	"context"
+	"iter"
 
 	"github.com/ndquang191/go-graph-grpc/account/pb"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/stream"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 type Client struct {
@@ -12,8 +19,18 @@ type Client struct {
 	service pb.AccountServiceClient
 }
 
-func NewClient(url string) (*Client, error) {
-	conn, err := grpc.Dial(url, grpc.WithInsecure())
+// NewClient dials the service at url. Extra dial options are applied after
+// the default insecure transport, so they can override it. Status errors
+// returned by the service are translated back to errs.Error values, and
+// calls carry the OpenTelemetry trace context and request ID of ctx.
+func NewClient(url string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(errs.UnaryClientInterceptor, logging.UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(errs.StreamClientInterceptor, logging.StreamClientInterceptor),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}, opts...)
+	conn, err := grpc.Dial(url, opts...)
 
 	if err != nil {
 		return nil, err
@@ -27,14 +44,17 @@ func (c *Client) Close() {
 	c.conn.Close()
 }
 
-func (c *Client) PostAccount(ctx context.Context, name string) (*Account, error) {
-	r, err := c.service.PostAccount(ctx, &pb.PostAccountRequest{Name: name})
+// PostAccount creates an account. Retries with the same non-empty
+// idempotencyKey return the account created by the first request.
+func (c *Client) PostAccount(ctx context.Context, name string, email string, password string, idempotencyKey string) (*Account, error) {
+	r, err := c.service.PostAccount(ctx, &pb.PostAccountRequest{Name: name, Email: email, Password: password, IdempotencyKey: idempotencyKey})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &Account{ID: r.Account.Id, Name: r.Account.Name}, nil
+	a := decodeAccount(r.Account)
+	return &a, nil
 }
 
 func (c *Client) GetAccount(ctx context.Context, id string) (*Account, error) {
@@ -45,7 +65,9 @@ func (c *Client) GetAccount(ctx context.Context, id string) (*Account, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Account{ID: r.Account.Id, Name: r.Account.Name}, nil
+
+	a := decodeAccount(r.Account)
+	return &a, nil
 }
 
 func (c *Client) GetAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error) {
@@ -59,8 +81,110 @@ func (c *Client) GetAccounts(ctx context.Context, skip uint64, take uint64) ([]A
 
 	accounts := []Account{}
 	for _, a := range r.Accounts {
-		accounts = append(accounts, Account{ID: a.Id, Name: a.Name})
+		accounts = append(accounts, decodeAccount(a))
 	}
 
 	return accounts, nil
 }
+
+func (c *Client) GetAccountsPage(ctx context.Context, after string, first uint64) (*AccountPage, error) {
+	r, err := c.service.GetAccounts(
+		ctx, &pb.GetAccountsRequest{After: after, Take: first},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page := &AccountPage{
+		Accounts:    []Account{},
+		Cursors:     r.Cursors,
+		HasNextPage: r.HasNextPage,
+	}
+	for _, a := range r.Accounts {
+		page.Accounts = append(page.Accounts, decodeAccount(a))
+	}
+
+	return page, nil
+}
+
+// UpdateAccount sets the fields of the account named in fields, see
+// UpdatableFields, and returns the updated account
+func (c *Client) UpdateAccount(ctx context.Context, account Account, fields []string) (*Account, error) {
+	r, err := c.service.UpdateAccount(ctx, &pb.UpdateAccountRequest{
+		Account: &pb.Account{
+			Id:    account.ID,
+			Name:  account.Name,
+			Email: account.Email,
+			Roles: account.Roles,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: fields},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	a := decodeAccount(r.Account)
+	return &a, nil
+}
+
+func (c *Client) DeactivateAccount(ctx context.Context, id string) (*Account, error) {
+	r, err := c.service.DeactivateAccount(ctx, &pb.DeactivateAccountRequest{Id: id})
+
+	if err != nil {
+		return nil, err
+	}
+
+	a := decodeAccount(r.Account)
+	return &a, nil
+}
+
+func (c *Client) Login(ctx context.Context, email string, password string) (*auth.Tokens, error) {
+	r, err := c.service.Login(ctx, &pb.LoginRequest{Email: email, Password: password})
+
+	if err != nil {
+		return nil, err
+	}
+	return decodeTokens(r.Tokens), nil
+}
+
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*auth.Tokens, error) {
+	r, err := c.service.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: refreshToken})
+
+	if err != nil {
+		return nil, err
+	}
+	return decodeTokens(r.Tokens), nil
+}
+
+// StreamAccounts yields every account in ID order, receiving them as the
+// loop asks for them. It ends with an error if the stream is cut short.
+func (c *Client) StreamAccounts(ctx context.Context) iter.Seq2[Account, error] {
+	return stream.Recv(ctx,
+		func(ctx context.Context) (pb.AccountService_StreamAccountsClient, error) {
+			return c.service.StreamAccounts(ctx, &pb.StreamAccountsRequest{})
+		},
+		func(res *pb.StreamAccountsResponse) Account { return decodeAccount(res.Account) },
+	)
+}
+
+func decodeTokens(t *pb.Tokens) *auth.Tokens {
+	return &auth.Tokens{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		ExpiresAt:    t.ExpiresAt.AsTime(),
+	}
+}
+
+func decodeAccount(a *pb.Account) Account {
+	return Account{
+		ID:        a.Id,
+		Name:      a.Name,
+		Email:     a.Email,
+		CreatedAt: a.CreatedAt.AsTime(),
+		UpdatedAt: a.UpdatedAt.AsTime(),
+		Active:    a.Active,
+		Roles:     a.Roles,
+	}
+}
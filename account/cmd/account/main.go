@@ -1,38 +1,111 @@
 package main
 
 import (
+	"context"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/ndquang191/go-graph-grpc/account"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/mtls"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
+	"github.com/ndquang191/go-graph-grpc/internal/tracing"
 	"github.com/tinrab/retry"
-	"log"
+	"log/slog"
+	"os"
 	"time"
 )
 
 type Config struct {
 	DatabaseURL string `envconfig:"DATABASE_URL"`
+	// Storage selects the repository: "postgres" or "memory"
+	Storage string `envconfig:"STORAGE" default:"postgres"`
+	// JWTSecret is the HMAC key login tokens are signed with, shared with
+	// the gateway that verifies them
+	JWTSecret string      `envconfig:"JWT_SECRET" required:"true"`
+	TLS       mtls.Config `envconfig:"TLS"`
+	// Port is the port the gRPC server listens on
+	Port int `envconfig:"PORT" default:"8080"`
+	// DrainTimeout bounds how long in-flight calls may take to finish on
+	// shutdown
+	DrainTimeout time.Duration  `envconfig:"DRAIN_TIMEOUT" default:"10s"`
+	Tracing      tracing.Config `envconfig:"TRACING"`
+	Log          logging.Config `envconfig:"LOG"`
+	// AdminPort serves the metrics at /metrics, apart from the gRPC port
+	AdminPort int `envconfig:"ADMIN_PORT" default:"9090"`
+	// IdempotencyRetention is how long idempotency keys of Post requests are
+	// remembered
+	IdempotencyRetention time.Duration `envconfig:"IDEMPOTENCY_RETENTION" default:"24h"`
+	// OutboxInterval is how often stored events are relayed to the broker
+	OutboxInterval time.Duration `envconfig:"OUTBOX_INTERVAL" default:"1s"`
 }
 
 func main() {
 	var config Config
 	err := envconfig.Process("", &config)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(slog.Default(), "Failed to read the config", "error", err)
+	}
+
+	logger, err := logging.New(os.Stderr, config.Log, "account")
+	if err != nil {
+		logging.Fatal(slog.Default(), "Failed to set up logging", "error", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "account", config.Tracing)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up tracing", "error", err)
 	}
 
 	var r account.Repository
-	retry.ForeverSleep(2*time.Second, func(_ int) error {
-		r, err = account.NewPostgresRepository(config.DatabaseURL)
-		if err != nil {
-			log.Print(err)
-			return err
-		}
-		return nil
-	})
+	if config.Storage == "memory" {
+		r = account.NewMemoryRepository()
+	} else {
+		retry.ForeverSleep(2*time.Second, func(_ int) error {
+			r, err = account.NewPostgresRepository(config.DatabaseURL)
+			if err != nil {
+				logger.Warn("Failed to connect to the database, retrying", "error", err)
+				return err
+			}
+			return nil
+		})
+		logger.Info("Connected to the database")
+	}
 
-	defer r.Close()
+	opts, err := config.TLS.ServerOptions()
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS credentials", "error", err)
+	}
 
-	log.Println('s', "Starting server")
-	s := account.NewService(r)
+	s := account.NewService(r, auth.NewSigner([]byte(config.JWTSecret)))
 
-	log.Fatal(account.ListenGRPC(s, 8080))
+	// events reach subscribers in this process only, until a networked
+	// events.Broker is plugged in here
+	broker := events.NewMemoryBroker()
+	broker.Subscribe(">", events.LogHandler(logger))
+	relay := outbox.NewRelay(r.Outbox(), broker, config.OutboxInterval, logger)
+	relay.Start()
+
+	srv := account.NewGRPCServer(s, idempotency.New(r, config.IdempotencyRetention),
+		// cleanups run in reverse order, so spans are flushed last
+		server.OnShutdown(func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.Error("Failed to flush spans", "error", err)
+			}
+		}),
+		server.WithLogger(logger),
+		server.WithPort(config.Port),
+		server.WithAdminPort(config.AdminPort),
+		server.WithServerOptions(opts...),
+		server.WithDrainTimeout(config.DrainTimeout),
+		server.WithHealthCheck(r.Ping),
+		server.OnShutdown(r.Close),
+		server.OnShutdown(relay.Stop),
+	)
+	if err := srv.Run(context.Background()); err != nil {
+		logging.Fatal(logger, "Server failed", "error", err)
+	}
 }
@@ -0,0 +1,13 @@
+package account
+
+import "github.com/ndquang191/go-graph-grpc/internal/events"
+
+// accountCreated returns the event recording that account was created
+func accountCreated(account *Account) (events.Event, error) {
+	return events.New(events.TypeAccountCreated, account.ID, events.AccountCreated{
+		AccountID: account.ID,
+		Name:      account.Name,
+		Email:     account.Email,
+		CreatedAt: account.CreatedAt,
+	})
+}
@@ -0,0 +1,163 @@
+package account
+
+import (
+	"context"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"iter"
+	"slices"
+	"sort"
+	"sync"
+)
+
+type memoryRepository struct {
+	*idempotency.MemoryStore
+	mu       sync.RWMutex
+	accounts []Account // ordered by ID, like the Postgres listings
+	byID     map[string]int
+	events   *outbox.MemoryStore
+}
+
+// NewMemoryRepository returns a thread-safe Repository backed by process
+// memory, for running the service without Postgres
+func NewMemoryRepository() Repository {
+	return &memoryRepository{
+		MemoryStore: idempotency.NewMemoryStore(),
+		byID:        map[string]int{},
+		events:      outbox.NewMemoryStore(),
+	}
+}
+
+func (r *memoryRepository) Close() {
+}
+
+func (r *memoryRepository) Outbox() outbox.Store {
+	return r.events
+}
+
+func (r *memoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRepository) PutAccount(ctx context.Context, account *Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byID[account.ID]; ok || r.emailTaken(account) {
+		return ErrAlreadyExists
+	}
+
+	event, err := accountCreated(account)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(r.accounts), func(i int) bool {
+		return r.accounts[i].ID > account.ID
+	})
+	r.accounts = append(r.accounts, Account{})
+	copy(r.accounts[i+1:], r.accounts[i:])
+	r.accounts[i] = *account
+
+	for j := i; j < len(r.accounts); j++ {
+		r.byID[r.accounts[j].ID] = j
+	}
+	r.events.Add(event)
+	return nil
+}
+
+func (r *memoryRepository) GetAccountByID(ctx context.Context, id string) (*Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, ok := r.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	a := r.accounts[i]
+	return &a, nil
+}
+
+func (r *memoryRepository) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, a := range r.accounts {
+		if a.Email == email {
+			return &a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryRepository) ListAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	accounts := []Account{}
+	for i := skip; i < uint64(len(r.accounts)) && i < skip+take; i++ {
+		accounts = append(accounts, r.accounts[i])
+	}
+	return accounts, nil
+}
+
+func (r *memoryRepository) ListAccountsAfter(ctx context.Context, afterID string, take uint64) ([]Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	start := sort.Search(len(r.accounts), func(i int) bool {
+		return r.accounts[i].ID > afterID
+	})
+
+	accounts := []Account{}
+	for i := start; i < len(r.accounts) && uint64(len(accounts)) < take; i++ {
+		accounts = append(accounts, r.accounts[i])
+	}
+	return accounts, nil
+}
+
+func (r *memoryRepository) UpdateAccount(ctx context.Context, account *Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.byID[account.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if r.emailTaken(account) {
+		return ErrAlreadyExists
+	}
+
+	r.accounts[i] = *account
+	return nil
+}
+
+// StreamAccounts yields a snapshot of the accounts taken when it starts
+func (r *memoryRepository) StreamAccounts(ctx context.Context) iter.Seq2[Account, error] {
+	return func(yield func(Account, error) bool) {
+		r.mu.RLock()
+		accounts := slices.Clone(r.accounts)
+		r.mu.RUnlock()
+
+		for _, a := range accounts {
+			if err := ctx.Err(); err != nil {
+				yield(Account{}, err)
+				return
+			}
+			if !yield(a, nil) {
+				return
+			}
+		}
+	}
+}
+
+// emailTaken mirrors the unique constraint on the email column
+func (r *memoryRepository) emailTaken(account *Account) bool {
+	for _, a := range r.accounts {
+		if a.Email == account.Email && a.ID != account.ID {
+			return true
+		}
+	}
+	return false
+}
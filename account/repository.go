@@ -3,22 +3,67 @@ package account
 import (
 	"context"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"database/sql/driver"
+	_ "embed"
+	"errors"
+	"fmt"
+	"iter"
+	"net"
+
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/metrics"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"github.com/ndquang191/go-graph-grpc/internal/pgcursor"
+	"github.com/ndquang191/go-graph-grpc/internal/pgschema"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 type Repository interface {
 	Close()
+	// Ping reports whether the storage is reachable
+	Ping(ctx context.Context) error
+	// Store keeps the idempotency keys of Post requests next to the data
+	// they created
+	idempotency.Store
+	// Outbox holds the events of the changes made through the repository
+	// until they are published
+	Outbox() outbox.Store
+	// PutAccount stores account along with its AccountCreated event
 	PutAccount(ctx context.Context, account *Account) error
 	GetAccountByID(ctx context.Context, id string) (*Account, error)
+	GetAccountByEmail(ctx context.Context, email string) (*Account, error)
 	ListAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error)
+	ListAccountsAfter(ctx context.Context, afterID string, take uint64) ([]Account, error)
+	UpdateAccount(ctx context.Context, account *Account) error
+	// StreamAccounts yields every account in ID order, reading them in
+	// batches as the caller consumes them
+	StreamAccounts(ctx context.Context) iter.Seq2[Account, error]
 }
 
+// schema creates the tables of the repository, or migrates those of an older
+// version, when it connects
+//
+//go:embed up.sql
+var schema string
+
+// streamBatchSize is the number of accounts StreamAccounts reads at once
+const streamBatchSize = 100
+
+const accountColumns = `id, name, email, created_at, updated_at, active, roles, password_hash`
+
 type postgresRepository struct {
-	db *sql.DB
+	*idempotency.PostgresStore
+	db     *sql.DB
+	events *outbox.PostgresStore
 }
 
 func NewPostgresRepository(url string) (Repository, error) {
-	db, err := sql.Open("postgres", url)
+	db, err := otelsql.Open("postgres", url,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -28,8 +73,16 @@ func NewPostgresRepository(url string) (Repository, error) {
 		return nil, err
 	}
 
+	if err := pgschema.Apply(context.Background(), db, schema); err != nil {
+		return nil, err
+	}
+
+	metrics.RegisterDB(db, "account")
+
 	return &postgresRepository{
-		db: db,
+		PostgresStore: idempotency.NewPostgresStore(db),
+		db:            db,
+		events:        outbox.NewPostgresStore(db),
 	}, nil
 }
 
@@ -37,38 +90,108 @@ func (r *postgresRepository) Close() {
 	r.db.Close()
 }
 
-func (r *postgresRepository) Ping() error {
-	return r.db.Ping()
+func (r *postgresRepository) Outbox() outbox.Store {
+	return r.events
 }
 
-func (r *postgresRepository) PutAccount(ctx context.Context, account *Account) error {
-	_, err := r.db.ExecContext(ctx, `INSERT INTO account (id, name) VALUES ($1, $2)`, account.ID, account.Name)
-	return err
+func (r *postgresRepository) Ping(ctx context.Context) error {
+	return wrapError(r.db.PingContext(ctx))
+}
+
+func (r *postgresRepository) PutAccount(ctx context.Context, account *Account) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = wrapError(err)
+			return
+		}
+
+		err = wrapError(tx.Commit())
+	}()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO accounts (`+accountColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		account.ID,
+		account.Name,
+		account.Email,
+		account.CreatedAt,
+		account.UpdatedAt,
+		account.Active,
+		pq.Array(account.Roles),
+		account.PasswordHash,
+	)
+	if err != nil {
+		return err
+	}
+
+	event, err := accountCreated(account)
+	if err != nil {
+		return err
+	}
+	return outbox.Insert(ctx, tx, event)
+}
+
+func (r *postgresRepository) UpdateAccount(ctx context.Context, account *Account) error {
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE accounts SET name = $2, email = $3, updated_at = $4, active = $5, roles = $6 WHERE id = $1`,
+		account.ID,
+		account.Name,
+		account.Email,
+		account.UpdatedAt,
+		account.Active,
+		pq.Array(account.Roles),
+	)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(err)
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
 func (r *postgresRepository) GetAccountByID(ctx context.Context, id string) (*Account, error) {
-	row := r.db.QueryRowContext(ctx, `SELECT id, name FROM account WHERE id = $1`, id)
+	row := r.db.QueryRowContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE id = $1`, id)
 
-	a := Account{}
+	a, err := scanAccount(row)
+	if err != nil {
+		return nil, wrapError(err)
+	}
 
-	if err := row.Scan(&a.ID, &a.Name); err != nil {
-		return nil, err
+	return a, nil
+}
+
+func (r *postgresRepository) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE email = $1`, email)
+
+	a, err := scanAccount(row)
+	if err != nil {
+		return nil, wrapError(err)
 	}
 
-	return &a, nil
+	return a, nil
 }
 
 func (r *postgresRepository) ListAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error) {
-	rows, err := r.db.QueryContext(ctx, `SELECT id, name FROM account LIMIT $1 OFFSET $2`, take, skip)
+	rows, err := r.db.QueryContext(ctx, `SELECT `+accountColumns+` FROM accounts ORDER BY id LIMIT $1 OFFSET $2`, take, skip)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	defer rows.Close()
 
 	accounts := []Account{}
 	for rows.Next() {
-		a := &Account{}
-		if err := rows.Scan(&a.ID, &a.Name); err == nil {
+		if a, err := scanAccount(rows); err == nil {
 			accounts = append(accounts, *a)
 		}
 
@@ -78,3 +201,76 @@ func (r *postgresRepository) ListAccounts(ctx context.Context, skip uint64, take
 	}
 	return accounts, nil
 }
+
+// ListAccountsAfter lists accounts by keyset on their ksuid, which stays
+// stable under concurrent inserts
+func (r *postgresRepository) ListAccountsAfter(ctx context.Context, afterID string, take uint64) ([]Account, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE id > $1 ORDER BY id LIMIT $2`, afterID, take)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		accounts = append(accounts, *a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+	return accounts, nil
+}
+
+// StreamAccounts reads the accounts through a server-side cursor, so they
+// come from one snapshot however long the caller takes
+func (r *postgresRepository) StreamAccounts(ctx context.Context) iter.Seq2[Account, error] {
+	return func(yield func(Account, error) bool) {
+		for row, err := range pgcursor.Query(ctx, r.db, streamBatchSize, `SELECT `+accountColumns+` FROM accounts ORDER BY id`) {
+			if err != nil {
+				yield(Account{}, wrapError(err))
+				return
+			}
+
+			a, err := scanAccount(row)
+			if err != nil {
+				yield(Account{}, wrapError(err))
+				return
+			}
+			if !yield(*a, nil) {
+				return
+			}
+		}
+	}
+}
+
+// scanAccount reads a row selected with accountColumns
+func scanAccount(row interface{ Scan(...any) error }) (*Account, error) {
+	a := &Account{}
+	if err := row.Scan(&a.ID, &a.Name, &a.Email, &a.CreatedAt, &a.UpdatedAt, &a.Active, pq.Array(&a.Roles), &a.PasswordHash); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// wrapError translates database errors to the account domain errors
+func wrapError(err error) error {
+	var pqErr *pq.Error
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation":
+		return ErrAlreadyExists
+	case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/pgschema"
+	"github.com/segmentio/ksuid"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	testRepository(t, NewMemoryRepository())
+}
+
+// TestPostgresRepository runs against the database at TEST_DATABASE_URL, to
+// which the repository applies up.sql
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	r, err := NewPostgresRepository(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the schema migrates a database it created before, which it leaves as is
+	if err := pgschema.Apply(context.Background(), r.(*postgresRepository).db, schema); err != nil {
+		t.Fatalf("apply up.sql again: %v", err)
+	}
+
+	testRepository(t, r)
+}
+
+func testRepository(t *testing.T, r Repository) {
+	ctx := context.Background()
+
+	newAccount := func() *Account {
+		id := ksuid.New().String()
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		return &Account{
+			ID:           id,
+			Name:         "Ada",
+			Email:        strings.ToLower(id) + "@example.com",
+			CreatedAt:    now,
+			UpdatedAt:    now,
+			Active:       true,
+			Roles:        []string{RoleCustomer},
+			PasswordHash: "hash",
+		}
+	}
+	// accounts are listed in ID order, which ksuids made within a second
+	// are not created in
+	var accounts []*Account
+	for range 3 {
+		a := newAccount()
+		if err := r.PutAccount(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+		accounts = append(accounts, a)
+	}
+	slices.SortFunc(accounts, func(a, b *Account) int { return strings.Compare(a.ID, b.ID) })
+
+	t.Run("PutAccount", func(t *testing.T) {
+		if err := r.PutAccount(ctx, accounts[0]); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("PutAccount of an existing account = %v, want %v", err, ErrAlreadyExists)
+		}
+		sameEmail := newAccount()
+		sameEmail.Email = accounts[0].Email
+		if err := r.PutAccount(ctx, sameEmail); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("PutAccount with a taken email = %v, want %v", err, ErrAlreadyExists)
+		}
+	})
+
+	t.Run("GetAccount", func(t *testing.T) {
+		got, err := r.GetAccountByID(ctx, accounts[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAccount(t, got, accounts[0])
+
+		got, err = r.GetAccountByEmail(ctx, accounts[1].Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAccount(t, got, accounts[1])
+
+		if _, err := r.GetAccountByID(ctx, ksuid.New().String()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetAccountByID of a missing account = %v, want %v", err, ErrNotFound)
+		}
+		if _, err := r.GetAccountByEmail(ctx, "missing@example.com"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetAccountByEmail of a missing account = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("UpdateAccount", func(t *testing.T) {
+		a := *accounts[2]
+		a.Name = "Grace"
+		a.Active = false
+		a.Roles = []string{RoleCustomer, RoleAdmin}
+		a.UpdatedAt = a.UpdatedAt.Add(time.Minute)
+		if err := r.UpdateAccount(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.GetAccountByID(ctx, a.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAccount(t, got, &a)
+		accounts[2] = &a
+
+		taken := a
+		taken.Email = accounts[0].Email
+		if err := r.UpdateAccount(ctx, &taken); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("UpdateAccount to a taken email = %v, want %v", err, ErrAlreadyExists)
+		}
+		if err := r.UpdateAccount(ctx, newAccount()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateAccount of a missing account = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("ListAccounts", func(t *testing.T) {
+		all, err := r.ListAccounts(ctx, 0, math.MaxInt32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.IsSortedFunc(all, func(a, b Account) int { return strings.Compare(a.ID, b.ID) }) {
+			t.Error("accounts are not listed in ID order")
+		}
+		i := slices.IndexFunc(all, func(a Account) bool { return a.ID == accounts[0].ID })
+		if i < 0 || i+len(accounts) > len(all) {
+			t.Fatalf("the accounts stored are not listed together: %v", all)
+		}
+
+		page, err := r.ListAccounts(ctx, uint64(i+1), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := r.ListAccountsAfter(ctx, accounts[0].ID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range [][]Account{page, after} {
+			if len(got) != 2 {
+				t.Fatalf("page = %v, want the 2 accounts after %s", got, accounts[0].ID)
+			}
+			checkAccount(t, &got[0], accounts[1])
+			checkAccount(t, &got[1], accounts[2])
+		}
+	})
+}
+
+func checkAccount(t *testing.T, got, want *Account) {
+	t.Helper()
+	if got.ID != want.ID || got.Name != want.Name || got.Email != want.Email || got.Active != want.Active ||
+		!slices.Equal(got.Roles, want.Roles) || got.PasswordHash != want.PasswordHash ||
+		!got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Errorf("account = %+v, want %+v", got, want)
+	}
+}
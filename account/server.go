@@ -4,38 +4,46 @@ import (
 	"context"
 	"fmt"
 	"github.com/ndquang191/go-graph-grpc/account/pb"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
-	"net"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type grpcServer struct {
 	pb.UnimplementedAccountServiceServer
 	service Service
+	keys    *idempotency.Keys
 }
 
-func ListenGRPC(service Service, port int) error {
-	lis, err := net.Listen("tcp", fmt.Sprint(":", port))
-	if err != nil {
-		return err
-	}
-	serv := grpc.NewServer()
-	pb.RegisterAccountServiceServer(serv, &grpcServer{service: service})
-	reflection.Register(serv)
-	return serv.Serve(lis)
-
+// NewGRPCServer returns a server for the account service, ready to Run. Keys
+// deduplicates PostAccount requests carrying an idempotency key.
+func NewGRPCServer(service Service, keys *idempotency.Keys, opts ...server.Option) *server.Server {
+	s := server.New(opts...)
+	pb.RegisterAccountServiceServer(s, &grpcServer{service: service, keys: keys})
+	return s
 }
 
 func (s *grpcServer) PostAccount(ctx context.Context, rq *pb.PostAccountRequest) (*pb.PostAccountResponse, error) {
-	a, err := s.service.PostAccount(ctx, rq.Name)
+	// an account is made before it can authenticate, so its keys are scoped
+	// to its email
+	email, err := normalizeEmail(rq.Email)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pb.PostAccountResponse{Account: &pb.Account{
-		Id:   a.ID,
-		Name: a.Name,
-	}}, nil
+	// the fingerprint of the request is stored, so the password is left out:
+	// even hashed, it could be guessed from the fingerprint much faster than
+	// from its bcrypt hash
+	fingerprinted := &pb.PostAccountRequest{Name: rq.Name, Email: rq.Email}
+	return idempotency.Do(ctx, s.keys, email, rq.IdempotencyKey, fingerprinted, func(ctx context.Context) (*pb.PostAccountResponse, error) {
+		a, err := s.service.PostAccount(ctx, rq.Name, rq.Email, rq.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		return &pb.PostAccountResponse{Account: accountProto(a)}, nil
+	})
 }
 func (s *grpcServer) GetAccount(ctx context.Context, rq *pb.GetAccountRequest) (*pb.GetAccountResponse, error) {
 	a, err := s.service.GetAccountByID(ctx, rq.Id)
@@ -43,25 +51,120 @@ func (s *grpcServer) GetAccount(ctx context.Context, rq *pb.GetAccountRequest) (
 		return nil, err
 	}
 
-	return &pb.GetAccountResponse{Account: &pb.Account{
-		Id:   a.ID,
-		Name: a.Name,
-	}}, nil
+	return &pb.GetAccountResponse{Account: accountProto(a)}, nil
 }
 
 func (s *grpcServer) GetAccounts(ctx context.Context, rq *pb.GetAccountsRequest) (*pb.GetAccountsResponse, error) {
+	if rq.Skip == 0 {
+		return s.getAccountsAfter(ctx, rq.After, rq.Take)
+	}
+
 	res, err := s.service.ListAccounts(ctx, rq.Skip, rq.Take)
 	if err != nil {
 		return nil, err
 	}
 
 	accounts := []*pb.Account{}
-	for _, p := range res {
-		accounts = append(accounts, &pb.Account{
-			Id:   p.ID,
-			Name: p.Name,
-		})
+	for i := range res {
+		accounts = append(accounts, accountProto(&res[i]))
 	}
 
 	return &pb.GetAccountsResponse{Accounts: accounts}, nil
 }
+
+func (s *grpcServer) getAccountsAfter(ctx context.Context, after string, first uint64) (*pb.GetAccountsResponse, error) {
+	page, err := s.service.ListAccountsAfter(ctx, after, first)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []*pb.Account{}
+	for i := range page.Accounts {
+		accounts = append(accounts, accountProto(&page.Accounts[i]))
+	}
+
+	return &pb.GetAccountsResponse{
+		Accounts:    accounts,
+		Cursors:     page.Cursors,
+		HasNextPage: page.HasNextPage,
+	}, nil
+}
+
+func (s *grpcServer) UpdateAccount(ctx context.Context, rq *pb.UpdateAccountRequest) (*pb.UpdateAccountResponse, error) {
+	if rq.Account == nil {
+		return nil, fmt.Errorf("%w: account is required", ErrInvalidArgument)
+	}
+
+	a, err := s.service.UpdateAccount(ctx, Account{
+		ID:    rq.Account.Id,
+		Name:  rq.Account.Name,
+		Email: rq.Account.Email,
+		Roles: rq.Account.Roles,
+	}, rq.UpdateMask.GetPaths())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateAccountResponse{Account: accountProto(a)}, nil
+}
+
+func (s *grpcServer) DeactivateAccount(ctx context.Context, rq *pb.DeactivateAccountRequest) (*pb.DeactivateAccountResponse, error) {
+	a, err := s.service.DeactivateAccount(ctx, rq.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeactivateAccountResponse{Account: accountProto(a)}, nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, rq *pb.LoginRequest) (*pb.LoginResponse, error) {
+	t, err := s.service.Login(ctx, rq.Email, rq.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.LoginResponse{Tokens: tokensProto(t)}, nil
+}
+
+func (s *grpcServer) RefreshToken(ctx context.Context, rq *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	t, err := s.service.RefreshToken(ctx, rq.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RefreshTokenResponse{Tokens: tokensProto(t)}, nil
+}
+
+// StreamAccounts sends an account per message. Send blocks while the client
+// is behind, which pauses the read of the accounts.
+func (s *grpcServer) StreamAccounts(rq *pb.StreamAccountsRequest, stream pb.AccountService_StreamAccountsServer) error {
+	for a, err := range s.service.StreamAccounts(stream.Context()) {
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.StreamAccountsResponse{Account: accountProto(&a)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tokensProto(t *auth.Tokens) *pb.Tokens {
+	return &pb.Tokens{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		ExpiresAt:    timestamppb.New(t.ExpiresAt),
+	}
+}
+
+func accountProto(a *Account) *pb.Account {
+	return &pb.Account{
+		Id:        a.ID,
+		Name:      a.Name,
+		Email:     a.Email,
+		CreatedAt: timestamppb.New(a.CreatedAt),
+		UpdatedAt: timestamppb.New(a.UpdatedAt),
+		Active:    a.Active,
+		Roles:     a.Roles,
+	}
+}
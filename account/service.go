@@ -2,39 +2,123 @@ package account
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/cursor"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
 	"github.com/segmentio/ksuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrNotFound        = errs.New(errs.NotFound, "account not found")
+	ErrInvalidArgument = errs.New(errs.InvalidArgument, "invalid account")
+	ErrAlreadyExists   = errs.New(errs.AlreadyExists, "account already exists")
+	ErrUnavailable     = errs.New(errs.Unavailable, "account storage unavailable")
+	ErrDeactivated     = errs.New(errs.FailedPrecondition, "account is deactivated")
+
+	ErrInvalidCredentials = errs.New(errs.Unauthenticated, "invalid email or password")
+)
+
+const minPasswordLength = 8
+
+// Roles an account can have. Every account is a customer; admins manage the
+// catalog and other accounts.
+const (
+	RoleCustomer = "customer"
+	RoleAdmin    = "admin"
+)
+
+var roles = map[string]bool{RoleCustomer: true, RoleAdmin: true}
+
 type Service interface {
-	PostAccount(ctx context.Context, name string) (*Account, error)
+	PostAccount(ctx context.Context, name string, email string, password string) (*Account, error)
 	GetAccountByID(ctx context.Context, id string) (*Account, error)
 	ListAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error)
+	ListAccountsAfter(ctx context.Context, after string, first uint64) (*AccountPage, error)
+	UpdateAccount(ctx context.Context, account Account, fields []string) (*Account, error)
+	DeactivateAccount(ctx context.Context, id string) (*Account, error)
+	Login(ctx context.Context, email string, password string) (*auth.Tokens, error)
+	RefreshToken(ctx context.Context, refreshToken string) (*auth.Tokens, error)
+	// StreamAccounts yields every account in ID order, for exports
+	StreamAccounts(ctx context.Context) iter.Seq2[Account, error]
 }
 
+// UpdatableFields are the account fields UpdateAccount accepts in its mask
+var UpdatableFields = []string{"name", "email", "roles"}
+
 type Account struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Active is false once the account is deactivated, after which it can no
+	// longer be changed or place orders
+	Active bool     `json:"active"`
+	Roles  []string `json:"roles"`
+	// PasswordHash is the bcrypt hash of the password, never sent to clients
+	PasswordHash string `json:"-"`
+}
+
+// AccountPage is one page of a cursor paginated account listing
+type AccountPage struct {
+	Accounts []Account
+	// Cursors[i] is the cursor to resume the listing after Accounts[i]
+	Cursors     []string
+	HasNextPage bool
 }
 
 type accountService struct {
 	repository Repository
+	signer     *auth.Signer
 }
 
-func NewService(r Repository) Service {
+func NewService(r Repository, signer *auth.Signer) Service {
 	return &accountService{
 		repository: r,
+		signer:     signer,
 	}
 }
 
-func (s *accountService) PostAccount(ctx context.Context, name string) (*Account, error) {
+func (s *accountService) PostAccount(ctx context.Context, name string, email string, password string) (*Account, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidArgument)
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("%w: password must have at least %d characters", ErrInvalidArgument, minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	now := time.Now().UTC()
 	a := Account{
-		Name: name,
-		ID:   ksuid.New().String(),
+		Name:         name,
+		Email:        email,
+		ID:           ksuid.New().String(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Active:       true,
+		Roles:        []string{RoleCustomer},
+		PasswordHash: string(hash),
 	}
 
 	if err := s.repository.PutAccount(ctx, &a); err != nil {
-		return nil, err
+		return nil, emailTaken(err, email)
 	}
 	return &a, nil
 }
@@ -51,3 +135,192 @@ func (s *accountService) ListAccounts(ctx context.Context, skip uint64, take uin
 	}
 	return s.repository.ListAccounts(ctx, skip, take)
 }
+
+func (s *accountService) StreamAccounts(ctx context.Context) iter.Seq2[Account, error] {
+	return s.repository.StreamAccounts(ctx)
+}
+
+func (s *accountService) ListAccountsAfter(ctx context.Context, after string, first uint64) (*AccountPage, error) {
+	if first > 100 || first == 0 {
+		first = 100
+	}
+
+	afterID := ""
+	if after != "" {
+		if err := cursor.Decode(after, &afterID); err != nil {
+			return nil, err
+		}
+	}
+
+	// one extra row tells whether there is a next page
+	accounts, err := s.repository.ListAccountsAfter(ctx, afterID, first+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &AccountPage{Cursors: []string{}}
+	if uint64(len(accounts)) > first {
+		accounts = accounts[:first]
+		page.HasNextPage = true
+	}
+
+	page.Accounts = accounts
+	for _, a := range accounts {
+		page.Cursors = append(page.Cursors, cursor.Encode(a.ID))
+	}
+	return page, nil
+}
+
+// UpdateAccount changes the fields of an account named in fields to their
+// values in account, leaving the others as they are
+func (s *accountService) UpdateAccount(ctx context.Context, account Account, fields []string) (*Account, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: no fields to update", ErrInvalidArgument)
+	}
+
+	a, err := s.repository.GetAccountByID(ctx, account.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Active {
+		return nil, ErrDeactivated
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "name":
+			if strings.TrimSpace(account.Name) == "" {
+				return nil, fmt.Errorf("%w: name is required", ErrInvalidArgument)
+			}
+			a.Name = account.Name
+		case "email":
+			email, err := normalizeEmail(account.Email)
+			if err != nil {
+				return nil, err
+			}
+			a.Email = email
+		case "roles":
+			r, err := normalizeRoles(account.Roles)
+			if err != nil {
+				return nil, err
+			}
+			a.Roles = r
+		default:
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidArgument, field)
+		}
+	}
+
+	a.UpdatedAt = time.Now().UTC()
+	if err := s.repository.UpdateAccount(ctx, a); err != nil {
+		return nil, emailTaken(err, a.Email)
+	}
+	return a, nil
+}
+
+// DeactivateAccount marks an account as deactivated. Deactivating an account
+// twice is not an error.
+func (s *accountService) DeactivateAccount(ctx context.Context, id string) (*Account, error) {
+	a, err := s.repository.GetAccountByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Active {
+		return a, nil
+	}
+
+	a.Active = false
+	a.UpdatedAt = time.Now().UTC()
+	if err := s.repository.UpdateAccount(ctx, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// dummyHash is compared against when no account has the email, so a login
+// takes as long whether the account exists or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Login checks the password of the account with the given email and issues
+// tokens for it
+func (s *accountService) Login(ctx context.Context, email string, password string) (*auth.Tokens, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	a, err := s.repository.GetAccountByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if !a.Active {
+		return nil, ErrDeactivated
+	}
+
+	return s.signer.Issue(identity(a))
+}
+
+// RefreshToken issues new tokens in exchange for a valid refresh token, as
+// long as the account it was issued to is still active
+func (s *accountService) RefreshToken(ctx context.Context, refreshToken string) (*auth.Tokens, error) {
+	token, err := s.signer.Verify(refreshToken, auth.Refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := s.repository.GetAccountByID(ctx, token.AccountID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !a.Active {
+		return nil, ErrDeactivated
+	}
+
+	return s.signer.Issue(identity(a))
+}
+
+func identity(a *Account) auth.Identity {
+	return auth.Identity{AccountID: a.ID, Roles: a.Roles}
+}
+
+// normalizeRoles checks the roles are known and makes sure the customer role
+// is always kept
+func normalizeRoles(r []string) ([]string, error) {
+	normalized := []string{RoleCustomer}
+	for _, role := range r {
+		if !roles[role] {
+			return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidArgument, role)
+		}
+		if role != RoleCustomer && !slices.Contains(normalized, role) {
+			normalized = append(normalized, role)
+		}
+	}
+	return normalized, nil
+}
+
+func normalizeEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" {
+		return "", fmt.Errorf("%w: invalid email %q", ErrInvalidArgument, email)
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// emailTaken explains the unique violation of the email column, the only
+// one an account can run into besides its ksuid
+func emailTaken(err error, email string) error {
+	if errors.Is(err, ErrAlreadyExists) {
+		return fmt.Errorf("%w: email %s is already in use", ErrAlreadyExists, email)
+	}
+	return err
+}
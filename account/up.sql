@@ -1,4 +1,55 @@
-CREATE TABLE IF NOT EXISTS `accounts` (
+CREATE TABLE IF NOT EXISTS accounts (
    id CHAR(27) PRIMARY KEY,
-   name VARCHAR(255) NOT NULL
-);
\ No newline at end of file
+   name VARCHAR(255) NOT NULL,
+   email VARCHAR(255) NOT NULL UNIQUE,
+   created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+   updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+   active BOOLEAN NOT NULL DEFAULT TRUE,
+   -- the first admin has to be granted by hand:
+   -- UPDATE accounts SET roles = '{customer,admin}' WHERE email = '...';
+   roles TEXT[] NOT NULL DEFAULT '{customer}',
+   password_hash VARCHAR(60) NOT NULL
+);
+
+-- the statements below migrate the accounts table created by older versions
+-- of this file, which only had an id and a name, and do nothing to an up to
+-- date one
+
+-- older accounts have no email to log in with: they get one under the
+-- reserved .invalid domain, which an admin can replace with their real one
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+UPDATE accounts SET email = id || '@accounts.invalid' WHERE email IS NULL;
+ALTER TABLE accounts ALTER COLUMN email SET NOT NULL;
+-- named like the index of the UNIQUE constraint of a new table
+CREATE UNIQUE INDEX IF NOT EXISTS accounts_email_key ON accounts (email);
+
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+ALTER TABLE accounts ALTER COLUMN created_at DROP DEFAULT;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+ALTER TABLE accounts ALTER COLUMN updated_at DROP DEFAULT;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{customer}';
+-- without a password hash, older accounts cannot log in
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS password_hash VARCHAR(60) NOT NULL DEFAULT '';
+ALTER TABLE accounts ALTER COLUMN password_hash DROP DEFAULT;
+
+-- idempotency keys of Post requests, see internal/idempotency
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+   key VARCHAR(255) PRIMARY KEY,
+   fingerprint CHAR(64) NOT NULL,
+   response BYTEA,
+   created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+
+-- events waiting to be published, see internal/outbox
+CREATE TABLE IF NOT EXISTS outbox (
+   id CHAR(27) PRIMARY KEY,
+   type VARCHAR(64) NOT NULL,
+   aggregate_id VARCHAR(255) NOT NULL,
+   data JSONB NOT NULL,
+   occurred_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_occurred_at ON outbox (occurred_at);
@@ -2,8 +2,19 @@ package catalog
 
 import (
 	"context"
+	"errors"
 	"github.com/ndquang191/go-graph-grpc/catalog/pb"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/stream"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"io"
+	"iter"
 )
 
 type Client struct {
@@ -11,8 +22,18 @@ type Client struct {
 	service pb.CatalogServiceClient
 }
 
-func NewClient(url string) (*Client, error) {
-	conn, err := grpc.Dial(url, grpc.WithInsecure())
+// NewClient dials the service at url. Extra dial options are applied after
+// the default insecure transport, so they can override it. Status errors
+// returned by the service are translated back to errs.Error values, and
+// calls carry the OpenTelemetry trace context and request ID of ctx.
+func NewClient(url string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(errs.UnaryClientInterceptor, logging.UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(errs.StreamClientInterceptor, logging.StreamClientInterceptor),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}, opts...)
+	conn, err := grpc.Dial(url, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -29,11 +50,18 @@ func (c *Client) Close() {
 	c.conn.Close()
 }
 
-func (c *Client) PostProduct(ctx context.Context, name, description string, price float64) (*Product, error) {
+// PostProduct creates a product. Retries with the same non-empty
+// idempotencyKey and createdBy return the product created by the first
+// request.
+func (c *Client) PostProduct(ctx context.Context, name, description string, price money.Money, stock uint32, idempotencyKey, createdBy string) (*Product, error) {
 	r, err := c.service.PostProduct(ctx, &pb.PostProductRequest{
-		Name:        name,
-		Description: description,
-		Price:       price,
+		Name:           name,
+		Description:    description,
+		Price:          moneyProto(price),
+		PriceFloat:     price.Float(),
+		Stock:          stock,
+		IdempotencyKey: idempotencyKey,
+		CreatedBy:      createdBy,
 	})
 	if err != nil {
 		return nil, err
@@ -42,7 +70,8 @@ func (c *Client) PostProduct(ctx context.Context, name, description string, pric
 		ID:          r.Product.Id,
 		Name:        r.Product.Name,
 		Description: r.Product.Description,
-		Price:       r.Product.Price,
+		Price:       decodePrice(r.Product.Price, r.Product.PriceFloat),
+		Stock:       r.Product.Stock,
 	}, nil
 }
 
@@ -66,6 +95,9 @@ func (c *Client) GetProduct(ctx context.Context, id string) (*pb.Product, error)
 		Name:        r.Product.Name,
 		Description: r.Product.Description,
 		Price:       r.Product.Price,
+		PriceFloat:  r.Product.PriceFloat,
+		Stock:       r.Product.Stock,
+		Deleted:     r.Product.Deleted,
 	}, nil
 
 }
@@ -81,15 +113,185 @@ func (c *Client) GetProducts(ctx context.Context, skip uint64, take uint64, ids
 		return nil, err
 	}
 
-	products := []Product{}
-	for _, p := range r.Products {
-		products = append(products, Product{
-			ID:          p.Id,
+	return decodeProducts(r.Products), nil
+}
+
+// GetProductsPage lists products, or searches them when query is set, one
+// cursor paginated page at a time
+func (c *Client) GetProductsPage(ctx context.Context, query string, after string, first uint64) (*ProductPage, error) {
+	r, err := c.service.GetProducts(ctx, &pb.GetProductsRequest{
+		Take:  first,
+		Query: query,
+		After: after,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProductPage{
+		Products:    decodeProducts(r.Products),
+		Cursors:     r.Cursors,
+		HasNextPage: r.HasNextPage,
+	}, nil
+}
+
+func (c *Client) ReserveStock(ctx context.Context, items []StockItem) error {
+	_, err := c.service.ReserveStock(ctx, &pb.ReserveStockRequest{
+		Items: stockItemsProto(items),
+	})
+	return err
+}
+
+func (c *Client) ReleaseStock(ctx context.Context, items []StockItem) error {
+	_, err := c.service.ReleaseStock(ctx, &pb.ReleaseStockRequest{
+		Items: stockItemsProto(items),
+	})
+	return err
+}
+
+func (c *Client) CommitStock(ctx context.Context, items []StockItem) error {
+	_, err := c.service.CommitStock(ctx, &pb.CommitStockRequest{
+		Items: stockItemsProto(items),
+	})
+	return err
+}
+
+func (c *Client) ReturnStock(ctx context.Context, items []StockItem) error {
+	_, err := c.service.ReturnStock(ctx, &pb.ReturnStockRequest{
+		Items: stockItemsProto(items),
+	})
+	return err
+}
+
+func stockItemsProto(items []StockItem) []*pb.StockItem {
+	res := []*pb.StockItem{}
+	for _, i := range items {
+		res = append(res, &pb.StockItem{
+			ProductId: i.ProductID,
+			Quantity:  i.Quantity,
+		})
+	}
+	return res
+}
+
+// UpdateProduct sets the fields of the product named in fields, see
+// UpdatableFields, and returns the updated product
+func (c *Client) UpdateProduct(ctx context.Context, product Product, fields []string) (*Product, error) {
+	r, err := c.service.UpdateProduct(ctx, &pb.UpdateProductRequest{
+		Product: &pb.Product{
+			Id:          product.ID,
+			Name:        product.Name,
+			Description: product.Description,
+			Price:       moneyProto(product.Price),
+			PriceFloat:  product.Price.Float(),
+			Stock:       product.Stock,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: fields},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := decodeProduct(r.Product)
+	return &p, nil
+}
+
+func (c *Client) DeleteProduct(ctx context.Context, id string) (*Product, error) {
+	r, err := c.service.DeleteProduct(ctx, &pb.DeleteProductRequest{
+		Id: id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := decodeProduct(r.Product)
+	return &p, nil
+}
+
+// StreamProducts yields every product in ID order, deleted ones included,
+// receiving them as the loop asks for them. It ends with an error if the
+// stream is cut short.
+func (c *Client) StreamProducts(ctx context.Context) iter.Seq2[Product, error] {
+	return stream.Recv(ctx,
+		func(ctx context.Context) (pb.CatalogService_StreamProductsClient, error) {
+			return c.service.StreamProducts(ctx, &pb.StreamProductsRequest{})
+		},
+		func(res *pb.StreamProductsResponse) Product { return decodeProduct(res.Product) },
+	)
+}
+
+// ImportProducts sends products to the catalog, which stores them in
+// batches, and reports how the import went once they are all stored. Sending
+// blocks while the catalog is behind, so products is read only as fast as
+// they are stored. The IDs of the products are ignored.
+func (c *Client) ImportProducts(ctx context.Context, products iter.Seq[Product]) (*ImportReport, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	upload, err := c.service.ImportProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for p := range products {
+		err := upload.Send(&pb.ImportProductsRequest{
 			Name:        p.Name,
 			Description: p.Description,
-			Price:       p.Price,
+			Price:       moneyProto(p.Price),
+			Stock:       p.Stock,
 		})
+		// the catalog ended the call, CloseAndRecv returns why
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return products, nil
+	r, err := upload.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{Imported: int(r.Imported), Failed: int(r.Failed)}
+	for _, f := range r.Failures {
+		report.Failures = append(report.Failures, ImportFailure{
+			Index: int(f.Index),
+			Err:   errs.FromStatus(status.Error(codes.Code(f.Code), f.Message)),
+		})
+	}
+	return report, nil
+}
+
+func decodeProduct(p *pb.Product) Product {
+	return Product{
+		ID:          p.Id,
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       decodePrice(p.Price, p.PriceFloat),
+		Stock:       p.Stock,
+		Deleted:     p.Deleted,
+	}
+}
+
+func decodeProducts(res []*pb.Product) []Product {
+	products := []Product{}
+	for _, p := range res {
+		products = append(products, decodeProduct(p))
+	}
+	return products
+}
+
+func decodeMoney(m *pb.Money) money.Money {
+	return money.New(m.GetAmount(), m.GetCurrency())
+}
+
+// decodePrice reads price, falling back to the deprecated float price of the
+// clients and servers built before Money, which priced in USD
+func decodePrice(price *pb.Money, priceFloat float64) money.Money {
+	if price == nil && priceFloat != 0 {
+		return money.FromFloat(priceFloat, money.DefaultCurrency)
+	}
+	return decodeMoney(price)
 }
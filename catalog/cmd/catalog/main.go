@@ -1,16 +1,42 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/mtls"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
+	"github.com/ndquang191/go-graph-grpc/internal/tracing"
 	"github.com/tinrab/retry"
 )
 
 type Config struct {
 	DatabaseURL string `envconfig:"DATABASE_URL"`
+	// Storage selects the repository: "elastic" or "memory"
+	Storage string      `envconfig:"STORAGE" default:"elastic"`
+	TLS     mtls.Config `envconfig:"TLS"`
+	// Port is the port the gRPC server listens on
+	Port int `envconfig:"PORT" default:"8080"`
+	// DrainTimeout bounds how long in-flight calls may take to finish on
+	// shutdown
+	DrainTimeout time.Duration  `envconfig:"DRAIN_TIMEOUT" default:"10s"`
+	Tracing      tracing.Config `envconfig:"TRACING"`
+	Log          logging.Config `envconfig:"LOG"`
+	// AdminPort serves the metrics at /metrics, apart from the gRPC port
+	AdminPort int `envconfig:"ADMIN_PORT" default:"9090"`
+	// IdempotencyRetention is how long idempotency keys of Post requests are
+	// remembered
+	IdempotencyRetention time.Duration `envconfig:"IDEMPOTENCY_RETENTION" default:"24h"`
+	// OutboxInterval is how often stored events are relayed to the broker
+	OutboxInterval time.Duration `envconfig:"OUTBOX_INTERVAL" default:"1s"`
 }
 
 func main() {
@@ -18,23 +44,66 @@ func main() {
 
 	err := envconfig.Process("", &cfg)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(slog.Default(), "Failed to read the config", "error", err)
+	}
 
+	logger, err := logging.New(os.Stderr, cfg.Log, "catalog")
+	if err != nil {
+		logging.Fatal(slog.Default(), "Failed to set up logging", "error", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "catalog", cfg.Tracing)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up tracing", "error", err)
 	}
 
 	var r catalog.Repository
 
-	retry.ForeverSleep(2*time.Second, func(_ int) (err error) {
-		r, err = catalog.NewElasticRepository(cfg.DatabaseURL)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return nil
-	})
+	if cfg.Storage == "memory" {
+		r = catalog.NewMemoryRepository()
+		logger.Info("Using in-memory storage")
+	} else {
+		retry.ForeverSleep(2*time.Second, func(_ int) (err error) {
+			r, err = catalog.NewElasticRepository(cfg.DatabaseURL)
+			if err != nil {
+				logger.Warn("Failed to connect to Elasticsearch, retrying", "error", err)
+			}
+			return
+		})
+		logger.Info("Connected to Elasticsearch")
+	}
 
-	defer r.Close()
-	log.Println("Connected to Elastic")
+	opts, err := cfg.TLS.ServerOptions()
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS credentials", "error", err)
+	}
 
 	s := catalog.NewService(r)
-	log.Fatal(catalog.ListenGRPC(s, 8080))
+	// events reach subscribers in this process only, until a networked
+	// events.Broker is plugged in here
+	broker := events.NewMemoryBroker()
+	broker.Subscribe(">", events.LogHandler(logger))
+	relay := outbox.NewRelay(r.Outbox(), broker, cfg.OutboxInterval, logger)
+	relay.Start()
+
+	srv := catalog.NewGRPCServer(s, idempotency.New(r, cfg.IdempotencyRetention),
+		// cleanups run in reverse order, so spans are flushed last
+		server.OnShutdown(func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.Error("Failed to flush spans", "error", err)
+			}
+		}),
+		server.WithLogger(logger),
+		server.WithPort(cfg.Port),
+		server.WithAdminPort(cfg.AdminPort),
+		server.WithServerOptions(opts...),
+		server.WithDrainTimeout(cfg.DrainTimeout),
+		server.WithHealthCheck(r.Ping),
+		server.OnShutdown(r.Close),
+		server.OnShutdown(relay.Stop),
+	)
+	if err := srv.Run(context.Background()); err != nil {
+		logging.Fatal(logger, "Server failed", "error", err)
+	}
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+)
+
+// errFailed ends an import in which some products failed, once they are
+// reported
+var errFailed = errors.New("some products were not imported")
+
+const importArgs = `FILE...
+
+Imports the products of CSV or JSON Lines files, "-" reading standard input.
+CSV files start with a header naming the columns among name, description,
+price, currency and stock; JSON Lines files hold an object with these fields
+per line. Prices are decimal amounts, such as 19.99, in the currency, which
+defaults to ` + money.DefaultCurrency + `.`
+
+func runImport(ctx context.Context, cfg Config, args []string) error {
+	flags := newFlagSet("import", importArgs)
+	addr := flags.String("addr", cfg.CatalogURL, "address of the catalog service")
+	format := flags.String("format", "", `format of the files, "csv" or "jsonl" (default guessed from the file extension)`)
+	flags.Parse(args)
+
+	files := flags.Args()
+	if len(files) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	formats := make([]string, len(files))
+	for i, file := range files {
+		f, err := fileFormat(file, *format)
+		if err != nil {
+			return err
+		}
+		formats[i] = f
+	}
+
+	client, err := dial(cfg, *addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// sources[i] is where the i-th product sent was read, as file:line
+	var sources []string
+	invalid := 0
+	products := func(yield func(catalog.Product) bool) {
+		for i, file := range files {
+			for r := range readFile(file, formats[i]) {
+				if r.err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", r.source, r.err)
+					invalid++
+					continue
+				}
+
+				sources = append(sources, r.source)
+				if !yield(r.product) {
+					return
+				}
+			}
+		}
+	}
+
+	start := time.Now()
+	report, err := client.ImportProducts(ctx, products)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	for _, f := range report.Failures {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", sources[f.Index], f.Err)
+	}
+	if more := report.Failed - len(report.Failures); more > 0 {
+		fmt.Fprintf(os.Stderr, "... and %d more products not imported\n", more)
+	}
+
+	failed := report.Failed + invalid
+	fmt.Printf("Imported %d products in %s (%.0f products/s), %d failed\n",
+		report.Imported, elapsed.Round(time.Millisecond), float64(report.Imported)/elapsed.Seconds(), failed)
+	if failed != 0 {
+		return errFailed
+	}
+	return nil
+}
+
+// fileFormat returns format, or the format of file going by its extension
+func fileFormat(file, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		}
+	}
+
+	switch {
+	case format == "csv", format == "jsonl":
+		return format, nil
+	case format == "":
+		return "", fmt.Errorf("%s: unknown format, set -format to csv or jsonl", file)
+	}
+	return "", fmt.Errorf("unknown format %q, want csv or jsonl", format)
+}
+
+// record is a product read from a file, or why it could not be read
+type record struct {
+	product catalog.Product
+	// source is the line of the product, empty for errors reading the file
+	source string
+	err    error
+}
+
+// readFile yields the records of file, "-" being standard input
+func readFile(file, format string) iter.Seq[record] {
+	return func(yield func(record) bool) {
+		in := os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				yield(record{source: file, err: err})
+				return
+			}
+			defer f.Close()
+			in = f
+		}
+
+		read := readCSV
+		if format == "jsonl" {
+			read = readJSONLines
+		}
+		for r := range read(in) {
+			if r.source == "" {
+				r.source = file
+			} else {
+				r.source = file + ":" + r.source
+			}
+			if !yield(r) {
+				return
+			}
+		}
+	}
+}
+
+// readCSV yields the records of CSV rows, their source being the line
+func readCSV(in io.Reader) iter.Seq[record] {
+	return func(yield func(record) bool) {
+		reader := csv.NewReader(in)
+		reader.TrimLeadingSpace = true
+
+		header, err := reader.Read()
+		if err != nil {
+			yield(record{source: "1", err: fmt.Errorf("read the header: %w", err)})
+			return
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, required := range []string{"name", "price"} {
+			if _, ok := columns[required]; !ok {
+				yield(record{source: "1", err: fmt.Errorf("no %s column in the header", required)})
+				return
+			}
+		}
+
+		for {
+			row, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+
+			var r record
+			var parseErr *csv.ParseError
+			switch {
+			case errors.As(err, &parseErr):
+				// the next rows can still be read
+				r.source = strconv.Itoa(parseErr.StartLine)
+				r.err = parseErr.Err
+			case err != nil:
+				yield(record{err: err})
+				return
+			default:
+				line, _ := reader.FieldPos(0)
+				r.source = strconv.Itoa(line)
+				field := func(name string) string {
+					if i, ok := columns[name]; ok && i < len(row) {
+						return strings.TrimSpace(row[i])
+					}
+					return ""
+				}
+				r.product, r.err = newProduct(field("name"), field("description"), field("price"), field("currency"), field("stock"))
+			}
+
+			if !yield(r) {
+				return
+			}
+		}
+	}
+}
+
+// jsonProduct is a line of a JSON Lines file. Prices may be numbers or
+// strings, strings keeping amounts like 0.10 exact.
+type jsonProduct struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       json.Number `json:"price"`
+	Currency    string      `json:"currency"`
+	Stock       json.Number `json:"stock"`
+}
+
+// readJSONLines yields the records of JSON Lines, their source being the
+// line. Blank lines are skipped.
+func readJSONLines(in io.Reader) iter.Seq[record] {
+	return func(yield func(record) bool) {
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			r := record{source: strconv.Itoa(line)}
+			var p jsonProduct
+			if r.err = json.Unmarshal([]byte(text), &p); r.err == nil {
+				r.product, r.err = newProduct(p.Name, p.Description, p.Price.String(), p.Currency, p.Stock.String())
+			}
+			if !yield(r) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(record{err: err})
+		}
+	}
+}
+
+// newProduct parses the fields of a product read from a file. The catalog
+// validates the product further.
+func newProduct(name, description, price, currency, stock string) (catalog.Product, error) {
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	if price == "" {
+		return catalog.Product{}, errors.New("price is required")
+	}
+	m, err := money.Parse(price, strings.ToUpper(currency))
+	if err != nil {
+		return catalog.Product{}, err
+	}
+
+	var units uint64
+	if stock != "" {
+		if units, err = strconv.ParseUint(stock, 10, 32); err != nil {
+			return catalog.Product{}, fmt.Errorf("invalid stock %q", stock)
+		}
+	}
+
+	return catalog.Product{
+		Name:        name,
+		Description: description,
+		Price:       m,
+		Stock:       uint32(units),
+	}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"iter"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+)
+
+func TestNewProduct(t *testing.T) {
+	tests := []struct {
+		price, currency, stock string
+		want                   catalog.Product
+		// err is part of the error message, empty if the product is valid
+		err string
+	}{
+		{"19.99", "USD", "5", catalog.Product{Name: "Mug", Price: money.New(1999, "USD"), Stock: 5}, ""},
+		{"0.10", "EUR", "", catalog.Product{Name: "Mug", Price: money.New(10, "EUR")}, ""},
+		{"12", "", "0", catalog.Product{Name: "Mug", Price: money.New(1200, money.DefaultCurrency)}, ""},
+		{"1500", "jpy", "1", catalog.Product{Name: "Mug", Price: money.New(1500, "JPY"), Stock: 1}, ""},
+		{"1.234", "KWD", "", catalog.Product{Name: "Mug", Price: money.New(1234, "KWD")}, ""},
+		{"", "USD", "1", catalog.Product{}, "price is required"},
+		{"1.999", "USD", "1", catalog.Product{}, money.ErrInvalidAmount.Error()},
+		{"1.5", "JPY", "1", catalog.Product{}, money.ErrInvalidAmount.Error()},
+		{"$5", "USD", "1", catalog.Product{}, money.ErrInvalidAmount.Error()},
+		{"5", "DOLLARS", "1", catalog.Product{}, money.ErrInvalidCurrency.Error()},
+		{"5", "USD", "-1", catalog.Product{}, `invalid stock "-1"`},
+		{"5", "USD", "4294967296", catalog.Product{}, `invalid stock "4294967296"`},
+	}
+	for _, tt := range tests {
+		got, err := newProduct("Mug", "", tt.price, tt.currency, tt.stock)
+		if !matches(err, tt.err) || got != tt.want {
+			t.Errorf("newProduct(%q, %q, %q) = %+v, %v, want %+v, %q", tt.price, tt.currency, tt.stock, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []record
+		// errs are part of the error messages of the records, in order
+		errs []string
+	}{
+		{
+			name: "header in any order and case",
+			in:   " Stock,PRICE , name,Currency\n3,9.50,Mug,eur\n",
+			want: []record{
+				{source: "2", product: catalog.Product{Name: "Mug", Price: money.New(950, "EUR"), Stock: 3}},
+			},
+			errs: []string{""},
+		},
+		{
+			name: "optional columns left out",
+			in:   "name,price\nMug,2\n",
+			want: []record{
+				{source: "2", product: catalog.Product{Name: "Mug", Price: money.New(200, money.DefaultCurrency)}},
+			},
+			errs: []string{""},
+		},
+		{
+			name: "unknown columns ignored",
+			in:   "sku,name,description,price\nM-1,Mug,Blue,2\n",
+			want: []record{
+				{source: "2", product: catalog.Product{Name: "Mug", Description: "Blue", Price: money.New(200, money.DefaultCurrency)}},
+			},
+			errs: []string{""},
+		},
+		{
+			name: "no price column",
+			in:   "name,stock\nMug,2\n",
+			want: []record{{source: "1"}},
+			errs: []string{"no price column"},
+		},
+		{
+			name: "empty file",
+			in:   "",
+			want: []record{{source: "1"}},
+			errs: []string{"read the header"},
+		},
+		{
+			name: "malformed rows between valid ones",
+			in:   "name,price\nMug,2\nBowl\nPlate,abc\nCup,\"1\nGlass,1\n",
+			want: []record{
+				{source: "2", product: catalog.Product{Name: "Mug", Price: money.New(200, money.DefaultCurrency)}},
+				{source: "3"},
+				{source: "4"},
+				{source: "5"},
+			},
+			errs: []string{"", "wrong number of fields", money.ErrInvalidAmount.Error(), "quote"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkRecords(t, readCSV(strings.NewReader(tt.in)), tt.want, tt.errs)
+		})
+	}
+}
+
+func TestReadJSONLines(t *testing.T) {
+	in := `{"name": "Mug", "price": 9.5, "currency": "EUR", "stock": 3}
+
+{"name": "Bowl", "price": "0.10"}
+{"name": "Plate", "price": 1.5, "currency": "JPY"}
+{"name": "Cup",
+{"name": "Glass", "price": 2, "stock": -1}
+`
+	want := []record{
+		{source: "1", product: catalog.Product{Name: "Mug", Price: money.New(950, "EUR"), Stock: 3}},
+		{source: "3", product: catalog.Product{Name: "Bowl", Price: money.New(10, money.DefaultCurrency)}},
+		{source: "4"},
+		{source: "5"},
+		{source: "6"},
+	}
+	errs := []string{"", "", money.ErrInvalidAmount.Error(), "unexpected end of JSON input", "invalid stock"}
+	checkRecords(t, readJSONLines(strings.NewReader(in)), want, errs)
+}
+
+// checkRecords compares the records of seq to want, and their errors to errs
+func checkRecords(t *testing.T, seq iter.Seq[record], want []record, errs []string) {
+	t.Helper()
+	got := slices.Collect(seq)
+	if len(got) != len(want) {
+		t.Fatalf("got %d records %+v, want %d", len(got), got, len(want))
+	}
+	for i := range got {
+		if got[i].source != want[i].source || got[i].product != want[i].product || !matches(got[i].err, errs[i]) {
+			t.Errorf("record %d = %+v, want %+v with error %q", i, got[i], want[i], errs[i])
+		}
+	}
+}
+
+// matches reports whether err contains msg, or is nil if msg is empty
+func matches(err error, msg string) bool {
+	if msg == "" {
+		return err == nil
+	}
+	return err != nil && strings.Contains(err.Error(), msg)
+}
@@ -0,0 +1,87 @@
+// Command catalogctl administers the catalog service over gRPC.
+//
+//	catalogctl import [-addr host:port] [-format csv|jsonl] FILE...
+//
+// imports the products of CSV or JSON Lines files, "-" reading standard
+// input. The address defaults to $CATALOG_SERVICE_URL, and the client
+// certificate is read from the TLS_* variables like in the services.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/mtls"
+)
+
+type Config struct {
+	CatalogURL string      `envconfig:"CATALOG_SERVICE_URL" default:"localhost:8080"`
+	TLS        mtls.Config `envconfig:"TLS"`
+}
+
+const usage = `Usage: catalogctl <command> [flags]
+
+Commands:
+  import    import products from CSV or JSON Lines files
+
+Run catalogctl <command> -h for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var cfg Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		fatal(fmt.Errorf("read the config: %w", err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "import":
+		err = runImport(ctx, cfg, args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "catalogctl: unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// dial connects to the catalog service at addr
+func dial(cfg Config, addr string) (*catalog.Client, error) {
+	opts, err := cfg.TLS.DialOptions()
+	if err != nil {
+		return nil, err
+	}
+	return catalog.NewClient(addr, opts...)
+}
+
+// newFlagSet returns the flag set of a command, exiting on -h
+func newFlagSet(name, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: catalogctl %s [flags] %s\n\nFlags:\n", name, args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "catalogctl: %v\n", err)
+	os.Exit(1)
+}
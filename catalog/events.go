@@ -0,0 +1,11 @@
+package catalog
+
+import "github.com/ndquang191/go-graph-grpc/internal/events"
+
+// productPriceChanged returns the event recording the new price of product
+func productPriceChanged(product *Product) (events.Event, error) {
+	return events.New(events.TypeProductPriceChanged, product.ID, events.ProductPriceChanged{
+		ProductID: product.ID,
+		Price:     product.Price,
+	})
+}
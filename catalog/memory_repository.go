@@ -0,0 +1,397 @@
+package catalog
+
+import (
+	"context"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"iter"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/agnivade/levenshtein"
+)
+
+type memoryRepository struct {
+	*idempotency.MemoryStore
+	mu       sync.RWMutex
+	products map[string]productDocument
+	events   *outbox.MemoryStore
+}
+
+// NewMemoryRepository returns a thread-safe Repository backed by process
+// memory, for running the service without Elasticsearch
+func NewMemoryRepository() Repository {
+	return &memoryRepository{
+		MemoryStore: idempotency.NewMemoryStore(),
+		products:    map[string]productDocument{},
+		events:      outbox.NewMemoryStore(),
+	}
+}
+
+func (r *memoryRepository) Close() {
+}
+
+func (r *memoryRepository) Outbox() outbox.Store {
+	return r.events
+}
+
+func (r *memoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRepository) PutProduct(ctx context.Context, product *Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.products[product.ID]; ok {
+		return ErrAlreadyExists
+	}
+
+	r.products[product.ID] = productDocument{
+		ID:          product.ID,
+		Name:        product.Name,
+		Description: product.Description,
+		PriceAmount: product.Price.Amount,
+		Currency:    product.Price.Currency,
+		Stock:       product.Stock,
+	}
+	return nil
+}
+
+func (r *memoryRepository) PutProducts(ctx context.Context, products []Product) ([]error, error) {
+	failures := make([]error, len(products))
+	for i := range products {
+		failures[i] = r.PutProduct(ctx, &products[i])
+	}
+	return failures, nil
+}
+
+func (r *memoryRepository) GetProductByID(ctx context.Context, id string) (*Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	doc, ok := r.products[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	p := toProduct(id, doc)
+	return &p, nil
+}
+
+// ListProducts returns products ordered by name, like the Elasticsearch
+// repository does
+func (r *memoryRepository) ListProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return page(r.sortedProducts(), skip, take), nil
+}
+
+func (r *memoryRepository) ListProductsAfter(ctx context.Context, after []interface{}, take uint64) ([]Product, [][]interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	afterName, afterID := "", ""
+	if len(after) == 2 {
+		afterName, _ = after[0].(string)
+		afterID, _ = after[1].(string)
+	}
+
+	products := []Product{}
+	sortValues := [][]interface{}{}
+	for _, p := range r.sortedProducts() {
+		if len(after) != 0 && (p.Name < afterName || (p.Name == afterName && p.ID <= afterID)) {
+			continue
+		}
+		if uint64(len(products)) == take {
+			break
+		}
+		products = append(products, p)
+		sortValues = append(sortValues, []interface{}{p.Name, p.ID})
+	}
+	return products, sortValues, nil
+}
+
+func (r *memoryRepository) ListProductsWithIDs(ctx context.Context, ids []string) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	products := []Product{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		doc, ok := r.products[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		products = append(products, toProduct(id, doc))
+	}
+	return products, nil
+}
+
+func (r *memoryRepository) SearchProducts(ctx context.Context, query string, skip uint64, take uint64) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hits := r.search(query)
+
+	products := make([]Product, 0, len(hits))
+	for _, h := range hits {
+		products = append(products, h.product)
+	}
+
+	return page(products, skip, take), nil
+}
+
+func (r *memoryRepository) SearchProductsAfter(ctx context.Context, query string, after []interface{}, take uint64) ([]Product, [][]interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	afterScore, afterID := 0.0, ""
+	if len(after) == 2 {
+		afterScore, _ = after[0].(float64)
+		afterID, _ = after[1].(string)
+	}
+
+	products := []Product{}
+	sortValues := [][]interface{}{}
+	for _, h := range r.search(query) {
+		score := float64(h.score)
+		if len(after) != 0 && (score > afterScore || (score == afterScore && h.product.ID <= afterID)) {
+			continue
+		}
+		if uint64(len(products)) == take {
+			break
+		}
+		products = append(products, h.product)
+		sortValues = append(sortValues, []interface{}{score, h.product.ID})
+	}
+	return products, sortValues, nil
+}
+
+// sortedProducts returns all products ordered by name and ID, which is the
+// order of the Elasticsearch listings
+func (r *memoryRepository) sortedProducts() []Product {
+	products := make([]Product, 0, len(r.products))
+	for id, doc := range r.products {
+		if !doc.Deleted {
+			products = append(products, toProduct(id, doc))
+		}
+	}
+
+	sort.Slice(products, func(i, j int) bool {
+		if products[i].Name == products[j].Name {
+			return products[i].ID < products[j].ID
+		}
+		return products[i].Name < products[j].Name
+	})
+	return products
+}
+
+type searchHit struct {
+	product Product
+	score   int
+}
+
+// search approximates the Elasticsearch multi_match query with fuzziness
+// AUTO: every query term is compared against the words of the name and
+// description, and products are ranked by how many terms matched.
+func (r *memoryRepository) search(query string) []searchHit {
+	terms := strings.Fields(strings.ToLower(query))
+
+	hits := []searchHit{}
+	for id, doc := range r.products {
+		if doc.Deleted {
+			continue
+		}
+		words := strings.Fields(strings.ToLower(doc.Name + " " + doc.Description))
+
+		score := 0
+		for _, term := range terms {
+			for _, word := range words {
+				if fuzzyMatch(term, word) {
+					score++
+					break
+				}
+			}
+		}
+
+		if score > 0 {
+			hits = append(hits, searchHit{product: toProduct(id, doc), score: score})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].product.ID < hits[j].product.ID
+	})
+	return hits
+}
+
+func (r *memoryRepository) ReserveStock(ctx context.Context, id string, quantity uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	if doc.Deleted || doc.available() < quantity {
+		return ErrInsufficientStock
+	}
+
+	doc.Reserved += quantity
+	r.products[id] = doc
+	return nil
+}
+
+func (r *memoryRepository) ReleaseStock(ctx context.Context, id string, quantity uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	doc.Reserved = subtract(doc.Reserved, quantity)
+	r.products[id] = doc
+	return nil
+}
+
+func (r *memoryRepository) CommitStock(ctx context.Context, id string, quantity uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	doc.Stock = subtract(doc.Stock, quantity)
+	doc.Reserved = subtract(doc.Reserved, quantity)
+	r.products[id] = doc
+	return nil
+}
+
+func (r *memoryRepository) ReturnStock(ctx context.Context, id string, quantity uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	doc.Stock += quantity
+	r.products[id] = doc
+	return nil
+}
+
+func (r *memoryRepository) UpdateProduct(ctx context.Context, product *Product, fields []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.products[product.ID]
+	if !ok || doc.Deleted {
+		return ErrNotFound
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "name":
+			doc.Name = product.Name
+		case "description":
+			doc.Description = product.Description
+		case "price":
+			if doc.price() != product.Price {
+				event, err := productPriceChanged(product)
+				if err != nil {
+					return err
+				}
+				r.events.Add(event)
+			}
+			doc.PriceAmount = product.Price.Amount
+			doc.Currency = product.Price.Currency
+		case "stock":
+			doc.Stock = product.Stock + doc.Reserved
+		}
+	}
+	r.products[product.ID] = doc
+	return nil
+}
+
+func (r *memoryRepository) DeleteProduct(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	doc.Deleted = true
+	r.products[id] = doc
+	return nil
+}
+
+// StreamProducts yields a snapshot of the products taken when it starts
+func (r *memoryRepository) StreamProducts(ctx context.Context) iter.Seq2[Product, error] {
+	return func(yield func(Product, error) bool) {
+		r.mu.RLock()
+		products := make([]Product, 0, len(r.products))
+		for id, doc := range r.products {
+			products = append(products, toProduct(id, doc))
+		}
+		r.mu.RUnlock()
+
+		sort.Slice(products, func(i, j int) bool {
+			return products[i].ID < products[j].ID
+		})
+		for _, p := range products {
+			if err := ctx.Err(); err != nil {
+				yield(Product{}, err)
+				return
+			}
+			if !yield(p, nil) {
+				return
+			}
+		}
+	}
+}
+
+func page(products []Product, skip uint64, take uint64) []Product {
+	if skip >= uint64(len(products)) {
+		return []Product{}
+	}
+	end := skip + take
+	if end > uint64(len(products)) {
+		end = uint64(len(products))
+	}
+	return products[skip:end]
+}
+
+// fuzzyMatch mirrors Elasticsearch's AUTO fuzziness: exact match for terms
+// of up to two characters, one edit for three to five, two edits beyond.
+func fuzzyMatch(term, word string) bool {
+	maxEdits := 2
+	switch n := len([]rune(term)); {
+	case n <= 2:
+		maxEdits = 0
+	case n <= 5:
+		maxEdits = 1
+	}
+	return levenshtein.ComputeDistance(term, word) <= maxEdits
+}
+
+func subtract(a, b uint32) uint32 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
@@ -5,36 +5,210 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"sort"
+	"time"
+
 	elastic "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/metrics"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
 )
 
 var (
-	ErrNotFound = errors.New("Entity not found")
+	ErrNotFound          = errs.New(errs.NotFound, "product not found")
+	ErrInvalidArgument   = errs.New(errs.InvalidArgument, "invalid product")
+	ErrAlreadyExists     = errs.New(errs.AlreadyExists, "product already exists")
+	ErrUnavailable       = errs.New(errs.Unavailable, "catalog storage unavailable")
+	ErrInsufficientStock = errs.New(errs.FailedPrecondition, "insufficient stock")
 )
 
 type Repository interface {
 	Close()
+	// Ping reports whether the storage is reachable
+	Ping(ctx context.Context) error
+	// Store keeps the idempotency keys of Post requests next to the data
+	// they created
+	idempotency.Store
+	// Outbox holds the events of the changes made through the repository
+	// until they are published
+	Outbox() outbox.Store
 	PutProduct(ctx context.Context, product *Product) error
+	// PutProducts stores many products at once. The error of each product
+	// is returned at its position, nil for the products stored; the error
+	// returned last is for failures of the whole call.
+	PutProducts(ctx context.Context, products []Product) ([]error, error)
 	GetProductByID(ctx context.Context, id string) (*Product, error)
 	ListProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error)
 	ListProductsWithIDs(ctx context.Context, ids []string) ([]Product, error)
 	SearchProducts(ctx context.Context, query string, skip uint64, take uint64) ([]Product, error)
+	// ListProductsAfter and SearchProductsAfter page with search_after: after
+	// holds the sort values of the last product of the previous page, and the
+	// sort values of every returned product are returned alongside it.
+	ListProductsAfter(ctx context.Context, after []interface{}, take uint64) ([]Product, [][]interface{}, error)
+	SearchProductsAfter(ctx context.Context, query string, after []interface{}, take uint64) ([]Product, [][]interface{}, error)
+	ReserveStock(ctx context.Context, id string, quantity uint32) error
+	ReleaseStock(ctx context.Context, id string, quantity uint32) error
+	CommitStock(ctx context.Context, id string, quantity uint32) error
+	// ReturnStock puts committed units back in stock
+	ReturnStock(ctx context.Context, id string, quantity uint32) error
+	// UpdateProduct overwrites the named fields of a product with the values
+	// in product. Deleted products cannot be updated. A change of price is
+	// stored along with its ProductPriceChanged event.
+	UpdateProduct(ctx context.Context, product *Product, fields []string) error
+	DeleteProduct(ctx context.Context, id string) error
+	// StreamProducts yields every product in ID order, deleted ones
+	// included, reading them in batches as the caller consumes them
+	StreamProducts(ctx context.Context) iter.Seq2[Product, error]
 }
 
+// streamBatchSize is the number of products StreamProducts reads at once
+const streamBatchSize = 100
+
+// pitKeepAlive is how long the point in time of StreamProducts is kept
+// between two batches, so the most the caller may take over a batch
+const pitKeepAlive = "1m"
+
 type elasticRepository struct {
 	client *elastic.Client
 }
 
 type productDocument struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	PriceAmount int64  `json:"price_amount"`
+	Currency    string `json:"currency"`
+	Stock       uint32 `json:"stock"`
+	Reserved    uint32 `json:"reserved"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	// LegacyPrice is the float price of documents indexed before prices had
+	// a currency, read as an amount of money.DefaultCurrency
+	LegacyPrice float64 `json:"price,omitempty"`
+	// Outbox holds the events of the product until they are published.
+	// Elasticsearch has no transactions, but updates of a single document
+	// are atomic, so events are stored in the document they are about.
+	Outbox []events.Event `json:"outbox,omitempty"`
+}
+
+func (d productDocument) price() money.Money {
+	if d.Currency == "" {
+		return money.FromFloat(d.LegacyPrice, money.DefaultCurrency)
+	}
+	return money.New(d.PriceAmount, d.Currency)
+}
+
+// available returns the units that can still be reserved
+func (d productDocument) available() uint32 {
+	if d.Reserved > d.Stock {
+		return 0
+	}
+	return d.Stock - d.Reserved
+}
+
+func toProduct(id string, doc productDocument) Product {
+	return Product{
+		ID:          id,
+		Name:        doc.Name,
+		Description: doc.Description,
+		Price:       doc.price(),
+		Stock:       doc.available(),
+		Deleted:     doc.Deleted,
+	}
+}
+
+// notDeleted filters soft deleted products out of listings and searches
+var notDeleted = map[string]interface{}{
+	"term": map[string]interface{}{"deleted": true},
+}
+
+// productSort orders listings by name, with the ID as tiebreaker so every
+// product has a unique position for search_after
+var productSort = []map[string]interface{}{
+	{"name.keyword": map[string]string{"order": "asc"}},
+	{"id.keyword": map[string]string{"order": "asc"}},
+}
+
+// searchSort orders search results by relevance, with the ID as tiebreaker
+var searchSort = []map[string]interface{}{
+	{"_score": map[string]string{"order": "desc"}},
+	{"id.keyword": map[string]string{"order": "asc"}},
 }
 
-// NewElasticRepository initializes the repository with Elasticsearch v8
+// Painless scripts run by the update API, so reading and writing the stock
+// counters of a document happens atomically on the Elasticsearch side.
+const (
+	reserveStockScript = `
+		long stock = ctx._source.stock == null ? 0 : ctx._source.stock;
+		long reserved = ctx._source.reserved == null ? 0 : ctx._source.reserved;
+		if (ctx._source.deleted == true || stock - reserved < params.quantity) {
+			ctx.op = 'noop';
+		} else {
+			ctx._source.reserved = reserved + params.quantity;
+		}`
+	releaseStockScript = `
+		long reserved = ctx._source.reserved == null ? 0 : ctx._source.reserved;
+		ctx._source.reserved = Math.max(0, reserved - params.quantity);`
+	commitStockScript = `
+		long stock = ctx._source.stock == null ? 0 : ctx._source.stock;
+		long reserved = ctx._source.reserved == null ? 0 : ctx._source.reserved;
+		ctx._source.stock = Math.max(0, stock - params.quantity);
+		ctx._source.reserved = Math.max(0, reserved - params.quantity);`
+	returnStockScript = `
+		long stock = ctx._source.stock == null ? 0 : ctx._source.stock;
+		ctx._source.stock = stock + params.quantity;`
+	// stock is given as the units available for sale, so units held by
+	// pending orders are added back on top of it. params.event is added to
+	// the outbox if the price changes.
+	updateProductScript = `
+		if (ctx._source.deleted == true) {
+			ctx.op = 'noop';
+		} else {
+			boolean priceChanged = params.fields.containsKey('price_amount') && (
+				ctx._source.price_amount == null ||
+				((Number) ctx._source.price_amount).longValue() != ((Number) params.fields.price_amount).longValue() ||
+				ctx._source.currency != params.fields.currency);
+			if (priceChanged) {
+				if (ctx._source.outbox == null) {
+					ctx._source.outbox = [];
+				}
+				ctx._source.outbox.add(params.event);
+			}
+			for (field in params.fields.entrySet()) {
+				ctx._source[field.getKey()] = field.getValue();
+			}
+			if (params.fields.containsKey('stock')) {
+				long reserved = ctx._source.reserved == null ? 0 : ctx._source.reserved;
+				ctx._source.stock = params.fields.stock + reserved;
+			}
+		}`
+	deleteProductScript = `
+		ctx._source.deleted = true;`
+	markPublishedScript = `
+		if (ctx._source.outbox == null) {
+			ctx.op = 'noop';
+		} else {
+			ctx._source.outbox.removeIf(e -> params.ids.contains(e.id));
+			if (ctx._source.outbox.isEmpty()) {
+				ctx._source.remove('outbox');
+			}
+		}`
+)
+
+// NewElasticRepository initializes the repository with Elasticsearch v8.
+// Requests are traced with the global tracer provider and timed in the
+// http_client_request_duration_seconds metric.
 func NewElasticRepository(url string) (Repository, error) {
 	client, err := elastic.NewClient(elastic.Config{
-		Addresses: []string{url},
+		Addresses:       []string{url},
+		Instrumentation: elastic.NewOpenTelemetryInstrumentation(nil, false),
+		Transport:       metrics.InstrumentRoundTripper("elasticsearch", nil),
 	})
 	if err != nil {
 		return nil, err
@@ -48,12 +222,32 @@ func (r *elasticRepository) Close() {
 	// No specific method for closing in go-elasticsearch
 }
 
+func (r *elasticRepository) Outbox() outbox.Store {
+	return elasticOutbox{r}
+}
+
+func (r *elasticRepository) Ping(ctx context.Context) error {
+	res, err := r.client.Ping(r.client.Ping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%w: %s", ErrUnavailable, res.Status())
+	}
+	return nil
+}
+
 // PutProduct indexes a product document
 func (r *elasticRepository) PutProduct(ctx context.Context, product *Product) error {
 	doc := productDocument{
+		ID:          product.ID,
 		Name:        product.Name,
 		Description: product.Description,
-		Price:       product.Price,
+		PriceAmount: product.Price.Amount,
+		Currency:    product.Price.Currency,
+		Stock:       product.Stock,
 	}
 
 	body, err := json.Marshal(doc)
@@ -66,19 +260,92 @@ func (r *elasticRepository) PutProduct(ctx context.Context, product *Product) er
 		bytes.NewReader(body), // Document body
 		r.client.Index.WithContext(ctx),
 		r.client.Index.WithDocumentID(product.ID), // Optional: specify document ID
+		r.client.Index.WithOpType("create"),       // fail instead of overwriting an existing product
 	)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return errors.New("error indexing product")
+		if res.StatusCode == http.StatusConflict {
+			return ErrAlreadyExists
+		}
+		return responseError(res, "error indexing product")
 	}
 
 	return nil
 }
 
+// PutProducts indexes product documents with a single bulk request
+func (r *elasticRepository) PutProducts(ctx context.Context, products []Product) ([]error, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, product := range products {
+		action := map[string]interface{}{
+			// fail instead of overwriting an existing product
+			"create": map[string]string{"_id": product.ID},
+		}
+		if err := enc.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(productDocument{
+			ID:          product.ID,
+			Name:        product.Name,
+			Description: product.Description,
+			PriceAmount: product.Price.Amount,
+			Currency:    product.Price.Currency,
+			Stock:       product.Stock,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := r.client.Bulk(&body,
+		r.client.Bulk.WithContext(ctx),
+		r.client.Bulk.WithIndex("products"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, responseError(res, "error indexing products")
+	}
+
+	var bulkResult struct {
+		Items []map[string]struct {
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&bulkResult); err != nil {
+		return nil, err
+	}
+	if len(bulkResult.Items) != len(products) {
+		return nil, fmt.Errorf("error indexing products: %d results for %d products", len(bulkResult.Items), len(products))
+	}
+
+	failures := make([]error, len(products))
+	for i, item := range bulkResult.Items {
+		result := item["create"]
+		switch {
+		case result.Error == nil:
+		case result.Status == http.StatusConflict:
+			failures[i] = ErrAlreadyExists
+		case result.Status == http.StatusTooManyRequests, result.Status >= http.StatusInternalServerError:
+			failures[i] = fmt.Errorf("%w: %s: %s", ErrUnavailable, result.Error.Type, result.Error.Reason)
+		default:
+			failures[i] = fmt.Errorf("%w: %s: %s", ErrInvalidArgument, result.Error.Type, result.Error.Reason)
+		}
+	}
+	return failures, nil
+}
+
 // GetProductByID retrieves a product by its ID
 func (r *elasticRepository) GetProductByID(ctx context.Context, id string) (*Product, error) {
 	res, err := r.client.Get(
@@ -87,28 +354,23 @@ func (r *elasticRepository) GetProductByID(ctx context.Context, id string) (*Pro
 		r.client.Get.WithContext(ctx),
 	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		if res.StatusCode == 404 {
-			return nil, ErrNotFound
-		}
-		return nil, errors.New("error retrieving product")
+		return nil, responseError(res, "error retrieving product")
 	}
 
-	var doc productDocument
-	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+	var getResult struct {
+		Source productDocument `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&getResult); err != nil {
 		return nil, err
 	}
 
-	return &Product{
-		ID:          id,
-		Name:        doc.Name,
-		Description: doc.Description,
-		Price:       doc.Price,
-	}, nil
+	p := toProduct(id, getResult.Source)
+	return &p, nil
 }
 
 // ListProducts retrieves a list of products with pagination
@@ -116,8 +378,11 @@ func (r *elasticRepository) ListProducts(ctx context.Context, skip uint64, take
 	query := map[string]interface{}{
 		"from": skip,
 		"size": take,
-		"sort": []map[string]interface{}{
-			{"name.keyword": map[string]string{"order": "asc"}},
+		"sort": productSort,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must_not": notDeleted,
+			},
 		},
 	}
 
@@ -132,12 +397,12 @@ func (r *elasticRepository) ListProducts(ctx context.Context, skip uint64, take
 		r.client.Search.WithBody(bytes.NewReader(body)),
 	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return nil, errors.New("error listing products")
+		return nil, responseError(res, "error listing products")
 	}
 
 	var searchResult struct {
@@ -154,12 +419,7 @@ func (r *elasticRepository) ListProducts(ctx context.Context, skip uint64, take
 
 	products := make([]Product, 0, len(searchResult.Hits.Hits))
 	for _, hit := range searchResult.Hits.Hits {
-		products = append(products, Product{
-			ID:          hit.ID,
-			Name:        hit.Source.Name,
-			Description: hit.Source.Description,
-			Price:       hit.Source.Price,
-		})
+		products = append(products, toProduct(hit.ID, hit.Source))
 	}
 	return products, nil
 }
@@ -167,6 +427,8 @@ func (r *elasticRepository) ListProducts(ctx context.Context, skip uint64, take
 // ListProductsWithIDs retrieves products by their IDs
 func (r *elasticRepository) ListProductsWithIDs(ctx context.Context, ids []string) ([]Product, error) {
 	query := map[string]interface{}{
+		// searches return 10 hits unless told otherwise
+		"size": len(ids),
 		"query": map[string]interface{}{
 			"ids": map[string]interface{}{
 				"values": ids,
@@ -185,12 +447,12 @@ func (r *elasticRepository) ListProductsWithIDs(ctx context.Context, ids []strin
 		r.client.Search.WithBody(bytes.NewReader(body)),
 	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return nil, errors.New("error listing products by IDs")
+		return nil, responseError(res, "error listing products by IDs")
 	}
 
 	var searchResult struct {
@@ -207,12 +469,7 @@ func (r *elasticRepository) ListProductsWithIDs(ctx context.Context, ids []strin
 
 	products := make([]Product, 0, len(searchResult.Hits.Hits))
 	for _, hit := range searchResult.Hits.Hits {
-		products = append(products, Product{
-			ID:          hit.ID,
-			Name:        hit.Source.Name,
-			Description: hit.Source.Description,
-			Price:       hit.Source.Price,
-		})
+		products = append(products, toProduct(hit.ID, hit.Source))
 	}
 	return products, nil
 }
@@ -223,10 +480,15 @@ func (r *elasticRepository) SearchProducts(ctx context.Context, query string, sk
 		"from": skip,
 		"size": take,
 		"query": map[string]interface{}{
-			"multi_match": map[string]interface{}{
-				"query":     query,
-				"fields":    []string{"name", "description"},
-				"fuzziness": "AUTO",
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":     query,
+						"fields":    []string{"name", "description"},
+						"fuzziness": "AUTO",
+					},
+				},
+				"must_not": notDeleted,
 			},
 		},
 	}
@@ -242,12 +504,12 @@ func (r *elasticRepository) SearchProducts(ctx context.Context, query string, sk
 		r.client.Search.WithBody(bytes.NewReader(body)),
 	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return nil, errors.New("error searching products")
+		return nil, responseError(res, "error searching products")
 	}
 
 	var searchResult struct {
@@ -264,12 +526,596 @@ func (r *elasticRepository) SearchProducts(ctx context.Context, query string, sk
 
 	products := make([]Product, 0, len(searchResult.Hits.Hits))
 	for _, hit := range searchResult.Hits.Hits {
-		products = append(products, Product{
-			ID:          hit.ID,
-			Name:        hit.Source.Name,
-			Description: hit.Source.Description,
-			Price:       hit.Source.Price,
-		})
+		products = append(products, toProduct(hit.ID, hit.Source))
 	}
 	return products, nil
 }
+
+// ListProductsAfter retrieves the products sorted after the given sort values
+func (r *elasticRepository) ListProductsAfter(ctx context.Context, after []interface{}, take uint64) ([]Product, [][]interface{}, error) {
+	query := map[string]interface{}{
+		"size": take,
+		"sort": productSort,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must_not": notDeleted,
+			},
+		},
+	}
+
+	return r.searchAfter(ctx, query, after, "error listing products")
+}
+
+// SearchProductsAfter searches for products, resuming after the given sort values
+func (r *elasticRepository) SearchProductsAfter(ctx context.Context, query string, after []interface{}, take uint64) ([]Product, [][]interface{}, error) {
+	searchQuery := map[string]interface{}{
+		"size": take,
+		"sort": searchSort,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":     query,
+						"fields":    []string{"name", "description"},
+						"fuzziness": "AUTO",
+					},
+				},
+				"must_not": notDeleted,
+			},
+		},
+	}
+
+	return r.searchAfter(ctx, searchQuery, after, "error searching products")
+}
+
+// searchAfter runs a sorted search from the given sort values and returns the
+// products together with the sort values of each hit
+func (r *elasticRepository) searchAfter(ctx context.Context, query map[string]interface{}, after []interface{}, message string) ([]Product, [][]interface{}, error) {
+	if len(after) != 0 {
+		query["search_after"] = after
+	}
+
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := r.client.Search(
+		r.client.Search.WithContext(ctx),
+		r.client.Search.WithIndex("products"),
+		r.client.Search.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, nil, responseError(res, message)
+	}
+
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				ID     string          `json:"_id"`
+				Source productDocument `json:"_source"`
+				Sort   []interface{}   `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		return nil, nil, err
+	}
+
+	products := make([]Product, 0, len(searchResult.Hits.Hits))
+	sortValues := make([][]interface{}, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		products = append(products, toProduct(hit.ID, hit.Source))
+		sortValues = append(sortValues, hit.Sort)
+	}
+	return products, sortValues, nil
+}
+
+// StreamProducts pages through a point in time of the products index with
+// search_after, so products changed during the stream neither shift the
+// pages nor show up twice
+func (r *elasticRepository) StreamProducts(ctx context.Context) iter.Seq2[Product, error] {
+	return func(yield func(Product, error) bool) {
+		pit, err := r.openPointInTime(ctx)
+		// the index does not exist until the first product is stored
+		if errors.Is(err, ErrNotFound) {
+			return
+		}
+		if err != nil {
+			yield(Product{}, err)
+			return
+		}
+		defer func() {
+			r.closePointInTime(context.WithoutCancel(ctx), pit)
+		}()
+
+		var after []interface{}
+		for {
+			query := map[string]interface{}{
+				"size": streamBatchSize,
+				"sort": []map[string]interface{}{
+					{"id.keyword": map[string]string{"order": "asc"}},
+				},
+				"pit": map[string]interface{}{"id": pit, "keep_alive": pitKeepAlive},
+			}
+			if after != nil {
+				query["search_after"] = after
+			}
+
+			page, err := r.searchPointInTime(ctx, query)
+			if err != nil {
+				yield(Product{}, err)
+				return
+			}
+			pit = page.PitID
+
+			for _, hit := range page.Hits.Hits {
+				if !yield(toProduct(hit.ID, hit.Source), nil) {
+					return
+				}
+			}
+			if len(page.Hits.Hits) < streamBatchSize {
+				return
+			}
+			after = page.Hits.Hits[len(page.Hits.Hits)-1].Sort
+		}
+	}
+}
+
+// pointInTimePage is a page of a search in a point in time, which returns the
+// ID of the point in time to use for the next page
+type pointInTimePage struct {
+	PitID string `json:"pit_id"`
+	Hits  struct {
+		Hits []struct {
+			ID     string          `json:"_id"`
+			Source productDocument `json:"_source"`
+			Sort   []interface{}   `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func (r *elasticRepository) openPointInTime(ctx context.Context) (string, error) {
+	res, err := r.client.OpenPointInTime([]string{"products"}, pitKeepAlive,
+		r.client.OpenPointInTime.WithContext(ctx),
+	)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", responseError(res, "error opening products point in time")
+	}
+
+	var opened struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&opened); err != nil {
+		return "", err
+	}
+	return opened.ID, nil
+}
+
+// searchPointInTime runs a search of a point in time, which names the index
+// itself
+func (r *elasticRepository) searchPointInTime(ctx context.Context, query map[string]interface{}) (*pointInTimePage, error) {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.client.Search(
+		r.client.Search.WithContext(ctx),
+		r.client.Search.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, responseError(res, "error streaming products")
+	}
+
+	page := &pointInTimePage{}
+	if err := json.NewDecoder(res.Body).Decode(page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// closePointInTime frees the point in time right away. Failures are ignored,
+// as the point in time expires after pitKeepAlive anyway.
+func (r *elasticRepository) closePointInTime(ctx context.Context, pit string) {
+	body, err := json.Marshal(map[string]string{"id": pit})
+	if err != nil {
+		return
+	}
+
+	res, err := r.client.ClosePointInTime(
+		r.client.ClosePointInTime.WithContext(ctx),
+		r.client.ClosePointInTime.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
+
+// ReserveStock holds quantity units of a product for a pending order
+func (r *elasticRepository) ReserveStock(ctx context.Context, id string, quantity uint32) error {
+	result, err := r.updateStock(ctx, id, reserveStockScript, quantity)
+	if err != nil {
+		return err
+	}
+
+	if result == "noop" {
+		return ErrInsufficientStock
+	}
+
+	return nil
+}
+
+// ReleaseStock gives back units previously held by ReserveStock
+func (r *elasticRepository) ReleaseStock(ctx context.Context, id string, quantity uint32) error {
+	_, err := r.updateStock(ctx, id, releaseStockScript, quantity)
+	return err
+}
+
+// CommitStock removes previously reserved units from the stock for good
+func (r *elasticRepository) CommitStock(ctx context.Context, id string, quantity uint32) error {
+	_, err := r.updateStock(ctx, id, commitStockScript, quantity)
+	return err
+}
+
+// ReturnStock adds back units removed by CommitStock, such as those of a
+// cancelled order
+func (r *elasticRepository) ReturnStock(ctx context.Context, id string, quantity uint32) error {
+	_, err := r.updateStock(ctx, id, returnStockScript, quantity)
+	return err
+}
+
+// UpdateProduct overwrites the given fields of a product document
+func (r *elasticRepository) UpdateProduct(ctx context.Context, product *Product, fields []string) error {
+	doc := map[string]interface{}{}
+	var event *events.Event
+	for _, field := range fields {
+		switch field {
+		case "name":
+			doc["name"] = product.Name
+		case "description":
+			doc["description"] = product.Description
+		case "price":
+			doc["price_amount"] = product.Price.Amount
+			doc["currency"] = product.Price.Currency
+			e, err := productPriceChanged(product)
+			if err != nil {
+				return err
+			}
+			event = &e
+		case "stock":
+			doc["stock"] = product.Stock
+		}
+	}
+
+	result, err := r.runScript(ctx, product.ID, updateProductScript, map[string]interface{}{
+		"fields": doc,
+		"event":  event,
+	}, "error updating product")
+	if err != nil {
+		return err
+	}
+
+	if result == "noop" {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteProduct flags a product as deleted. The document is kept so orders
+// placed for the product can still resolve it.
+func (r *elasticRepository) DeleteProduct(ctx context.Context, id string) error {
+	_, err := r.runScript(ctx, id, deleteProductScript, map[string]interface{}{}, "error deleting product")
+	return err
+}
+
+// updateStock runs one of the stock scripts against a product and returns
+// the update result reported by Elasticsearch ("updated" or "noop")
+func (r *elasticRepository) updateStock(ctx context.Context, id string, script string, quantity uint32) (string, error) {
+	return r.runScript(ctx, id, script, map[string]interface{}{
+		"quantity": quantity,
+	}, "error updating product stock")
+}
+
+// runScript updates a product with a painless script and returns the update
+// result reported by Elasticsearch ("updated" or "noop")
+func (r *elasticRepository) runScript(ctx context.Context, id string, script string, params map[string]interface{}, message string) (string, error) {
+	update := map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": script,
+			"lang":   "painless",
+			"params": params,
+		},
+	}
+
+	body, err := json.Marshal(update)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := r.client.Update(
+		"products",
+		id,
+		bytes.NewReader(body),
+		r.client.Update.WithContext(ctx),
+		r.client.Update.WithRetryOnConflict(3),
+	)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", responseError(res, message)
+	}
+
+	var updateResult struct {
+		Result string `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&updateResult); err != nil {
+		return "", err
+	}
+
+	return updateResult.Result, nil
+}
+
+// responseError translates an Elasticsearch error response to a domain error
+func responseError(res *esapi.Response, message string) error {
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case res.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: %s: %s", ErrUnavailable, message, res.Status())
+	}
+	return fmt.Errorf("%s: %s", message, res.Status())
+}
+
+// keyDocument is the record of an idempotency key, stored under the key as
+// document ID
+type keyDocument struct {
+	Fingerprint string    `json:"fingerprint"`
+	Response    []byte    `json:"response,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const keysIndex = "idempotency_keys"
+
+// ReserveKey purges the expired keys, then creates the document of key
+// unless it exists. A document whose lease ended is overwritten if it did not
+// change since it was read, so only one of the requests taking it over wins.
+func (r *elasticRepository) ReserveKey(ctx context.Context, key, fingerprint string, notBefore, leaseBefore time.Time) (*idempotency.Record, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"created_at": map[string]interface{}{"lt": notBefore},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.DeleteByQuery(
+		[]string{keysIndex},
+		bytes.NewReader(query),
+		r.client.DeleteByQuery.WithContext(ctx),
+		r.client.DeleteByQuery.WithConflicts("proceed"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	res.Body.Close()
+	// the index does not exist until the first key is stored
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return nil, responseError(res, "error purging idempotency keys")
+	}
+
+	body, err := json.Marshal(keyDocument{Fingerprint: fingerprint, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	// the existing document may be released, or taken over by another
+	// request, between the create and the get, in which case the create is
+	// tried again
+	var takeOver *keyVersion
+	for {
+		opts := []func(*esapi.IndexRequest){
+			r.client.Index.WithContext(ctx),
+			r.client.Index.WithDocumentID(key),
+		}
+		if takeOver == nil {
+			opts = append(opts, r.client.Index.WithOpType("create"))
+		} else {
+			opts = append(opts,
+				r.client.Index.WithIfSeqNo(takeOver.seqNo),
+				r.client.Index.WithIfPrimaryTerm(takeOver.primaryTerm),
+			)
+		}
+		res, err := r.client.Index(keysIndex, bytes.NewReader(body), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		res.Body.Close()
+		if !res.IsError() {
+			return nil, nil
+		}
+		if res.StatusCode != http.StatusConflict {
+			return nil, responseError(res, "error reserving idempotency key")
+		}
+
+		record, version, err := r.getKey(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			takeOver = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Response != nil || !record.CreatedAt.Before(leaseBefore) {
+			return record, nil
+		}
+		takeOver = &version
+	}
+}
+
+// keyVersion identifies a change of a key document, to overwrite the document
+// only if it did not change since
+type keyVersion struct {
+	seqNo       int
+	primaryTerm int
+}
+
+func (r *elasticRepository) getKey(ctx context.Context, key string) (*idempotency.Record, keyVersion, error) {
+	res, err := r.client.Get(keysIndex, key, r.client.Get.WithContext(ctx))
+	if err != nil {
+		return nil, keyVersion{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, keyVersion{}, responseError(res, "error retrieving idempotency key")
+	}
+
+	var getResult struct {
+		SeqNo       int         `json:"_seq_no"`
+		PrimaryTerm int         `json:"_primary_term"`
+		Source      keyDocument `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&getResult); err != nil {
+		return nil, keyVersion{}, err
+	}
+	return &idempotency.Record{
+		Key:         key,
+		Fingerprint: getResult.Source.Fingerprint,
+		Response:    getResult.Source.Response,
+		CreatedAt:   getResult.Source.CreatedAt,
+	}, keyVersion{seqNo: getResult.SeqNo, primaryTerm: getResult.PrimaryTerm}, nil
+}
+
+func (r *elasticRepository) CompleteKey(ctx context.Context, key string, response []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"doc": map[string]interface{}{"response": response},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := r.client.Update(keysIndex, key, bytes.NewReader(body), r.client.Update.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return responseError(res, "error completing idempotency key")
+	}
+	return nil
+}
+
+func (r *elasticRepository) ReleaseKey(ctx context.Context, key string) error {
+	res, err := r.client.Delete(keysIndex, key, r.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return responseError(res, "error releasing idempotency key")
+	}
+	return nil
+}
+
+// elasticOutbox is the Store of the events kept in the outbox field of the
+// product documents
+type elasticOutbox struct {
+	r *elasticRepository
+}
+
+// PendingEvents returns the events of up to limit products, in the order
+// they occurred
+func (o elasticOutbox) PendingEvents(ctx context.Context, limit int) ([]events.Event, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"size":    limit,
+		"_source": []string{"outbox"},
+		"query": map[string]interface{}{
+			"exists": map[string]interface{}{"field": "outbox.id"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := o.r.client.Search(
+		o.r.client.Search.WithContext(ctx),
+		o.r.client.Search.WithIndex("products"),
+		o.r.client.Search.WithBody(bytes.NewReader(query)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	// the index does not exist until the first product is stored
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, responseError(res, "error listing product events")
+	}
+
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source productDocument `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		return nil, err
+	}
+
+	pending := []events.Event{}
+	for _, hit := range searchResult.Hits.Hits {
+		pending = append(pending, hit.Source.Outbox...)
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].OccurredAt.Before(pending[j].OccurredAt)
+	})
+	return pending[:min(limit, len(pending))], nil
+}
+
+// MarkPublished removes the published events from the outbox of their
+// products
+func (o elasticOutbox) MarkPublished(ctx context.Context, published []events.Event) error {
+	ids := map[string][]string{}
+	for _, e := range published {
+		ids[e.AggregateID] = append(ids[e.AggregateID], e.ID)
+	}
+
+	for productID, eventIDs := range ids {
+		_, err := o.r.runScript(ctx, productID, markPublishedScript, map[string]interface{}{
+			"ids": eventIDs,
+		}, "error marking product events published")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/segmentio/ksuid"
+)
+
+// TestMemoryRepository checks the memory repository behaves like the
+// Elasticsearch one: listings ordered by name, fuzzy searches ranked by the
+// terms matched, and deleted products only found by ID
+func TestMemoryRepository(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryRepository()
+
+	put := func(name, description string, stock uint32) Product {
+		t.Helper()
+		p := Product{ID: ksuid.New().String(), Name: name, Description: description, Price: money.New(500, "USD"), Stock: stock}
+		if err := r.PutProduct(ctx, &p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	mug := put("Mug", "blue ceramic cup", 5)
+	bowl := put("Bowl", "ceramic", 5)
+	plate := put("Plate", "white", 5)
+	deleted := put("Cup", "ceramic cup", 5)
+	if err := r.DeleteProduct(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(products []Product) []string {
+		ids := []string{}
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	t.Run("PutProduct", func(t *testing.T) {
+		if err := r.PutProduct(ctx, &mug); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("PutProduct of an existing product = %v, want %v", err, ErrAlreadyExists)
+		}
+
+		got, err := r.GetProductByID(ctx, mug.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != mug {
+			t.Errorf("product = %+v, want %+v", got, mug)
+		}
+		if _, err := r.GetProductByID(ctx, ksuid.New().String()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetProductByID of a missing product = %v, want %v", err, ErrNotFound)
+		}
+
+		got, err = r.GetProductByID(ctx, deleted.ID)
+		if err != nil || !got.Deleted {
+			t.Errorf("GetProductByID of a deleted product = %+v, %v, want it deleted", got, err)
+		}
+	})
+
+	t.Run("ListProducts", func(t *testing.T) {
+		byName := []string{bowl.ID, mug.ID, plate.ID}
+		all, err := r.ListProducts(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(all); !slices.Equal(got, byName) {
+			t.Errorf("ListProducts = %v, want %v", got, byName)
+		}
+		skipped, err := r.ListProducts(ctx, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(skipped); !slices.Equal(got, byName[1:2]) {
+			t.Errorf("ListProducts(1, 1) = %v, want %v", got, byName[1:2])
+		}
+
+		first, sortValues, err := r.ListProductsAfter(ctx, nil, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, _, err := r.ListProductsAfter(ctx, sortValues[len(sortValues)-1], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(append(first, rest...)); !slices.Equal(got, byName) {
+			t.Errorf("pages after one another = %v, want %v", got, byName)
+		}
+
+		withIDs, err := r.ListProductsWithIDs(ctx, []string{plate.ID, ksuid.New().String(), plate.ID, mug.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids(withIDs), []string{plate.ID, mug.ID}; !slices.Equal(got, want) {
+			t.Errorf("ListProductsWithIDs = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("SearchProducts", func(t *testing.T) {
+		tests := []struct {
+			query string
+			want  []string
+		}{
+			// the mug matches both terms, the bowl one, the deleted cup is
+			// left out
+			{"ceramic cup", []string{mug.ID, bowl.ID}},
+			// terms of three to five characters allow one edit
+			{"plat", []string{plate.ID}},
+			{"mig", []string{mug.ID}},
+			// terms of two characters must match exactly
+			{"mu", []string{}},
+			{"glass", []string{}},
+		}
+		for _, tt := range tests {
+			got, err := r.SearchProducts(ctx, tt.query, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids(got), tt.want) {
+				t.Errorf("SearchProducts(%q) = %v, want %v", tt.query, ids(got), tt.want)
+			}
+		}
+
+		first, sortValues, err := r.SearchProductsAfter(ctx, "ceramic cup", nil, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, _, err := r.SearchProductsAfter(ctx, "ceramic cup", sortValues[0], 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids(append(first, rest...)), []string{mug.ID, bowl.ID}; !slices.Equal(got, want) {
+			t.Errorf("search pages after one another = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("UpdateProduct", func(t *testing.T) {
+		p := plate
+		p.Name = "Dish"
+		p.Description = "changed, but not updated"
+		if err := r.UpdateProduct(ctx, &p, []string{"name"}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.GetProductByID(ctx, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "Dish" || got.Description != plate.Description {
+			t.Errorf("updated product = %+v, want only its name changed", got)
+		}
+
+		if err := r.UpdateProduct(ctx, &deleted, []string{"name"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateProduct of a deleted product = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Stock", func(t *testing.T) {
+		stock := func() uint32 {
+			t.Helper()
+			p, err := r.GetProductByID(ctx, bowl.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p.Stock
+		}
+
+		if err := r.ReserveStock(ctx, bowl.ID, 6); !errors.Is(err, ErrInsufficientStock) {
+			t.Errorf("ReserveStock beyond the stock = %v, want %v", err, ErrInsufficientStock)
+		}
+		if err := r.ReserveStock(ctx, deleted.ID, 1); !errors.Is(err, ErrInsufficientStock) {
+			t.Errorf("ReserveStock of a deleted product = %v, want %v", err, ErrInsufficientStock)
+		}
+		if err := r.ReserveStock(ctx, ksuid.New().String(), 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ReserveStock of a missing product = %v, want %v", err, ErrNotFound)
+		}
+
+		steps := []struct {
+			name   string
+			change func() error
+			want   uint32
+		}{
+			{"reserve", func() error { return r.ReserveStock(ctx, bowl.ID, 3) }, 2},
+			{"release", func() error { return r.ReleaseStock(ctx, bowl.ID, 1) }, 3},
+			{"commit", func() error { return r.CommitStock(ctx, bowl.ID, 2) }, 3},
+			// the stock set by an update is what is available, reservations
+			// aside
+			{"reserve again", func() error { return r.ReserveStock(ctx, bowl.ID, 1) }, 2},
+			{"update", func() error {
+				return r.UpdateProduct(ctx, &Product{ID: bowl.ID, Stock: 10}, []string{"stock"})
+			}, 10},
+			{"return", func() error { return r.ReturnStock(ctx, bowl.ID, 2) }, 12},
+		}
+		for _, step := range steps {
+			if err := step.change(); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if got := stock(); got != step.want {
+				t.Errorf("stock after %s = %d, want %d", step.name, got, step.want)
+			}
+		}
+	})
+}
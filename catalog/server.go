@@ -2,45 +2,42 @@ package catalog
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ndquang191/go-graph-grpc/catalog/pb"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
-	"log"
-	"net"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
+	"io"
 )
 
 type grpcServer struct {
 	pb.UnimplementedCatalogServiceServer
 	service Service
+	keys    *idempotency.Keys
 }
 
-func ListenGRPC(service Service, port int) error {
-	lis, err := net.Listen("tcp", fmt.Sprint(":", port))
-	if err != nil {
-		return err
-	}
-	serv := grpc.NewServer()
-	pb.RegisterCatalogServiceServer(serv, &grpcServer{
+// NewGRPCServer returns a server for the catalog service, ready to Run. Keys
+// deduplicates PostProduct requests carrying an idempotency key.
+func NewGRPCServer(service Service, keys *idempotency.Keys, opts ...server.Option) *server.Server {
+	s := server.New(opts...)
+	pb.RegisterCatalogServiceServer(s, &grpcServer{
 		UnimplementedCatalogServiceServer: pb.UnimplementedCatalogServiceServer{},
-		service:                           service})
-	reflection.Register(serv)
-	return serv.Serve(lis)
-
+		service:                           service,
+		keys:                              keys})
+	return s
 }
 
 func (s *grpcServer) PostProduct(ctx context.Context, rq *pb.PostProductRequest) (*pb.PostProductResponse, error) {
-	p, err := s.service.PostProduct(ctx, rq.Name, rq.Description, rq.Price)
-	if err != nil {
-		return nil, err
-	}
+	return idempotency.Do(ctx, s.keys, rq.CreatedBy, rq.IdempotencyKey, rq, func(ctx context.Context) (*pb.PostProductResponse, error) {
+		p, err := s.service.PostProduct(ctx, rq.Name, rq.Description, decodePrice(rq.Price, rq.PriceFloat), rq.Stock)
+		if err != nil {
+			return nil, err
+		}
 
-	return &pb.PostProductResponse{Product: &pb.Product{
-		Id:          p.ID,
-		Name:        p.Name,
-		Description: p.Description,
-		Price:       p.Price,
-	}}, nil
+		return &pb.PostProductResponse{Product: productProto(p)}, nil
+	})
 }
 
 func (s *grpcServer) GetProduct(ctx context.Context, rq *pb.GetProductRequest) (*pb.GetProductResponse, error) {
@@ -49,15 +46,14 @@ func (s *grpcServer) GetProduct(ctx context.Context, rq *pb.GetProductRequest) (
 		return nil, err
 	}
 
-	return &pb.GetProductResponse{Product: &pb.Product{
-		Id:          p.ID,
-		Name:        p.Name,
-		Description: p.Description,
-		Price:       p.Price,
-	}}, nil
+	return &pb.GetProductResponse{Product: productProto(p)}, nil
 }
 
 func (s *grpcServer) GetProducts(ctx context.Context, r *pb.GetProductsRequest) (*pb.GetProductsResponse, error) {
+	if len(r.Ids) == 0 && r.Skip == 0 {
+		return s.getProductsAfter(ctx, r)
+	}
+
 	var res []Product
 	var err error
 	if r.Query != "" {
@@ -69,21 +65,211 @@ func (s *grpcServer) GetProducts(ctx context.Context, r *pb.GetProductsRequest)
 	}
 
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
-	products := []*pb.Product{}
+	return &pb.GetProductsResponse{Products: productsProto(res)}, nil
+
+}
+
+func (s *grpcServer) getProductsAfter(ctx context.Context, r *pb.GetProductsRequest) (*pb.GetProductsResponse, error) {
+	var page *ProductPage
+	var err error
+	if r.Query != "" {
+		page, err = s.service.SearchProductsAfter(ctx, r.Query, r.After, r.Take)
+	} else {
+		page, err = s.service.GetProductsAfter(ctx, r.After, r.Take)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetProductsResponse{
+		Products:    productsProto(page.Products),
+		Cursors:     page.Cursors,
+		HasNextPage: page.HasNextPage,
+	}, nil
+}
+
+func (s *grpcServer) ReserveStock(ctx context.Context, r *pb.ReserveStockRequest) (*pb.ReserveStockResponse, error) {
+	if err := s.service.ReserveStock(ctx, stockItems(r.Items)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ReserveStockResponse{}, nil
+}
+
+func (s *grpcServer) ReleaseStock(ctx context.Context, r *pb.ReleaseStockRequest) (*pb.ReleaseStockResponse, error) {
+	if err := s.service.ReleaseStock(ctx, stockItems(r.Items)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ReleaseStockResponse{}, nil
+}
+
+func (s *grpcServer) CommitStock(ctx context.Context, r *pb.CommitStockRequest) (*pb.CommitStockResponse, error) {
+	if err := s.service.CommitStock(ctx, stockItems(r.Items)); err != nil {
+		return nil, err
+	}
+
+	return &pb.CommitStockResponse{}, nil
+}
 
-	for _, p := range res {
-		products = append(products, &pb.Product{
-			Id:          p.ID,
-			Name:        p.Name,
-			Description: p.Description,
-			Price:       p.Price,
+func (s *grpcServer) ReturnStock(ctx context.Context, r *pb.ReturnStockRequest) (*pb.ReturnStockResponse, error) {
+	if err := s.service.ReturnStock(ctx, stockItems(r.Items)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ReturnStockResponse{}, nil
+}
+
+func (s *grpcServer) UpdateProduct(ctx context.Context, r *pb.UpdateProductRequest) (*pb.UpdateProductResponse, error) {
+	if r.Product == nil {
+		return nil, fmt.Errorf("%w: product is required", ErrInvalidArgument)
+	}
+
+	p, err := s.service.UpdateProduct(ctx, Product{
+		ID:          r.Product.Id,
+		Name:        r.Product.Name,
+		Description: r.Product.Description,
+		Price:       decodePrice(r.Product.Price, r.Product.PriceFloat),
+		Stock:       r.Product.Stock,
+	}, r.UpdateMask.GetPaths())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateProductResponse{Product: productProto(p)}, nil
+}
+
+func (s *grpcServer) DeleteProduct(ctx context.Context, r *pb.DeleteProductRequest) (*pb.DeleteProductResponse, error) {
+	p, err := s.service.DeleteProduct(ctx, r.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteProductResponse{Product: productProto(p)}, nil
+}
+
+// StreamProducts sends a product per message. Send blocks while the client
+// is behind, which pauses the read of the products.
+func (s *grpcServer) StreamProducts(r *pb.StreamProductsRequest, stream pb.CatalogService_StreamProductsServer) error {
+	for p, err := range s.service.StreamProducts(stream.Context()) {
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.StreamProductsResponse{Product: productProto(&p)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importBatchSize is the number of products ImportProducts stores at once
+const importBatchSize = 500
+
+// ImportProducts stores the products of the stream a batch at a time, so the
+// stream is read only as fast as the products are stored. A batch failing as
+// a whole, as while Elasticsearch is unavailable, fails each of its products
+// rather than the import, so the response accounts for every product.
+func (s *grpcServer) ImportProducts(stream pb.CatalogService_ImportProductsServer) error {
+	ctx := stream.Context()
+	res := &pb.ImportProductsResponse{}
+	batch := make([]Product, 0, importBatchSize)
+	offset := 0
+
+	flush := func() error {
+		failures, err := s.service.ImportProducts(ctx, batch)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failures = make([]error, len(batch))
+			for i := range failures {
+				failures[i] = err
+			}
+		}
+
+		for i, err := range failures {
+			if err == nil {
+				res.Imported++
+				continue
+			}
+			res.Failed++
+			if len(res.Failures) < MaxImportFailures {
+				res.Failures = append(res.Failures, &pb.ImportFailure{
+					Index:   uint32(offset + i),
+					Code:    uint32(errs.KindOf(err).Code()),
+					Message: err.Error(),
+				})
+			}
+		}
+		offset += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		rq, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, Product{
+			Name:        rq.Name,
+			Description: rq.Description,
+			Price:       decodeMoney(rq.Price),
+			Stock:       rq.Stock,
 		})
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
 	}
+	if len(batch) != 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return stream.SendAndClose(res)
+}
 
-	return &pb.GetProductsResponse{Products: products}, nil
+func stockItems(items []*pb.StockItem) []StockItem {
+	res := []StockItem{}
+	for _, i := range items {
+		res = append(res, StockItem{
+			ProductID: i.ProductId,
+			Quantity:  i.Quantity,
+		})
+	}
+	return res
+}
+
+func productProto(p *Product) *pb.Product {
+	return &pb.Product{
+		Id:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       moneyProto(p.Price),
+		PriceFloat:  p.Price.Float(),
+		Stock:       p.Stock,
+		Deleted:     p.Deleted,
+	}
+}
+
+func productsProto(res []Product) []*pb.Product {
+	products := []*pb.Product{}
+	for i := range res {
+		products = append(products, productProto(&res[i]))
+	}
+	return products
+}
 
+func moneyProto(m money.Money) *pb.Money {
+	return &pb.Money{Amount: m.Amount, Currency: m.Currency}
 }
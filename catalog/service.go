@@ -2,22 +2,81 @@ package catalog
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/ndquang191/go-graph-grpc/internal/cursor"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
 	"github.com/segmentio/ksuid"
+	"iter"
+	"strings"
 )
 
 type Service interface {
-	PostProduct(ctx context.Context, name, description string, price float64) (*Product, error)
+	PostProduct(ctx context.Context, name, description string, price money.Money, stock uint32) (*Product, error)
 	GetProduct(ctx context.Context, id string) (*Product, error)
 	GetProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error)
 	GetProductsByIDs(ctx context.Context, ids []string) ([]Product, error)
 	SearchProducts(cxt context.Context, query string, skip uint64, take uint64) ([]Product, error)
+	GetProductsAfter(ctx context.Context, after string, first uint64) (*ProductPage, error)
+	SearchProductsAfter(ctx context.Context, query string, after string, first uint64) (*ProductPage, error)
+	ReserveStock(ctx context.Context, items []StockItem) error
+	ReleaseStock(ctx context.Context, items []StockItem) error
+	CommitStock(ctx context.Context, items []StockItem) error
+	ReturnStock(ctx context.Context, items []StockItem) error
+	UpdateProduct(ctx context.Context, product Product, fields []string) (*Product, error)
+	DeleteProduct(ctx context.Context, id string) (*Product, error)
+	// StreamProducts yields every product in ID order, deleted ones
+	// included, for exports
+	StreamProducts(ctx context.Context) iter.Seq2[Product, error]
+	// ImportProducts creates a batch of products, ignoring their IDs. The
+	// error of each product is returned at its position, nil for the
+	// products created.
+	ImportProducts(ctx context.Context, products []Product) ([]error, error)
 }
 
+// UpdatableFields are the product fields UpdateProduct accepts in its mask
+var UpdatableFields = []string{"name", "description", "price", "stock"}
+
 type Product struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
+	Stock       uint32      `json:"stock"`
+	// Deleted products are hidden from listings and searches but can still
+	// be looked up by ID, for the orders placed before they were removed
+	Deleted bool `json:"deleted"`
+}
+
+// ProductPage is one page of a cursor paginated product listing or search
+type ProductPage struct {
+	Products []Product
+	// Cursors[i] is the cursor to resume the listing after Products[i]
+	Cursors     []string
+	HasNextPage bool
+}
+
+// MaxImportFailures is the most failures an import reports individually
+const MaxImportFailures = 1000
+
+// ImportReport tells how an import of products went
+type ImportReport struct {
+	Imported int
+	Failed   int
+	// Failures are the first failed products, up to MaxImportFailures
+	Failures []ImportFailure
+}
+
+// ImportFailure is a product that was not imported, by its position in the
+// import
+type ImportFailure struct {
+	Index int
+	Err   error
+}
+
+type StockItem struct {
+	ProductID string `json:"productId"`
+	Quantity  uint32 `json:"quantity"`
 }
 
 type catalogService struct {
@@ -30,11 +89,16 @@ func NewService(repository Repository) Service {
 	}
 }
 
-func (s *catalogService) PostProduct(ctx context.Context, name, description string, price float64) (*Product, error) {
+func (s *catalogService) PostProduct(ctx context.Context, name, description string, price money.Money, stock uint32) (*Product, error) {
+	if err := validateProduct(name, price); err != nil {
+		return nil, err
+	}
+
 	p := &Product{
 		Name:        name,
 		Description: description,
 		Price:       price,
+		Stock:       stock,
 		ID:          ksuid.New().String(),
 	}
 	if err := s.repository.PutProduct(ctx, p); err != nil {
@@ -43,6 +107,92 @@ func (s *catalogService) PostProduct(ctx context.Context, name, description stri
 	return p, nil
 }
 
+func (s *catalogService) ImportProducts(ctx context.Context, products []Product) ([]error, error) {
+	failures := make([]error, len(products))
+	valid := make([]Product, 0, len(products))
+	positions := make([]int, 0, len(products))
+	for i, p := range products {
+		if err := validateProduct(p.Name, p.Price); err != nil {
+			failures[i] = err
+			continue
+		}
+
+		p.ID = ksuid.New().String()
+		p.Deleted = false
+		valid = append(valid, p)
+		positions = append(positions, i)
+	}
+	if len(valid) == 0 {
+		return failures, nil
+	}
+
+	stored, err := s.repository.PutProducts(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	for i, err := range stored {
+		failures[positions[i]] = err
+	}
+	return failures, nil
+}
+
+func validateProduct(name string, price money.Money) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidArgument)
+	}
+	return validatePrice(price)
+}
+
+func validatePrice(price money.Money) error {
+	if !money.ValidCurrency(price.Currency) {
+		return fmt.Errorf("%w: invalid currency %q", ErrInvalidArgument, price.Currency)
+	}
+	if price.IsNegative() {
+		return fmt.Errorf("%w: price must not be negative", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// UpdateProduct changes the fields of a product named in fields to their
+// values in product, leaving the others as they are
+func (s *catalogService) UpdateProduct(ctx context.Context, product Product, fields []string) (*Product, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: no fields to update", ErrInvalidArgument)
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "name":
+			if strings.TrimSpace(product.Name) == "" {
+				return nil, fmt.Errorf("%w: name is required", ErrInvalidArgument)
+			}
+		case "price":
+			if err := validatePrice(product.Price); err != nil {
+				return nil, err
+			}
+		case "description", "stock":
+		default:
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidArgument, field)
+		}
+	}
+
+	if err := s.repository.UpdateProduct(ctx, &product, fields); err != nil {
+		return nil, err
+	}
+	return s.repository.GetProductByID(ctx, product.ID)
+}
+
+func (s *catalogService) DeleteProduct(ctx context.Context, id string) (*Product, error) {
+	if err := s.repository.DeleteProduct(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.repository.GetProductByID(ctx, id)
+}
+
+func (s *catalogService) StreamProducts(ctx context.Context) iter.Seq2[Product, error] {
+	return s.repository.StreamProducts(ctx)
+}
+
 func (s *catalogService) GetProduct(ctx context.Context, id string) (*Product, error) {
 	return s.repository.GetProductByID(ctx, id)
 }
@@ -67,3 +217,105 @@ func (s *catalogService) SearchProducts(cxt context.Context, query string, skip
 	}
 	return s.repository.SearchProducts(cxt, query, skip, take)
 }
+
+func (s *catalogService) GetProductsAfter(ctx context.Context, after string, first uint64) (*ProductPage, error) {
+	return s.productsAfter(after, first, func(afterKey []interface{}, take uint64) ([]Product, [][]interface{}, error) {
+		return s.repository.ListProductsAfter(ctx, afterKey, take)
+	})
+}
+
+func (s *catalogService) SearchProductsAfter(ctx context.Context, query string, after string, first uint64) (*ProductPage, error) {
+	return s.productsAfter(after, first, func(afterKey []interface{}, take uint64) ([]Product, [][]interface{}, error) {
+		return s.repository.SearchProductsAfter(ctx, query, afterKey, take)
+	})
+}
+
+// productsAfter decodes the cursor into the sort values of the repository
+// listing, fetches one product more than asked for to tell whether there is a
+// next page, and encodes the sort values of each product as its cursor.
+func (s *catalogService) productsAfter(after string, first uint64, list func([]interface{}, uint64) ([]Product, [][]interface{}, error)) (*ProductPage, error) {
+	if first > 100 || first == 0 {
+		first = 100
+	}
+
+	var afterKey []interface{}
+	if after != "" {
+		if err := cursor.Decode(after, &afterKey); err != nil {
+			return nil, err
+		}
+	}
+
+	products, sortValues, err := list(afterKey, first+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ProductPage{Cursors: []string{}}
+	if uint64(len(products)) > first {
+		products = products[:first]
+		page.HasNextPage = true
+	}
+
+	page.Products = products
+	for i := range products {
+		page.Cursors = append(page.Cursors, cursor.Encode(sortValues[i]))
+	}
+	return page, nil
+}
+
+// ReserveStock reserves every item or none of them: when one product runs
+// short, the reservations already made for the others are released again.
+func (s *catalogService) ReserveStock(ctx context.Context, items []StockItem) error {
+	for i, item := range items {
+		if err := s.repository.ReserveStock(ctx, item.ProductID, item.Quantity); err != nil {
+			for _, reserved := range items[:i] {
+				s.repository.ReleaseStock(ctx, reserved.ProductID, reserved.Quantity)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseStock releases every item it can. An item that fails does not stop
+// the others, so only the failed items, joined in the error, stay reserved.
+func (s *catalogService) ReleaseStock(ctx context.Context, items []StockItem) error {
+	return eachItem(items, func(item StockItem) error {
+		return s.repository.ReleaseStock(ctx, item.ProductID, item.Quantity)
+	})
+}
+
+// CommitStock commits every item it can, like ReleaseStock
+func (s *catalogService) CommitStock(ctx context.Context, items []StockItem) error {
+	return eachItem(items, func(item StockItem) error {
+		return s.repository.CommitStock(ctx, item.ProductID, item.Quantity)
+	})
+}
+
+// ReturnStock puts the units of every item back in stock, or of none of them:
+// when one product fails, the units already returned for the others are
+// taken out again.
+func (s *catalogService) ReturnStock(ctx context.Context, items []StockItem) error {
+	for i, item := range items {
+		if err := s.repository.ReturnStock(ctx, item.ProductID, item.Quantity); err != nil {
+			for _, returned := range items[:i] {
+				if s.repository.ReserveStock(ctx, returned.ProductID, returned.Quantity) == nil {
+					s.repository.CommitStock(ctx, returned.ProductID, returned.Quantity)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// eachItem runs update for all items and joins the errors of the failed ones
+func eachItem(items []StockItem, update func(StockItem) error) error {
+	var failures []error
+	for _, item := range items {
+		if err := update(item); err != nil {
+			failures = append(failures, fmt.Errorf("product %s: %w", item.ProductID, err))
+		}
+	}
+	return errors.Join(failures...)
+}
@@ -0,0 +1,100 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/segmentio/ksuid"
+)
+
+func TestStockPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewMemoryRepository())
+
+	var items []StockItem
+	for range 2 {
+		p, err := s.PostProduct(ctx, "Mug", "", money.New(900, "USD"), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, StockItem{ProductID: p.ID, Quantity: 4})
+	}
+	if err := s.ReserveStock(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	// the missing product sits between the two others, which are still
+	// released and committed
+	missing := StockItem{ProductID: ksuid.New().String(), Quantity: 1}
+	withMissing := []StockItem{items[0], missing, items[1]}
+
+	available := func(want uint32) {
+		t.Helper()
+		for _, item := range items {
+			p, err := s.GetProduct(ctx, item.ProductID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Stock != want {
+				t.Errorf("stock of %s = %d, want %d", p.ID, p.Stock, want)
+			}
+		}
+	}
+
+	if err := s.ReleaseStock(ctx, withMissing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReleaseStock error = %v, want %v", err, ErrNotFound)
+	}
+	available(10)
+
+	if err := s.ReserveStock(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitStock(ctx, withMissing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("CommitStock error = %v, want %v", err, ErrNotFound)
+	}
+	available(6)
+}
+
+func TestReturnStock(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewMemoryRepository())
+
+	p, err := s.PostProduct(ctx, "Mug", "", money.New(900, "USD"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := StockItem{ProductID: p.ID, Quantity: 4}
+	if err := s.ReserveStock(ctx, []StockItem{item}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitStock(ctx, []StockItem{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	stock := func() uint32 {
+		t.Helper()
+		p, err := s.GetProduct(ctx, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Stock
+	}
+
+	// the units returned before the missing product are taken out again
+	missing := StockItem{ProductID: ksuid.New().String(), Quantity: 1}
+	if err := s.ReturnStock(ctx, []StockItem{item, missing}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReturnStock error = %v, want %v", err, ErrNotFound)
+	}
+	if got := stock(); got != 6 {
+		t.Errorf("stock after a failed return = %d, want 6", got)
+	}
+
+	if err := s.ReturnStock(ctx, []StockItem{item}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stock(); got != 10 {
+		t.Errorf("stock after returning = %d, want 10", got)
+	}
+}
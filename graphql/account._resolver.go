@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"log"
 	"time"
 )
 
@@ -10,14 +9,28 @@ type accountResolver struct {
 	server *Server
 }
 
+func (r *accountResolver) Email(ctx context.Context, obj *Account) (string, error) {
+	if err := authorizeOwner(ctx, obj.ID); err != nil {
+		return "", err
+	}
+	return obj.Email, nil
+}
+
+func (r *accountResolver) Roles(ctx context.Context, obj *Account) ([]Role, error) {
+	if err := authorizeOwner(ctx, obj.ID); err != nil {
+		return nil, err
+	}
+	return obj.Roles, nil
+}
+
 func (r *accountResolver) Orders(ctx context.Context, obj *Account) ([]*Order, error) {
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
+	if err := authorizeOwner(ctx, obj.ID); err != nil {
+		return nil, err
+	}
 
-	orderList, err := r.server.orderClient.GetOrdersForAccount(ctx, obj.ID)
+	orderList, err := loadersFor(ctx).ordersForAccount.Load(ctx, obj.ID)
 
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 
@@ -33,17 +46,45 @@ func (r *accountResolver) Orders(ctx context.Context, obj *Account) ([]*Order, e
 				Quantity:    int(p.Quantity),
 				Name:        p.Name,
 				Description: p.Description,
-				Price:       p.Price,
+				Price:       toMoney(p.Price),
 			})
 		}
 
 		orders = append(orders, &Order{
 			ID:         o.ID,
 			CreatedAt:  o.CreatedAt,
-			TotalPrice: o.TotalPrice,
+			TotalPrice: toMoney(o.TotalPrice),
+			Status:     orderStatus(o.Status),
 			Products:   products,
 		})
 	}
 
 	return orders, nil
 }
+
+func (r *accountResolver) OrdersConnection(ctx context.Context, obj *Account, first *int, after *string) (*OrderConnection, error) {
+	if err := authorizeOwner(ctx, obj.ID); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	page, err := r.server.orderClient.GetOrdersForAccountPage(ctx, obj.ID, stringValue(after), firstValue(first))
+	if err != nil {
+		return nil, err
+	}
+
+	edges := []*OrderEdge{}
+	for i := range page.Orders {
+		edges = append(edges, &OrderEdge{
+			Cursor: page.Cursors[i],
+			Node:   toOrder(&page.Orders[i]),
+		})
+	}
+
+	return &OrderConnection{
+		Edges:    edges,
+		PageInfo: pageInfo(after, page.Cursors, page.HasNextPage),
+	}, nil
+}
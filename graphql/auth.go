@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+)
+
+var (
+	ErrUnauthenticated = errs.New(errs.Unauthenticated, "authentication required")
+	ErrForbidden       = errs.New(errs.PermissionDenied, "forbidden")
+)
+
+type authKey struct{}
+
+// authResult is what withAuth learned from the Authorization header
+type authResult struct {
+	identity *auth.Identity
+	err      error
+}
+
+// withAuth verifies the bearer token of the request, if any, and records who
+// it was issued to. Requests without a token go through as anonymous;
+// resolvers that need an account call authenticated.
+func (s *Server) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(s.authenticate(r.Context(), r.Header.Get("Authorization"))))
+	})
+}
+
+// initWebsocket authenticates a WebSocket connection with the Authorization
+// of its connection_init payload, if any, as browsers cannot set the header
+func (s *Server) initWebsocket(ctx context.Context, payload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+	return s.authenticate(ctx, payload.Authorization()), nil, nil
+}
+
+// authenticate verifies the bearer token of an Authorization header and
+// records the result in ctx. An empty header leaves ctx as it is.
+func (s *Server) authenticate(ctx context.Context, header string) context.Context {
+	if header == "" {
+		return ctx
+	}
+
+	result := authResult{}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if ok {
+		result.identity, result.err = s.signer.Verify(token, auth.Access)
+	} else {
+		result.err = auth.ErrInvalidToken
+	}
+	return context.WithValue(ctx, authKey{}, result)
+}
+
+// authenticated returns who the request is authenticated as
+func authenticated(ctx context.Context) (*auth.Identity, error) {
+	result, ok := ctx.Value(authKey{}).(authResult)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return result.identity, result.err
+}
+
+// authenticatedAccountID returns the account the request is authenticated as
+func authenticatedAccountID(ctx context.Context) (string, error) {
+	identity, err := authenticated(ctx)
+	if err != nil {
+		return "", err
+	}
+	return identity.AccountID, nil
+}
+
+// authorizeOwner lets the request through when it is authenticated as the
+// given account or as an admin
+func authorizeOwner(ctx context.Context, accountID string) error {
+	identity, err := authenticated(ctx)
+	if err != nil {
+		return err
+	}
+	if identity.AccountID != accountID && !identity.HasRole(roleName(RoleAdmin)) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// hasRole implements the @hasRole directive
+func hasRole(ctx context.Context, obj interface{}, next graphql.Resolver, role Role) (interface{}, error) {
+	identity, err := authenticated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !identity.HasRole(roleName(role)) {
+		return nil, ErrForbidden
+	}
+	return next(ctx)
+}
+
+// roleName converts a schema role to the role stored on accounts
+func roleName(r Role) string {
+	return strings.ToLower(string(r))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/order"
+)
+
+// Loader collects the keys requested within a short window and fetches them
+// with a single call. Results are cached for the lifetime of the loader,
+// which is one GraphQL request.
+type Loader[K comparable, V any] struct {
+	ctx      context.Context
+	fetch    func(ctx context.Context, keys []K) (map[K]V, error)
+	wait     time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	cache   map[K]*loaderResult[V]
+	pending []K
+	timer   *time.Timer
+}
+
+type loaderResult[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func NewLoader[K comparable, V any](ctx context.Context, fetch func(ctx context.Context, keys []K) (map[K]V, error)) *Loader[K, V] {
+	return &Loader[K, V]{
+		ctx:      ctx,
+		fetch:    fetch,
+		wait:     2 * time.Millisecond,
+		maxBatch: 100,
+		cache:    map[K]*loaderResult[V]{},
+	}
+}
+
+// Load returns the value for key, waiting for the batch it is part of
+func (l *Loader[K, V]) Load(ctx context.Context, key K) (V, error) {
+	l.mu.Lock()
+	res, ok := l.cache[key]
+	if !ok {
+		res = &loaderResult[V]{done: make(chan struct{})}
+		l.cache[key] = res
+		l.pending = append(l.pending, key)
+
+		if len(l.pending) >= l.maxBatch {
+			if l.timer != nil {
+				l.timer.Stop()
+			}
+			go l.dispatch()
+		} else if len(l.pending) == 1 {
+			l.timer = time.AfterFunc(l.wait, l.dispatch)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-res.done:
+		return res.value, res.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+func (l *Loader[K, V]) dispatch() {
+	l.mu.Lock()
+	keys := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	if len(keys) == 0 {
+		return
+	}
+
+	// the batch serves many resolvers, so it is bound to the request rather
+	// than to whichever resolver happened to trigger it
+	ctx, cancel := context.WithTimeout(l.ctx, 3*time.Second)
+	defer cancel()
+
+	values, err := l.fetch(ctx, keys)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		res := l.cache[key]
+		res.value, res.err = values[key], err
+		close(res.done)
+	}
+}
+
+type loaders struct {
+	ordersForAccount *Loader[string, []order.Order]
+}
+
+type loadersKey struct{}
+
+// withLoaders gives every request its own set of loaders
+func (s *Server) withLoaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		l := &loaders{
+			ordersForAccount: NewLoader(ctx, s.orderClient.GetOrdersForAccounts),
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, loadersKey{}, l)))
+	})
+}
+
+func loadersFor(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
@@ -0,0 +1,1386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/client"
+	"github.com/ndquang191/go-graph-grpc/account"
+	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/metrics"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
+	"github.com/ndquang191/go-graph-grpc/order"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testClient is a GraphQL client for the gateway, holding the credentials of
+// an admin account for the calls that need one
+type testClient struct {
+	*client.Client
+	admin client.Option
+	// logs collects the JSON log lines of the gateway and the services
+	logs *logBuffer
+	// relays publish the events of the services to broker on flushEvents
+	relays []*outbox.Relay
+	broker *events.MemoryBroker
+	// the clients of the services, for the calls the gateway does not make
+	accountClient *account.Client
+	catalogClient *catalog.Client
+	orderClient   *order.Client
+}
+
+// flushEvents publishes the events the services stored so far
+func (c *testClient) flushEvents(t *testing.T) {
+	t.Helper()
+	for _, relay := range c.relays {
+		if _, err := relay.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// logBuffer is a bytes.Buffer safe for the concurrent writes of the services
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestClient boots the account, catalog and order services on in-process
+// bufconn listeners with in-memory repositories, and returns a GraphQL client
+// talking to a gateway wired to them.
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+
+	listeners := map[string]*bufconn.Listener{
+		"account": bufconn.Listen(1 << 20),
+		"catalog": bufconn.Listen(1 << 20),
+		"order":   bufconn.Listen(1 << 20),
+	}
+	for _, lis := range listeners {
+		t.Cleanup(func() { lis.Close() })
+	}
+
+	dialer := grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return listeners[addr].DialContext(ctx)
+	})
+
+	signer := auth.NewSigner([]byte("test secret"))
+
+	logs := &logBuffer{}
+	logger := func(service string) *slog.Logger {
+		logger, err := logging.New(logs, logging.Config{Level: "debug", Format: "json"}, service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return logger
+	}
+
+	accounts := account.NewMemoryRepository()
+
+	serve := func(srv *server.Server, lis net.Listener) {
+		go srv.Serve(lis)
+		t.Cleanup(srv.Shutdown)
+	}
+
+	serve(account.NewGRPCServer(account.NewService(accounts, signer), idempotency.New(accounts, idempotency.DefaultRetention), server.WithLogger(logger("account"))), listeners["account"])
+	products := catalog.NewMemoryRepository()
+	serve(catalog.NewGRPCServer(catalog.NewService(products), idempotency.New(products, idempotency.DefaultRetention), server.WithLogger(logger("catalog"))), listeners["catalog"])
+
+	accountClient, err := account.NewClient("account", dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(accountClient.Close)
+	catalogClient, err := catalog.NewClient("catalog", dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(catalogClient.Close)
+	broker := events.NewMemoryBroker()
+	orders := order.NewMemoryRepository()
+	serve(order.NewGRPCServer(order.NewService(orders), idempotency.New(orders, idempotency.DefaultRetention), broker, accountClient, catalogClient, server.WithLogger(logger("order"))), listeners["order"])
+
+	orderClient, err := order.NewClient("order", dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(orderClient.Close)
+
+	s, err := NewGraphQLServer("account", "catalog", "order", signer, logger("graphql"), dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	var relays []*outbox.Relay
+	for _, store := range []outbox.Store{accounts.Outbox(), products.Outbox(), orders.Outbox()} {
+		relays = append(relays, outbox.NewRelay(store, broker, outbox.DefaultInterval, logger("outbox")))
+	}
+
+	c := &testClient{
+		Client:        client.New(s.Handler()),
+		logs:          logs,
+		relays:        relays,
+		broker:        broker,
+		accountClient: accountClient,
+		catalogClient: catalogClient,
+		orderClient:   orderClient,
+	}
+
+	// the first admin can only be granted in storage
+	adminID := createAccount(t, c, "Admin")
+	admin, err := accounts.GetAccountByID(context.Background(), adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Roles = append(admin.Roles, account.RoleAdmin)
+	if err := accounts.UpdateAccount(context.Background(), admin); err != nil {
+		t.Fatal(err)
+	}
+	c.admin = login(t, c, "Admin")
+
+	return c
+}
+
+func createAccount(t *testing.T, c *testClient, name string) string {
+	t.Helper()
+
+	var resp struct {
+		CreateAccount struct {
+			ID   string
+			Name string
+		}
+	}
+	c.MustPost(`mutation($name: String!, $email: String!) {
+		createAccount(account: {name: $name, email: $email, password: "password123"}) { id name }
+	}`, &resp, client.Var("name", name), client.Var("email", email(name)))
+
+	if resp.CreateAccount.Name != name {
+		t.Fatalf("account name = %q, want %q", resp.CreateAccount.Name, name)
+	}
+	return resp.CreateAccount.ID
+}
+
+// createProduct creates a product priced in USD
+func createProduct(t *testing.T, c *testClient, name string, price string, stock int) string {
+	t.Helper()
+
+	var resp struct {
+		CreateProduct struct {
+			ID    string
+			Stock int
+		}
+	}
+	c.MustPost(`mutation($name: String!, $price: String!, $stock: Int) {
+		createProduct(product: {name: $name, description: "test product", price: {amount: $price, currency: "USD"}, stock: $stock}) { id stock }
+	}`, &resp, c.admin, client.Var("name", name), client.Var("price", price), client.Var("stock", stock))
+
+	if resp.CreateProduct.Stock != stock {
+		t.Fatalf("product stock = %d, want %d", resp.CreateProduct.Stock, stock)
+	}
+	return resp.CreateProduct.ID
+}
+
+// responseErrorCode posts a query expected to fail and returns extensions.code of the
+// first error
+func responseErrorCode(t *testing.T, c *testClient, query string, options ...client.Option) string {
+	t.Helper()
+
+	resp, err := c.RawPost(query, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errors []struct {
+		Message    string
+		Extensions map[string]interface{}
+	}
+	if err := json.Unmarshal(resp.Errors, &errors); err != nil || len(errors) == 0 {
+		t.Fatalf("expected errors, got %s", resp.Errors)
+	}
+	if errors[0].Extensions["requestId"] == "" {
+		t.Errorf("error %q has no request id", errors[0].Message)
+	}
+
+	code, _ := errors[0].Extensions["code"].(string)
+	return code
+}
+
+func email(name string) string {
+	return strings.ToLower(name) + "@example.com"
+}
+
+// login logs in to an account made by createAccount and returns the option
+// authenticating requests as it
+func login(t *testing.T, c *testClient, name string) client.Option {
+	t.Helper()
+	return client.AddHeader("Authorization", "Bearer "+accessToken(t, c, name))
+}
+
+// accessToken logs in to an account made by createAccount
+func accessToken(t *testing.T, c *testClient, name string) string {
+	t.Helper()
+
+	var resp struct {
+		Login struct {
+			AccessToken string
+		}
+	}
+	c.MustPost(`mutation($email: String!) { login(email: $email, password: "password123") { accessToken } }`,
+		&resp, client.Var("email", email(name)))
+
+	return resp.Login.AccessToken
+}
+
+const createOrderMutation = `mutation($product: String!, $quantity: Int!) {
+	createOrder(order: {products: [{id: $product, quantity: $quantity}]}) { id totalPrice { amount currency } status }
+}`
+
+func createOrder(t *testing.T, c *testClient, as client.Option, productID string, quantity int) string {
+	t.Helper()
+
+	var resp struct {
+		CreateOrder struct {
+			ID         string
+			TotalPrice Money
+			Status     string
+		}
+	}
+	c.MustPost(createOrderMutation, &resp, as, client.Var("product", productID), client.Var("quantity", quantity))
+
+	return resp.CreateOrder.ID
+}
+
+func TestCreateOrderAndListAccountOrders(t *testing.T) {
+	c := newTestClient(t)
+
+	accountID := createAccount(t, c, "Ada")
+	as := login(t, c, "Ada")
+	productID := createProduct(t, c, "Keyboard", "49.50", 10)
+
+	var created struct {
+		CreateOrder struct {
+			ID         string
+			TotalPrice Money
+			Status     string
+		}
+	}
+	c.MustPost(createOrderMutation, &created,
+		as, client.Var("product", productID), client.Var("quantity", 2))
+
+	if created.CreateOrder.TotalPrice != (Money{Amount: "99.00", Currency: "USD"}) {
+		t.Errorf("totalPrice = %+v, want 99.00 USD", created.CreateOrder.TotalPrice)
+	}
+	if created.CreateOrder.Status != "PENDING" {
+		t.Errorf("status = %q, want PENDING", created.CreateOrder.Status)
+	}
+
+	var accounts struct {
+		Account []struct {
+			ID     string
+			Orders []struct {
+				ID        string
+				CreatedAt string
+				Products  []struct {
+					ID       string
+					Name     string
+					Quantity int
+					Price    Money
+				}
+			}
+		}
+	}
+	c.MustPost(`query($id: String) {
+		account(id: $id) { id orders { id createdAt products { id name quantity price { amount currency } } } }
+	}`, &accounts, as, client.Var("id", accountID))
+
+	if len(accounts.Account) != 1 || len(accounts.Account[0].Orders) != 1 {
+		t.Fatalf("got %+v, want one account with one order", accounts.Account)
+	}
+	o := accounts.Account[0].Orders[0]
+	if o.ID != created.CreateOrder.ID {
+		t.Errorf("order id = %q, want %q", o.ID, created.CreateOrder.ID)
+	}
+	if createdAt, err := time.Parse(time.RFC3339, o.CreatedAt); err != nil || time.Since(createdAt) > time.Minute {
+		t.Errorf("createdAt = %q, want about now", o.CreatedAt)
+	}
+	if len(o.Products) != 1 || o.Products[0].Name != "Keyboard" || o.Products[0].Quantity != 2 || o.Products[0].Price.Amount != "49.50" {
+		t.Errorf("products = %+v, want 2 x Keyboard at 49.50", o.Products)
+	}
+
+	var products struct {
+		Products []struct {
+			Stock int
+		}
+	}
+	c.MustPost(`query($id: String) { products(id: $id) { stock } }`, &products, client.Var("id", productID))
+
+	if len(products.Products) != 1 || products.Products[0].Stock != 8 {
+		t.Errorf("products = %+v, want stock 8 after ordering 2", products.Products)
+	}
+}
+
+func TestListAccountsWithOrders(t *testing.T) {
+	c := newTestClient(t)
+
+	productID := createProduct(t, c, "Cable", "5", 100)
+	want := map[string]int{}
+	for i, name := range []string{"Ken", "Dennis", "Rob"} {
+		accountID := createAccount(t, c, name)
+		as := login(t, c, name)
+		for j := 0; j <= i; j++ {
+			createOrder(t, c, as, productID, 1)
+		}
+		want[accountID] = i + 1
+	}
+
+	var resp struct {
+		Account []struct {
+			ID     string
+			Orders []struct {
+				ID string
+			}
+		}
+	}
+	c.MustPost(`{ account(pagination: {skip: 0, take: 10}) { id orders { id } } }`, &resp, c.admin)
+
+	// the accounts listed include the admin, without orders
+	if len(resp.Account) != len(want)+1 {
+		t.Fatalf("got %d accounts, want %d", len(resp.Account), len(want)+1)
+	}
+	for _, a := range resp.Account {
+		if len(a.Orders) != want[a.ID] {
+			t.Errorf("account %s has %d orders, want %d", a.ID, len(a.Orders), want[a.ID])
+		}
+	}
+}
+
+func TestCreateOrderRejectsInsufficientStock(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Grace")
+	productID := createProduct(t, c, "Monitor", "199", 1)
+
+	code := responseErrorCode(t, c, createOrderMutation,
+		login(t, c, "Grace"), client.Var("product", productID), client.Var("quantity", 2))
+
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s when ordering more than the stock", code, CodeBadUserInput)
+	}
+}
+
+func TestCreateOrderProducts(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Hedy")
+	as := login(t, c, "Hedy")
+	productID := createProduct(t, c, "Headset", "30", 5)
+
+	// the quantities of a product listed twice add up, in the order returned
+	// like in those read later
+	var created struct {
+		CreateOrder struct {
+			ID       string
+			Products []struct {
+				ID       string
+				Name     string
+				Quantity int
+				Price    struct{ Amount string }
+			}
+		}
+	}
+	c.MustPost(`mutation($product: String!) {
+		createOrder(order: {products: [{id: $product, quantity: 2}, {id: $product, quantity: 1}]}) {
+			id products { id name quantity price { amount } }
+		}
+	}`, &created, as, client.Var("product", productID))
+
+	if p := created.CreateOrder.Products; len(p) != 1 || p[0].ID != productID || p[0].Name != "Headset" ||
+		p[0].Quantity != 3 || p[0].Price.Amount != "30.00" {
+		t.Errorf("created products = %+v, want 3 x %s at 30.00", p, productID)
+	}
+	o, err := c.orderClient.GetOrder(context.Background(), created.CreateOrder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := o.Products; len(p) != 1 || p[0].ID != productID || p[0].Quantity != 3 {
+		t.Errorf("products = %+v, want 3 x %s", p, productID)
+	}
+	if p, err := c.catalogClient.GetProduct(context.Background(), productID); err != nil || p.Stock != 2 {
+		t.Errorf("stock = %d, %v, want 2 after ordering 3", p.GetStock(), err)
+	}
+
+	code := responseErrorCode(t, c, `mutation($product: String!) {
+		createOrder(order: {products: [{id: $product, quantity: 1}, {id: "missing", quantity: 1}]}) { id }
+	}`, as, client.Var("product", productID))
+
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s when ordering a missing product", code, CodeBadUserInput)
+	}
+	if p, err := c.catalogClient.GetProduct(context.Background(), productID); err != nil || p.Stock != 2 {
+		t.Errorf("stock = %d, %v, want still 2 after a rejected order", p.GetStock(), err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	c := newTestClient(t)
+
+	if code := responseErrorCode(t, c, `{ order(id: "missing") { id } }`); code != CodeNotFound {
+		t.Errorf("code = %q, want %s for a missing order", code, CodeNotFound)
+	}
+
+	if code := responseErrorCode(t, c, `mutation { createAccount(account: {name: " ", email: "blank@example.com", password: "password123"}) { id } }`); code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s for an empty account name", code, CodeBadUserInput)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Barbara")
+	as := login(t, c, "Barbara")
+
+	// a float total would be 0.30000000000000004
+	productID := createProduct(t, c, "Sticker", "0.10", 10)
+	var created struct {
+		CreateOrder struct {
+			ID         string
+			TotalPrice Money
+			Status     string
+		}
+	}
+	c.MustPost(createOrderMutation, &created, as, client.Var("product", productID), client.Var("quantity", 3))
+	if created.CreateOrder.TotalPrice != (Money{Amount: "0.30", Currency: "USD"}) {
+		t.Errorf("totalPrice = %+v, want 0.30 USD", created.CreateOrder.TotalPrice)
+	}
+
+	var yen struct {
+		CreateProduct struct {
+			ID    string
+			Price Money
+		}
+	}
+	c.MustPost(`mutation { createProduct(product: {name: "Fan", description: "", price: {amount: "1200", currency: "JPY"}}) { id price { amount currency } } }`,
+		&yen, c.admin)
+	if yen.CreateProduct.Price != (Money{Amount: "1200", Currency: "JPY"}) {
+		t.Errorf("price = %+v, want 1200 JPY", yen.CreateProduct.Price)
+	}
+
+	code := responseErrorCode(t, c, `mutation($usd: String!, $jpy: String!) {
+		createOrder(order: {products: [{id: $usd, quantity: 1}, {id: $jpy, quantity: 1}]}) { id }
+	}`, as, client.Var("usd", productID), client.Var("jpy", yen.CreateProduct.ID))
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s for an order mixing currencies", code, CodeBadUserInput)
+	}
+
+	for _, price := range []string{`{amount: "1.005", currency: "USD"}`, `{amount: "1", currency: "dollars"}`, `{amount: "-1", currency: "USD"}`} {
+		code := responseErrorCode(t, c, `mutation { createProduct(product: {name: "Bad", description: "", price: `+price+`}) { id } }`, c.admin)
+		if code != CodeBadUserInput {
+			t.Errorf("code = %q, want %s for price %s", code, CodeBadUserInput, price)
+		}
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Hedy")
+	as := login(t, c, "Hedy")
+	productID := createProduct(t, c, "Radio", "25", 5)
+
+	const mutation = `mutation($product: String!, $quantity: Int!, $key: String) {
+		createOrder(order: {products: [{id: $product, quantity: $quantity}]}, idempotencyKey: $key) { id }
+	}`
+	post := func(quantity int) string {
+		var resp struct {
+			CreateOrder struct {
+				ID string
+			}
+		}
+		c.MustPost(mutation, &resp, as, client.Var("product", productID), client.Var("quantity", quantity), client.Var("key", "order-1"))
+		return resp.CreateOrder.ID
+	}
+
+	first, retry := post(2), post(2)
+	if first == "" || retry != first {
+		t.Errorf("retried order id = %q, want %q", retry, first)
+	}
+
+	var products struct {
+		Products []struct {
+			Stock int
+		}
+	}
+	c.MustPost(`query($id: String) { products(id: $id) { stock } }`, &products, client.Var("id", productID))
+	if len(products.Products) != 1 || products.Products[0].Stock != 3 {
+		t.Errorf("products = %+v, want stock 3 after one order of 2", products.Products)
+	}
+
+	code := responseErrorCode(t, c, mutation, as, client.Var("product", productID), client.Var("quantity", 1), client.Var("key", "order-1"))
+	if code != CodeConflict {
+		t.Errorf("code = %q, want %s when reusing a key for a different order", code, CodeConflict)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := newTestClient(t)
+
+	var published []events.Event
+	c.broker.Subscribe(">", func(ctx context.Context, event events.Event) error {
+		published = append(published, event)
+		return nil
+	})
+	c.flushEvents(t) // the admin account of the test client
+	published = nil
+
+	accountID := createAccount(t, c, "Margaret")
+	productID := createProduct(t, c, "Lamp", "30", 5)
+	for _, price := range []string{"35", "35"} {
+		c.MustPost(`mutation($id: String!, $price: String!) {
+			updateProduct(id: $id, product: {price: {amount: $price, currency: "USD"}}) { id }
+		}`, &struct{ UpdateProduct struct{ ID string } }{}, c.admin, client.Var("id", productID), client.Var("price", price))
+	}
+	orderID := createOrder(t, c, login(t, c, "Margaret"), productID, 2)
+	c.flushEvents(t)
+
+	types := map[string]events.Event{}
+	for _, e := range published {
+		if _, ok := types[e.Type]; ok {
+			t.Errorf("%s published twice", e.Type)
+		}
+		types[e.Type] = e
+	}
+	if len(types) != 3 {
+		t.Fatalf("published %d events, want the 3 of the account, the price change and the order: %+v", len(published), published)
+	}
+
+	var created events.AccountCreated
+	if err := types[events.TypeAccountCreated].Decode(&created); err != nil || created.AccountID != accountID {
+		t.Errorf("AccountCreated = %+v, %v, want account %s", created, err, accountID)
+	}
+	var changed events.ProductPriceChanged
+	if err := types[events.TypeProductPriceChanged].Decode(&changed); err != nil || changed.Price.Decimal() != "35.00" {
+		t.Errorf("ProductPriceChanged = %+v, %v, want price 35.00", changed, err)
+	}
+	var placed events.OrderPlaced
+	if err := types[events.TypeOrderPlaced].Decode(&placed); err != nil || placed.OrderID != orderID || placed.AccountID != accountID || placed.TotalPrice.Decimal() != "70.00" {
+		t.Errorf("OrderPlaced = %+v, %v, want order %s of account %s for 70.00", placed, err, orderID, accountID)
+	}
+
+	// events stay in the outbox until they are published
+	published = nil
+	c.flushEvents(t)
+	if len(published) != 0 {
+		t.Errorf("published %d events again", len(published))
+	}
+}
+
+// orderEvent is a message of an order subscription
+type orderEvent struct {
+	order struct {
+		ID     string
+		Status string
+	}
+	err error
+}
+
+// receive reads the messages of a subscription in the background, decoding
+// them with field as the name of the subscription
+func receive(sub *client.Subscription, field string) <-chan orderEvent {
+	ch := make(chan orderEvent, 16)
+	go func() {
+		for {
+			var e orderEvent
+			resp := map[string]interface{}{}
+			e.err = sub.Next(&resp)
+			if e.err == nil {
+				b, _ := json.Marshal(resp[field])
+				e.err = json.Unmarshal(b, &e.order)
+			}
+			ch <- e
+			if e.err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func TestSubscriptions(t *testing.T) {
+	c := newTestClient(t)
+
+	accountID := createAccount(t, c, "Katherine")
+	as := login(t, c, "Katherine")
+	productID := createProduct(t, c, "Clock", "15", 100)
+
+	// browsers authenticate in the connection_init payload
+	placed := c.WebsocketWithPayload(`subscription($account: String!) { ordersForAccount(accountId: $account) { id status } }`,
+		map[string]any{"Authorization": "Bearer " + accessToken(t, c, "Katherine")}, client.Var("account", accountID))
+	defer placed.Close()
+	placedOrders := receive(placed, "ordersForAccount")
+
+	// the subscription starts in the background, so orders are placed until
+	// one of them comes through
+	var orderID string
+	ordered := map[string]bool{}
+	for i := 0; orderID == "" && i < 50; i++ {
+		ordered[createOrder(t, c, as, productID, 1)] = true
+		c.flushEvents(t)
+		select {
+		case e := <-placedOrders:
+			if e.err != nil || !ordered[e.order.ID] || e.order.Status != "PENDING" {
+				t.Fatalf("ordersForAccount sent %+v, %v, want one of the orders placed", e.order, e.err)
+			}
+			orderID = e.order.ID
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if orderID == "" {
+		t.Fatal("ordersForAccount sent no order")
+	}
+
+	updated := c.Websocket(`subscription($id: String!) { orderUpdated(orderId: $id) { id status } }`, as, client.Var("id", orderID))
+	defer updated.Close()
+	updates := receive(updated, "orderUpdated")
+
+	next := func(want string) {
+		t.Helper()
+		select {
+		case e := <-updates:
+			if e.err != nil || e.order.ID != orderID || e.order.Status != want {
+				t.Fatalf("orderUpdated sent %+v, %v, want order %s %s", e.order, e.err, orderID, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("orderUpdated sent nothing, want order %s %s", orderID, want)
+		}
+	}
+	next("PENDING")
+
+	c.MustPost(`mutation($id: String!) { cancelOrder(id: $id) { id } }`,
+		&struct{ CancelOrder struct{ ID string } }{}, as, client.Var("id", orderID))
+	c.flushEvents(t)
+	next("CANCELLED")
+
+	createAccount(t, c, "Mallory")
+	other := c.Websocket(`subscription($id: String!) { orderUpdated(orderId: $id) { id status } }`, login(t, c, "Mallory"), client.Var("id", orderID))
+	defer other.Close()
+	var resp map[string]interface{}
+	if err := other.Next(&resp); err == nil || !strings.Contains(err.Error(), CodeForbidden) {
+		t.Errorf("orderUpdated of another account = %v, want %s", err, CodeForbidden)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	createAccount(t, c, "Ada")
+	as := login(t, c, "Ada")
+	keyboardID := createProduct(t, c, "Keyboard", "50", 5)
+	mouseID := createProduct(t, c, "Mouse", "20", 5)
+	firstID := createOrder(t, c, as, keyboardID, 1)
+	secondID := createOrder(t, c, as, mouseID, 2)
+	var deleted struct {
+		DeleteProduct struct {
+			ID string
+		}
+	}
+	c.MustPost(`mutation($id: String!) { deleteProduct(id: $id) { id } }`, &deleted, c.admin, client.Var("id", mouseID))
+
+	var names []string
+	for a, err := range c.accountClient.StreamAccounts(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, a.Name)
+	}
+	if !slices.Contains(names, "Admin") || !slices.Contains(names, "Ada") || len(names) != 2 {
+		t.Errorf("streamed accounts %v, want Admin and Ada", names)
+	}
+
+	var products []catalog.Product
+	for p, err := range c.catalogClient.StreamProducts(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		products = append(products, p)
+	}
+	if len(products) != 2 || !slices.IsSortedFunc(products, func(a, b catalog.Product) int { return strings.Compare(a.ID, b.ID) }) {
+		t.Fatalf("streamed products %+v, want both in ID order", products)
+	}
+	for _, p := range products {
+		if p.Deleted != (p.ID == mouseID) {
+			t.Errorf("streamed product %s deleted = %v", p.Name, p.Deleted)
+		}
+	}
+
+	var orders []order.Order
+	for o, err := range c.orderClient.StreamOrders(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders = append(orders, o)
+	}
+	wantIDs := []string{firstID, secondID}
+	slices.Sort(wantIDs)
+	if len(orders) != 2 || orders[0].ID != wantIDs[0] || orders[1].ID != wantIDs[1] {
+		t.Fatalf("streamed orders %+v, want %v", orders, wantIDs)
+	}
+	for _, o := range orders {
+		if len(o.Products) != 1 || o.Products[0].Name == "" {
+			t.Errorf("streamed order %s has products %+v, want them named from the catalog", o.ID, o.Products)
+		}
+	}
+
+	// breaking out of the loop early cancels the stream without an error
+	n := 0
+	for _, err := range c.accountClient.StreamAccounts(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("streamed %d accounts before breaking, want 1", n)
+	}
+}
+
+func TestImportProducts(t *testing.T) {
+	c := newTestClient(t)
+
+	// enough products for a few batches, with a nameless one in each
+	var products []catalog.Product
+	for i := range 1200 {
+		p := catalog.Product{Name: fmt.Sprintf("Imported %d", i), Price: money.New(int64(100+i), "USD"), Stock: 3}
+		if i%500 == 7 {
+			p.Name = ""
+		}
+		products = append(products, p)
+	}
+
+	report, err := c.catalogClient.ImportProducts(context.Background(), slices.Values(products))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1197 || report.Failed != 3 {
+		t.Errorf("imported %d and failed %d, want 1197 and 3", report.Imported, report.Failed)
+	}
+	var indexes []int
+	for _, f := range report.Failures {
+		indexes = append(indexes, f.Index)
+		if errs.KindOf(f.Err) != errs.InvalidArgument {
+			t.Errorf("failure %d is %v, want an invalid argument", f.Index, f.Err)
+		}
+	}
+	if !slices.Equal(indexes, []int{7, 507, 1007}) {
+		t.Errorf("failed products %v, want 7, 507 and 1007", indexes)
+	}
+
+	imported := map[string]catalog.Product{}
+	for p, err := range c.catalogClient.StreamProducts(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported[p.Name] = p
+	}
+	if len(imported) != 1197 {
+		t.Errorf("%d products stored, want 1197", len(imported))
+	}
+	if p := imported["Imported 1199"]; p.Price.Decimal() != "12.99" || p.Stock != 3 {
+		t.Errorf("imported product = %+v, want priced 12.99 with 3 in stock", p)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Linus")
+	as := login(t, c, "Linus")
+	productID := createProduct(t, c, "Mouse", "20", 5)
+
+	orderID := createOrder(t, c, as, productID, 1)
+
+	var cancelled struct {
+		CancelOrder struct {
+			Status string
+		}
+	}
+	c.MustPost(`mutation($id: String!) { cancelOrder(id: $id, reason: "changed my mind") { status } }`,
+		&cancelled, as, client.Var("id", orderID))
+
+	if cancelled.CancelOrder.Status != "CANCELLED" {
+		t.Errorf("status = %q, want CANCELLED", cancelled.CancelOrder.Status)
+	}
+
+	p, err := c.catalogClient.GetProduct(context.Background(), productID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Stock != 5 {
+		t.Errorf("stock = %d, want the 5 units back after cancelling", p.Stock)
+	}
+
+	// a cancelled order cannot be cancelled again, so its stock is returned once
+	code := responseErrorCode(t, c, `mutation($id: String!) { cancelOrder(id: $id) { status } }`,
+		as, client.Var("id", orderID))
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s when cancelling twice", code, CodeBadUserInput)
+	}
+	if p, err := c.catalogClient.GetProduct(context.Background(), productID); err != nil || p.Stock != 5 {
+		t.Errorf("stock = %d, %v, want still 5 after cancelling twice", p.GetStock(), err)
+	}
+
+	code = responseErrorCode(t, c, `mutation($id: String!) { updateOrderStatus(id: $id, status: SHIPPED) { status } }`,
+		c.admin, client.Var("id", orderID))
+
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s when shipping a cancelled order", code, CodeBadUserInput)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	c := newTestClient(t)
+
+	productID := createProduct(t, c, "Pen", "1", 100)
+	for _, name := range []string{"Paper", "Pencil"} {
+		createProduct(t, c, name, "1", 100)
+	}
+	accountID := createAccount(t, c, "Barbara")
+	for _, name := range []string{"Niklaus", "Edsger"} {
+		createAccount(t, c, name)
+	}
+	as := login(t, c, "Barbara")
+	for i := 0; i < 3; i++ {
+		createOrder(t, c, as, productID, 1)
+	}
+
+	type pageInfo struct {
+		HasNextPage     bool
+		HasPreviousPage bool
+		StartCursor     *string
+		EndCursor       *string
+	}
+
+	// walk a connection two nodes at a time and return the ids in order
+	walk := func(query string, connection func(resp map[string]json.RawMessage) json.RawMessage, options ...client.Option) []string {
+		ids := []string{}
+		var after *string
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatal("connection did not end")
+			}
+
+			raw, err := c.RawPost(query, append(options, client.Var("after", after))...)
+			if err != nil || raw.Errors != nil {
+				t.Fatalf("query failed: %v %s", err, raw.Errors)
+			}
+			data, _ := json.Marshal(raw.Data)
+			var resp map[string]json.RawMessage
+			if err := json.Unmarshal(data, &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			var conn struct {
+				Edges []struct {
+					Cursor string
+					Node   struct {
+						ID string
+					}
+				}
+				PageInfo pageInfo
+			}
+			if err := json.Unmarshal(connection(resp), &conn); err != nil {
+				t.Fatal(err)
+			}
+
+			if conn.PageInfo.HasPreviousPage != (after != nil) {
+				t.Errorf("hasPreviousPage = %v after cursor %v", conn.PageInfo.HasPreviousPage, after)
+			}
+			for _, e := range conn.Edges {
+				ids = append(ids, e.Node.ID)
+			}
+			if !conn.PageInfo.HasNextPage {
+				return ids
+			}
+			if len(conn.Edges) != 2 || *conn.PageInfo.EndCursor != conn.Edges[1].Cursor {
+				t.Fatalf("page %+v is not full or its end cursor is not the last edge", conn)
+			}
+			after = conn.PageInfo.EndCursor
+		}
+	}
+
+	accounts := walk(`query($after: String) {
+		accountsConnection(first: 2, after: $after) {
+			edges { cursor node { id } }
+			pageInfo { hasNextPage hasPreviousPage startCursor endCursor }
+		}
+	}`, func(resp map[string]json.RawMessage) json.RawMessage { return resp["accountsConnection"] })
+	if len(accounts) != 4 {
+		t.Errorf("accountsConnection returned %v, want the admin and 3 accounts", accounts)
+	}
+
+	products := walk(`query($after: String) {
+		productsConnection(first: 2, after: $after) {
+			edges { cursor node { id } }
+			pageInfo { hasNextPage hasPreviousPage startCursor endCursor }
+		}
+	}`, func(resp map[string]json.RawMessage) json.RawMessage { return resp["productsConnection"] })
+	if len(products) != 3 || products[1] != productID {
+		t.Errorf("productsConnection returned %v, want Paper, Pen and Pencil", products)
+	}
+
+	orders := walk(`query($id: String, $after: String) {
+		account(id: $id) {
+			ordersConnection(first: 2, after: $after) {
+				edges { cursor node { id } }
+				pageInfo { hasNextPage hasPreviousPage startCursor endCursor }
+			}
+		}
+	}`, func(resp map[string]json.RawMessage) json.RawMessage {
+		var account []map[string]json.RawMessage
+		json.Unmarshal(resp["account"], &account)
+		return account[0]["ordersConnection"]
+	}, as, client.Var("id", accountID))
+	if len(orders) != 3 {
+		t.Errorf("ordersConnection returned %v, want 3 orders", orders)
+	}
+}
+
+func TestUpdateAndDeleteProduct(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Frances")
+	as := login(t, c, "Frances")
+	productID := createProduct(t, c, "Lamp", "30", 5)
+	orderID := createOrder(t, c, as, productID, 1)
+
+	var updated struct {
+		UpdateProduct struct {
+			Name  string
+			Price Money
+			Stock int
+		}
+	}
+	c.MustPost(`mutation($id: String!) { updateProduct(id: $id, product: {price: {amount: "25", currency: "USD"}, stock: 10}) { name price { amount currency } stock } }`,
+		&updated, c.admin, client.Var("id", productID))
+
+	if updated.UpdateProduct.Name != "Lamp" || updated.UpdateProduct.Price.Amount != "25.00" || updated.UpdateProduct.Stock != 10 {
+		t.Errorf("updated product = %+v, want Lamp at 25.00 with 10 in stock", updated.UpdateProduct)
+	}
+
+	var deleted struct {
+		DeleteProduct struct {
+			Deleted bool
+		}
+	}
+	c.MustPost(`mutation($id: String!) { deleteProduct(id: $id) { deleted } }`, &deleted, c.admin, client.Var("id", productID))
+
+	if !deleted.DeleteProduct.Deleted {
+		t.Error("deleteProduct did not flag the product as deleted")
+	}
+
+	var products struct {
+		Products []struct {
+			ID string
+		}
+	}
+	c.MustPost(`{ products(pagination: {skip: 0, take: 10}) { id } }`, &products)
+
+	if len(products.Products) != 0 {
+		t.Errorf("products = %+v, want the deleted product hidden", products.Products)
+	}
+
+	var o struct {
+		Order struct {
+			Products []struct {
+				Name  string
+				Price Money
+			}
+		}
+	}
+	c.MustPost(`query($id: String!) { order(id: $id) { products { name price { amount currency } } } }`, &o, as, client.Var("id", orderID))
+
+	// the order keeps the price the Lamp was ordered at
+	if len(o.Order.Products) != 1 || o.Order.Products[0].Name != "Lamp" || o.Order.Products[0].Price.Amount != "30.00" {
+		t.Errorf("order products = %+v, want the deleted Lamp at 30.00", o.Order.Products)
+	}
+
+	code := responseErrorCode(t, c, createOrderMutation,
+		as, client.Var("product", productID), client.Var("quantity", 1))
+
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s when ordering a deleted product", code, CodeBadUserInput)
+	}
+}
+
+func TestUpdateAndDeactivateAccount(t *testing.T) {
+	c := newTestClient(t)
+
+	accountID := createAccount(t, c, "Margaret")
+	as := login(t, c, "Margaret")
+	createAccount(t, c, "Katherine")
+	productID := createProduct(t, c, "Notebook", "3", 10)
+
+	var updated struct {
+		UpdateAccount struct {
+			Name   string
+			Email  string
+			Active bool
+		}
+	}
+	c.MustPost(`mutation($id: String!) { updateAccount(id: $id, account: {email: "Maggie@Example.com"}) { name email active } }`,
+		&updated, as, client.Var("id", accountID))
+
+	if updated.UpdateAccount.Name != "Margaret" || updated.UpdateAccount.Email != "maggie@example.com" || !updated.UpdateAccount.Active {
+		t.Errorf("updated account = %+v, want Margaret with the new email", updated.UpdateAccount)
+	}
+
+	code := responseErrorCode(t, c, `mutation($id: String!) { updateAccount(id: $id, account: {email: "katherine@example.com"}) { id } }`,
+		as, client.Var("id", accountID))
+	if code != CodeConflict {
+		t.Errorf("code = %q, want %s for an email in use", code, CodeConflict)
+	}
+
+	var deactivated struct {
+		DeactivateAccount struct {
+			Active bool
+		}
+	}
+	c.MustPost(`mutation($id: String!) { deactivateAccount(id: $id) { active } }`, &deactivated, as, client.Var("id", accountID))
+
+	if deactivated.DeactivateAccount.Active {
+		t.Error("deactivateAccount left the account active")
+	}
+
+	code = responseErrorCode(t, c, createOrderMutation,
+		as, client.Var("product", productID), client.Var("quantity", 1))
+	if code != CodeBadUserInput {
+		t.Errorf("code = %q, want %s when a deactivated account orders", code, CodeBadUserInput)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	c := newTestClient(t)
+
+	createAccount(t, c, "Alan")
+	productID := createProduct(t, c, "Tape", "2", 10)
+
+	code := responseErrorCode(t, c, createOrderMutation, client.Var("product", productID), client.Var("quantity", 1))
+	if code != CodeUnauthenticated {
+		t.Errorf("code = %q, want %s when ordering anonymously", code, CodeUnauthenticated)
+	}
+
+	code = responseErrorCode(t, c, createOrderMutation,
+		client.AddHeader("Authorization", "Bearer forged"), client.Var("product", productID), client.Var("quantity", 1))
+	if code != CodeUnauthenticated {
+		t.Errorf("code = %q, want %s with an invalid token", code, CodeUnauthenticated)
+	}
+
+	code = responseErrorCode(t, c, `mutation { login(email: "alan@example.com", password: "wrong password") { accessToken } }`)
+	if code != CodeUnauthenticated {
+		t.Errorf("code = %q, want %s for a wrong password", code, CodeUnauthenticated)
+	}
+
+	var tokens struct {
+		Login struct {
+			AccessToken  string
+			RefreshToken string
+		}
+	}
+	c.MustPost(`mutation { login(email: "alan@example.com", password: "password123") { accessToken refreshToken } }`, &tokens)
+
+	code = responseErrorCode(t, c, createOrderMutation,
+		client.AddHeader("Authorization", "Bearer "+tokens.Login.RefreshToken), client.Var("product", productID), client.Var("quantity", 1))
+	if code != CodeUnauthenticated {
+		t.Errorf("code = %q, want %s when authenticating with a refresh token", code, CodeUnauthenticated)
+	}
+
+	var refreshed struct {
+		RefreshToken struct {
+			AccessToken string
+		}
+	}
+	c.MustPost(`mutation($token: String!) { refreshToken(refreshToken: $token) { accessToken } }`,
+		&refreshed, client.Var("token", tokens.Login.RefreshToken))
+
+	createOrder(t, c, client.AddHeader("Authorization", "Bearer "+refreshed.RefreshToken.AccessToken), productID, 1)
+}
+
+func TestAuthorization(t *testing.T) {
+	c := newTestClient(t)
+
+	accountID := createAccount(t, c, "Ada")
+	ada := login(t, c, "Ada")
+	bobID := createAccount(t, c, "Bob")
+	bob := login(t, c, "Bob")
+
+	const createProductMutation = `mutation { createProduct(product: {name: "Chair", description: "", price: {amount: "80", currency: "USD"}}) { id } }`
+
+	if code := responseErrorCode(t, c, createProductMutation); code != CodeUnauthenticated {
+		t.Errorf("code = %q, want %s when creating a product anonymously", code, CodeUnauthenticated)
+	}
+	if code := responseErrorCode(t, c, createProductMutation, bob); code != CodeForbidden {
+		t.Errorf("code = %q, want %s when a customer creates a product", code, CodeForbidden)
+	}
+
+	productID := createProduct(t, c, "Desk", "120", 3)
+	createOrder(t, c, ada, productID, 1)
+
+	const ordersQuery = `query($id: String) { account(id: $id) { orders { id } } }`
+
+	if code := responseErrorCode(t, c, ordersQuery, bob, client.Var("id", accountID)); code != CodeForbidden {
+		t.Errorf("code = %q, want %s when reading the orders of another account", code, CodeForbidden)
+	}
+
+	var orders struct {
+		Account []struct {
+			Orders []struct {
+				ID string
+			}
+		}
+	}
+	c.MustPost(ordersQuery, &orders, c.admin, client.Var("id", accountID))
+
+	if len(orders.Account) != 1 || len(orders.Account[0].Orders) != 1 {
+		t.Errorf("admin got %+v, want the order of the account", orders.Account)
+	}
+
+	// the email and roles of an account are private too, while its name is not
+	for _, query := range []string{
+		`query($id: String) { account(id: $id) { email } }`,
+		`query($id: String) { account(id: $id) { roles } }`,
+		`{ accountsConnection(first: 100) { edges { node { email } } } }`,
+	} {
+		if code := responseErrorCode(t, c, query, bob, client.Var("id", accountID)); code != CodeForbidden {
+			t.Errorf("code = %q, want %s for %s of another account", code, CodeForbidden, query)
+		}
+		if code := responseErrorCode(t, c, query, client.Var("id", accountID)); code != CodeUnauthenticated {
+			t.Errorf("code = %q, want %s for %s read anonymously", code, CodeUnauthenticated, query)
+		}
+	}
+
+	var profile struct {
+		Account []struct {
+			Name  string
+			Email string
+			Roles []string
+		}
+	}
+	for _, as := range []client.Option{ada, c.admin} {
+		c.MustPost(`query($id: String) { account(id: $id) { name email roles } }`, &profile, as, client.Var("id", accountID))
+		if len(profile.Account) != 1 || profile.Account[0].Email != email("Ada") || len(profile.Account[0].Roles) != 1 {
+			t.Errorf("got %+v, want the email and roles of Ada for the account and admins", profile.Account)
+		}
+	}
+	c.MustPost(`query($id: String) { account(id: $id) { name } }`, &profile, client.Var("id", accountID))
+	if len(profile.Account) != 1 || profile.Account[0].Name != "Ada" {
+		t.Errorf("got %+v, want the name of Ada for anyone", profile.Account)
+	}
+
+	var promoted struct {
+		SetAccountRoles struct {
+			Roles []string
+		}
+	}
+	c.MustPost(`mutation($id: String!) { setAccountRoles(id: $id, roles: [ADMIN]) { roles } }`,
+		&promoted, c.admin, client.Var("id", bobID))
+
+	if strings.Join(promoted.SetAccountRoles.Roles, ",") != "CUSTOMER,ADMIN" {
+		t.Errorf("roles = %v, want CUSTOMER and ADMIN", promoted.SetAccountRoles.Roles)
+	}
+
+	// the roles are read from the token, so they apply from the next login
+	var created struct {
+		CreateProduct struct {
+			ID string
+		}
+	}
+	c.MustPost(createProductMutation, &created, login(t, c, "Bob"))
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	c := newTestClient(t)
+	createAccount(t, c, "Grace")
+	as := login(t, c, "Grace")
+	productID := createProduct(t, c, "Mouse", "20", 5)
+
+	exporter.Reset()
+	createOrder(t, c, as, productID, 1)
+
+	spans := exporter.GetSpans()
+	var operation *tracetest.SpanStub
+	for i := range spans {
+		if spans[i].Name == "graphql.mutation" {
+			operation = &spans[i]
+		}
+	}
+	if operation == nil {
+		t.Fatalf("no operation span in %d spans", len(spans))
+	}
+
+	// every hop of createOrder belongs to the trace of the operation
+	want := []string{
+		"graphql.resolve Mutation.createOrder",
+		"order.OrderService/PostOrder",
+		"pb.AccountService/GetAccount",
+		"pb.CatalogService/GetProducts",
+		"pb.CatalogService/ReserveStock",
+	}
+	for _, name := range want {
+		found := false
+		for _, span := range spans {
+			if span.Name == name && span.SpanContext.TraceID() == operation.SpanContext.TraceID() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no %q span in the trace of the operation", name)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	c := newTestClient(t)
+	createAccount(t, c, "Ken")
+	as := login(t, c, "Ken")
+	productID := createProduct(t, c, "Keyboard", "80", 1)
+
+	// the second order is out of stock, so the gateway logs its error too
+	for _, wantErr := range []bool{false, true} {
+		resp, err := c.RawPost(createOrderMutation, as, client.Var("product", productID), client.Var("quantity", 1),
+			client.AddHeader("X-Request-ID", "order-request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotErr := len(resp.Errors) != 0; gotErr != wantErr {
+			t.Fatalf("errors = %s, want errors %v", resp.Errors, wantErr)
+		}
+	}
+
+	// every service the order went through logged with the ID of the request
+	services := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(c.logs.String()), "\n") {
+		var record struct {
+			Service   string
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		if record.RequestID == "order-request" {
+			services[record.Service] = true
+		}
+	}
+	for _, service := range []string{"graphql", "order", "account", "catalog"} {
+		if !services[service] {
+			t.Errorf("no %s log line with the request ID", service)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	for _, collector := range order.Collectors() {
+		if err := prometheus.Register(collector); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestClient(t)
+	createAccount(t, c, "Linus")
+	as := login(t, c, "Linus")
+	productID := createProduct(t, c, "Monitor", "150", 3)
+
+	// counters are global to the process, so compare them around the order
+	before := scrapeMetrics(t)
+	createOrder(t, c, as, productID, 2)
+	after := scrapeMetrics(t)
+
+	for _, want := range []string{
+		`grpc_server_handled_total{grpc_code="OK",grpc_method="PostOrder",grpc_service="order.OrderService"}`,
+		`grpc_server_handling_seconds_count{grpc_method="ReserveStock",grpc_service="pb.CatalogService"}`,
+		`graphql_operation_duration_seconds_count{operation_type="mutation"}`,
+		`graphql_resolver_duration_seconds_count{field="createOrder",object="Mutation"}`,
+	} {
+		if _, ok := after[want]; !ok {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+
+	if got := after["orders_created_total"] - before["orders_created_total"]; got != 1 {
+		t.Errorf("orders_created_total grew by %v, want 1", got)
+	}
+	if got := after[`order_value_total{currency="USD"}`] - before[`order_value_total{currency="USD"}`]; math.Abs(got-300) > 1e-6 {
+		t.Errorf("order_value_total grew by %v, want 300", got)
+	}
+}
+
+// scrapeMetrics returns the samples served by the metrics handler, keyed by
+// their name and labels
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	samples := map[string]float64{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
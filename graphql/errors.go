@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error codes set in the extensions of GraphQL errors
+const (
+	CodeNotFound        = "NOT_FOUND"
+	CodeBadUserInput    = "BAD_USER_INPUT"
+	CodeConflict        = "CONFLICT"
+	CodeUnauthenticated = "UNAUTHENTICATED"
+	CodeForbidden       = "FORBIDDEN"
+	CodeUnavailable     = "UNAVAILABLE"
+	CodeInternal        = "INTERNAL"
+)
+
+// withRequestID tags every request with an ID, taken from the X-Request-ID
+// header when the caller sent one, and echoes it back in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = logging.NewRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// presentError sets extensions.code from the gRPC status of the error, hides
+// the message of internal errors and attaches the request ID. Errors of the
+// resolvers are logged here, once per error.
+func (s *Server) presentError(ctx context.Context, err error) *gqlerror.Error {
+	gqlErr := graphql.DefaultErrorPresenter(ctx, err)
+
+	if gqlErr.Extensions == nil {
+		gqlErr.Extensions = map[string]interface{}{}
+	}
+	gqlErr.Extensions["requestId"] = logging.RequestID(ctx)
+
+	// errors raised by gqlgen itself, such as validation errors, already
+	// carry their own code
+	if _, ok := gqlErr.Extensions["code"]; ok {
+		return gqlErr
+	}
+
+	code := errorCode(err)
+	gqlErr.Extensions["code"] = code
+	logging.Error(ctx, s.logger, "GraphQL request failed", err, "path", gqlErr.Path.String(), "code", code)
+
+	if code == CodeInternal {
+		gqlErr.Message = "internal server error"
+	}
+
+	return gqlErr
+}
+
+func errorCode(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CodeUnavailable
+	}
+
+	s, ok := status.FromError(err)
+	if !ok {
+		return CodeInternal
+	}
+
+	switch s.Code() {
+	case codes.NotFound:
+		return CodeNotFound
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return CodeBadUserInput
+	case codes.AlreadyExists, codes.Aborted:
+		return CodeConflict
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return CodeUnavailable
+	case codes.Unauthenticated:
+		return CodeUnauthenticated
+	case codes.PermissionDenied:
+		return CodeForbidden
+	}
+	return CodeInternal
+}
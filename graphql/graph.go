@@ -1,10 +1,21 @@
 package main
 
 import (
+	"log/slog"
+	"net/http"
+	"time"
+
 	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/ndquang191/go-graph-grpc/account"
 	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
 	"github.com/ndquang191/go-graph-grpc/order"
+	"github.com/vektah/gqlparser/v2/ast"
+	"google.golang.org/grpc"
 )
 
 // central file for all the resolvers
@@ -13,20 +24,24 @@ type Server struct {
 	accountClient *account.Client
 	catalogClient *catalog.Client
 	orderClient   *order.Client
+	signer        *auth.Signer
+	logger        *slog.Logger
 }
 
-func NewGraphQLServer(accountURL string, catalogURL string, orderURL string) (*Server, error) {
+// NewGraphQLServer connects to the services. The signer verifies the tokens
+// requests are authenticated with.
+func NewGraphQLServer(accountURL string, catalogURL string, orderURL string, signer *auth.Signer, logger *slog.Logger, opts ...grpc.DialOption) (*Server, error) {
 
-	accountClient, err := account.NewClient(accountURL)
+	accountClient, err := account.NewClient(accountURL, opts...)
 	if err != nil {
 		return nil, err
 	}
-	catalogClient, err := catalog.NewClient(catalogURL)
+	catalogClient, err := catalog.NewClient(catalogURL, opts...)
 	if err != nil {
 		accountClient.Close()
 		return nil, err
 	}
-	orderClient, err := order.NewClient(orderURL)
+	orderClient, err := order.NewClient(orderURL, opts...)
 	if err != nil {
 		accountClient.Close()
 		catalogClient.Close()
@@ -37,9 +52,18 @@ func NewGraphQLServer(accountURL string, catalogURL string, orderURL string) (*S
 		accountClient: accountClient,
 		catalogClient: catalogClient,
 		orderClient:   orderClient,
+		signer:        signer,
+		logger:        logger,
 	}, nil
 }
 
+// Close releases the connections to the downstream services
+func (s *Server) Close() {
+	s.accountClient.Close()
+	s.catalogClient.Close()
+	s.orderClient.Close()
+}
+
 func (s *Server) Mutation() MutationResolver {
 	return &mutationResolver{server: s}
 }
@@ -48,6 +72,10 @@ func (s *Server) Query() QueryResolver {
 	return &queryResolver{server: s}
 }
 
+func (s *Server) Subscription() SubscriptionResolver {
+	return &subscriptionResolver{server: s}
+}
+
 func (s *Server) Account() AccountResolver {
 	return &accountResolver{server: s}
 }
@@ -55,5 +83,30 @@ func (s *Server) Account() AccountResolver {
 func (s *Server) ToExecutableSchema() graphql.ExecutableSchema {
 	return NewExecutableSchema(Config{
 		Resolvers: s,
+		Directives: DirectiveRoot{
+			HasRole: hasRole,
+		},
 	})
 }
+
+// Handler returns the HTTP handler serving the GraphQL API, with the
+// subscriptions over WebSocket
+func (s *Server) Handler() http.Handler {
+	srv := handler.New(s.ToExecutableSchema())
+	srv.AddTransport(transport.Websocket{
+		InitFunc:              s.initWebsocket,
+		KeepAlivePingInterval: 10 * time.Second,
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+	srv.SetQueryCache(lru.New[*ast.QueryDocument](1000))
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{Cache: lru.New[string](100)})
+
+	srv.SetErrorPresenter(s.presentError)
+	srv.Use(tracer{})
+	srv.Use(meter{})
+	return withRequestID(withTraceContext(s.withAuth(s.withLoaders(srv))))
+}
@@ -1,34 +1,103 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	// "github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/playground"
-	"github.com/99designs/gqlgen/handler"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/metrics"
+	"github.com/ndquang191/go-graph-grpc/internal/mtls"
+	"github.com/ndquang191/go-graph-grpc/internal/tracing"
 )
 
 type AppConfig struct {
 	AccountURL string `envconfig:"ACCOUNT_SERVICE_URL" json:"account_url"`
 	CatalogURL string `envconfig:"CATALOG_SERVICE_URL" json:"catalog_url"`
 	OrderURL   string `envconfig:"ORDER_SERVICE_URL" json:"order_url"`
+	JWTSecret  string `envconfig:"JWT_SECRET" required:"true" json:"-"`
+	// TLS holds the client certificate the gateway presents to the services
+	TLS     mtls.Config    `envconfig:"TLS" json:"-"`
+	Tracing tracing.Config `envconfig:"TRACING" json:"-"`
+	Log     logging.Config `envconfig:"LOG" json:"-"`
+	// AdminPort serves the metrics at /metrics, apart from the API
+	AdminPort int `envconfig:"ADMIN_PORT" default:"9090" json:"admin_port"`
 }
 
 func main() {
 	cfg := AppConfig{}
 	err := envconfig.Process("", &cfg)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(slog.Default(), "Failed to read the config", "error", err)
 	}
 
-	s, err := NewGraphQLServer(cfg.AccountURL, cfg.CatalogURL, cfg.OrderURL)
+	logger, err := logging.New(os.Stderr, cfg.Log, "graphql")
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(slog.Default(), "Failed to set up logging", "error", err)
 	}
+	slog.SetDefault(logger)
 
-	http.Handle("/graphql", handler.GraphQL(s.ToExecutableSchema()))
-	http.Handle("/graphql", playground.Handler("quang", "/graphql"))
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	shutdownTracing, err := tracing.Setup(context.Background(), "graphql", cfg.Tracing)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up tracing", "error", err)
+	}
+
+	opts, err := cfg.TLS.DialOptions()
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS credentials", "error", err)
+	}
+
+	s, err := NewGraphQLServer(cfg.AccountURL, cfg.CatalogURL, cfg.OrderURL, auth.NewSigner([]byte(cfg.JWTSecret)), logger, opts...)
+	if err != nil {
+		logging.Fatal(logger, "Failed to connect to the services", "error", err)
+	}
+
+	http.Handle("/graphql", s.Handler())
+	http.Handle("/playground", playground.Handler("quang", "/graphql"))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	adminServer := metrics.NewAdminServer(cfg.AdminPort)
+	go func() {
+		if err := adminServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Admin server failed", "error", err)
+		}
+	}()
+
+	httpServer := &http.Server{Addr: ":8080"}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		logger.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to shut down the server", "error", err)
+		}
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to shut down the admin server", "error", err)
+		}
+	}()
+
+	logger.Info("Serving", "port", 8080, "admin_port", cfg.AdminPort)
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		logging.Fatal(logger, "Server failed", "error", err)
+	}
+	<-drained
+
+	// flush the spans of the last requests before exiting
+	s.Close()
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Error("Failed to flush spans", "error", err)
+	}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	operationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_operation_duration_seconds",
+		Help:    "Time taken to execute GraphQL operations, by operation type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation_type"})
+
+	resolverSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_resolver_duration_seconds",
+		Help:    "Time taken by GraphQL field resolvers, by object and field.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"object", "field"})
+
+	graphqlErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_errors_total",
+		Help: "Errors returned in GraphQL responses, by operation type and error code.",
+	}, []string{"operation_type", "code"})
+)
+
+// meter is a gqlgen extension timing operations and resolvers and counting
+// the errors of responses. Operation names are left out of the labels since
+// clients choose them freely.
+type meter struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+	graphql.FieldInterceptor
+} = meter{}
+
+func (meter) ExtensionName() string {
+	return "Prometheus"
+}
+
+func (meter) Validate(graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (meter) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	operationType := "unknown"
+	if graphql.HasOperationContext(ctx) {
+		if oc := graphql.GetOperationContext(ctx); oc.Operation != nil {
+			operationType = string(oc.Operation.Operation)
+		}
+	}
+
+	start := time.Now()
+	resp := next(ctx)
+	operationSeconds.WithLabelValues(operationType).Observe(time.Since(start).Seconds())
+
+	if resp != nil {
+		for _, err := range resp.Errors {
+			code, ok := err.Extensions["code"]
+			if !ok {
+				code = "UNKNOWN"
+			}
+			graphqlErrors.WithLabelValues(operationType, fmt.Sprint(code)).Inc()
+		}
+	}
+	return resp
+}
+
+func (meter) InterceptField(ctx context.Context, next graphql.Resolver) (any, error) {
+	fc := graphql.GetFieldContext(ctx)
+	if fc == nil || !fc.IsResolver {
+		return next(ctx)
+	}
+
+	start := time.Now()
+	res, err := next(ctx)
+	resolverSeconds.WithLabelValues(fc.Object, fc.Field.Name).Observe(time.Since(start).Seconds())
+	return res, err
+}
@@ -1,7 +1,14 @@
 package main
 
+import "time"
+
 type Account struct {
-	ID     string  `json:"id"`
-	Name   string  `json:"name"`
-	Orders []Order `json:"orders"`
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Active    bool      `json:"active"`
+	Roles     []Role    `json:"roles"`
+	Orders    []Order   `json:"orders"`
 }
@@ -3,11 +3,52 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"strconv"
 	"time"
 )
 
+type AccountConnection struct {
+	Edges    []*AccountEdge `json:"edges"`
+	PageInfo *PageInfo      `json:"pageInfo"`
+}
+
+type AccountEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Account `json:"node"`
+}
+
 type AccountInput struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type AccountUpdateInput struct {
+	Name  *string `json:"name,omitempty"`
+	Email *string `json:"email,omitempty"`
+}
+
+type AuthPayload struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// An exact amount of money.
+type Money struct {
+	// Decimal amount in the major unit of the currency, such as "49.50".
+	Amount string `json:"amount"`
+	// ISO 4217 currency code, such as USD.
+	Currency string `json:"currency"`
+}
+
+type MoneyInput struct {
+	// Decimal amount in the major unit of the currency, such as "49.50".
+	Amount string `json:"amount"`
+	// ISO 4217 currency code, such as USD.
+	Currency string `json:"currency"`
 }
 
 type Mutation struct {
@@ -16,21 +57,31 @@ type Mutation struct {
 type Order struct {
 	ID         string            `json:"id"`
 	CreatedAt  time.Time         `json:"createdAt"`
-	TotalPrice float64           `json:"totalPrice"`
+	TotalPrice *Money            `json:"totalPrice"`
+	Status     OrderStatus       `json:"status"`
 	Products   []*OrderedProduct `json:"products"`
 }
 
+type OrderConnection struct {
+	Edges    []*OrderEdge `json:"edges"`
+	PageInfo *PageInfo    `json:"pageInfo"`
+}
+
+type OrderEdge struct {
+	Cursor string `json:"cursor"`
+	Node   *Order `json:"node"`
+}
+
 type OrderInput struct {
-	AcountID string                 `json:"acountId"`
 	Products []*OrderedProductInput `json:"products"`
 }
 
 type OrderedProduct struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Quantity    int     `json:"quantity"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       *Money `json:"price"`
+	Quantity    int    `json:"quantity"`
 }
 
 type OrderedProductInput struct {
@@ -38,23 +89,147 @@ type OrderedProductInput struct {
 	Quantity int    `json:"quantity"`
 }
 
+type PageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor,omitempty"`
+	EndCursor       *string `json:"endCursor,omitempty"`
+}
+
 type PaginationInput struct {
 	Skip *int `json:"skip,omitempty"`
 	Take *int `json:"take,omitempty"`
 }
 
 type Product struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       *Money `json:"price"`
+	Stock       int    `json:"stock"`
+	Deleted     bool   `json:"deleted"`
+}
+
+type ProductConnection struct {
+	Edges    []*ProductEdge `json:"edges"`
+	PageInfo *PageInfo      `json:"pageInfo"`
+}
+
+type ProductEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Product `json:"node"`
 }
 
 type ProductInput struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       *MoneyInput `json:"price"`
+	Stock       *int        `json:"stock,omitempty"`
+}
+
+type ProductUpdateInput struct {
+	Name        *string     `json:"name,omitempty"`
+	Description *string     `json:"description,omitempty"`
+	Price       *MoneyInput `json:"price,omitempty"`
+	Stock       *int        `json:"stock,omitempty"`
 }
 
 type Query struct {
 }
+
+// Subscriptions are served over WebSocket, with the graphql-transport-ws or the
+// older graphql-ws protocol. Browsers cannot set headers on WebSocket requests,
+// so the access token may be sent as Authorization in the connection_init
+// payload instead: {"Authorization": "Bearer <accessToken>"}.
+type Subscription struct {
+}
+
+type OrderStatus string
+
+const (
+	OrderStatusPending   OrderStatus = "PENDING"
+	OrderStatusPaid      OrderStatus = "PAID"
+	OrderStatusShipped   OrderStatus = "SHIPPED"
+	OrderStatusDelivered OrderStatus = "DELIVERED"
+	OrderStatusCancelled OrderStatus = "CANCELLED"
+	OrderStatusRefunded  OrderStatus = "REFUNDED"
+)
+
+var AllOrderStatus = []OrderStatus{
+	OrderStatusPending,
+	OrderStatusPaid,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+	OrderStatusCancelled,
+	OrderStatusRefunded,
+}
+
+func (e OrderStatus) IsValid() bool {
+	switch e {
+	case OrderStatusPending, OrderStatusPaid, OrderStatusShipped, OrderStatusDelivered, OrderStatusCancelled, OrderStatusRefunded:
+		return true
+	}
+	return false
+}
+
+func (e OrderStatus) String() string {
+	return string(e)
+}
+
+func (e *OrderStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = OrderStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid OrderStatus", str)
+	}
+	return nil
+}
+
+func (e OrderStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type Role string
+
+const (
+	RoleCustomer Role = "CUSTOMER"
+	RoleAdmin    Role = "ADMIN"
+)
+
+var AllRole = []Role{
+	RoleCustomer,
+	RoleAdmin,
+}
+
+func (e Role) IsValid() bool {
+	switch e {
+	case RoleCustomer, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+func (e Role) String() string {
+	return string(e)
+}
+
+func (e *Role) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Role(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Role", str)
+	}
+	return nil
+}
+
+func (e Role) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
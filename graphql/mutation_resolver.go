@@ -2,61 +2,215 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"github.com/ndquang191/go-graph-grpc/account"
+	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/auth"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
 	"github.com/ndquang191/go-graph-grpc/order"
-	"log"
+	"strings"
 	"time"
 )
 
 var (
-	ErrInvalidParameter = errors.New("invalid parameter")
+	ErrInvalidParameter = errs.New(errs.InvalidArgument, "invalid parameter")
 )
 
 type mutationResolver struct {
 	server *Server
 }
 
-func (r *mutationResolver) CreateAccount(ctx context.Context, input AccountInput) (*Account, error) {
+func (r *mutationResolver) Login(ctx context.Context, email string, password string) (*AuthPayload, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	t, err := r.server.accountClient.Login(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
 
+	return toAuthPayload(t), nil
+}
+
+func (r *mutationResolver) RefreshToken(ctx context.Context, refreshToken string) (*AuthPayload, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	a, err := r.server.accountClient.PostAccount(ctx, input.Name)
+	t, err := r.server.accountClient.RefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return toAuthPayload(t), nil
+}
+
+func (r *mutationResolver) CreateAccount(ctx context.Context, input AccountInput, idempotencyKey *string) (*Account, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	a, err := r.server.accountClient.PostAccount(ctx, input.Name, input.Email, input.Password, stringValue(idempotencyKey))
 
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 
-	return &Account{
-		ID:   a.ID,
-		Name: a.Name,
-	}, nil
+	return toAccount(a), nil
+}
+
+// UpdateAccount changes the fields set in input and leaves the others as
+// they are
+func (r *mutationResolver) UpdateAccount(ctx context.Context, id string, input AccountUpdateInput) (*Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if err := authorizeOwner(ctx, id); err != nil {
+		return nil, err
+	}
+
+	changes := account.Account{ID: id}
+	fields := []string{}
+	if input.Name != nil {
+		changes.Name = *input.Name
+		fields = append(fields, "name")
+	}
+	if input.Email != nil {
+		changes.Email = *input.Email
+		fields = append(fields, "email")
+	}
+
+	a, err := r.server.accountClient.UpdateAccount(ctx, changes, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return toAccount(a), nil
 }
 
-func (r *mutationResolver) CreateProduct(ctx context.Context, input ProductInput) (*Product, error) {
+func (r *mutationResolver) DeactivateAccount(ctx context.Context, id string) (*Account, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	p, err := r.server.catalogClient.PostProduct(ctx, input.Name, input.Description, input.Price)
+	if err := authorizeOwner(ctx, id); err != nil {
+		return nil, err
+	}
 
+	a, err := r.server.accountClient.DeactivateAccount(ctx, id)
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 
-	return &Product{
-		ID:          p.ID,
-		Name:        p.Name,
-		Description: p.Description,
-		Price:       p.Price,
-	}, nil
+	return toAccount(a), nil
 }
 
-func (r *mutationResolver) CreateOrder(ctx context.Context, input OrderInput) (*Order, error) {
+// SetAccountRoles replaces the roles of an account. They take effect for the
+// account once it logs in again or refreshes its token.
+func (r *mutationResolver) SetAccountRoles(ctx context.Context, id string, roles []Role) (*Account, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	changes := account.Account{ID: id}
+	for _, role := range roles {
+		changes.Roles = append(changes.Roles, roleName(role))
+	}
+
+	a, err := r.server.accountClient.UpdateAccount(ctx, changes, []string{"roles"})
+	if err != nil {
+		return nil, err
+	}
+
+	return toAccount(a), nil
+}
+
+func (r *mutationResolver) CreateProduct(ctx context.Context, input ProductInput, idempotencyKey *string) (*Product, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stock := 0
+	if input.Stock != nil {
+		stock = *input.Stock
+	}
+	if stock < 0 {
+		return nil, ErrInvalidParameter
+	}
+
+	price, err := parseMoney(input.Price)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := r.server.catalogClient.PostProduct(ctx, input.Name, input.Description, price, uint32(stock), stringValue(idempotencyKey), caller(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toProduct(p), nil
+}
+
+// UpdateProduct changes the fields set in input and leaves the others as
+// they are
+func (r *mutationResolver) UpdateProduct(ctx context.Context, id string, input ProductUpdateInput) (*Product, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	product := catalog.Product{ID: id}
+	fields := []string{}
+	if input.Name != nil {
+		product.Name = *input.Name
+		fields = append(fields, "name")
+	}
+	if input.Description != nil {
+		product.Description = *input.Description
+		fields = append(fields, "description")
+	}
+	if input.Price != nil {
+		price, err := parseMoney(input.Price)
+		if err != nil {
+			return nil, err
+		}
+		product.Price = price
+		fields = append(fields, "price")
+	}
+	if input.Stock != nil {
+		if *input.Stock < 0 {
+			return nil, ErrInvalidParameter
+		}
+		product.Stock = uint32(*input.Stock)
+		fields = append(fields, "stock")
+	}
+
+	p, err := r.server.catalogClient.UpdateProduct(ctx, product, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return toProduct(p), nil
+}
+
+func (r *mutationResolver) DeleteProduct(ctx context.Context, id string) (*Product, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	p, err := r.server.catalogClient.DeleteProduct(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return toProduct(p), nil
+}
+
+// CreateOrder places an order for the authenticated account
+func (r *mutationResolver) CreateOrder(ctx context.Context, input OrderInput, idempotencyKey *string) (*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	accountID, err := authenticatedAccountID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	var products []order.OrderedProduct
 
 	for _, p := range input.Products {
@@ -70,16 +224,143 @@ func (r *mutationResolver) CreateOrder(ctx context.Context, input OrderInput) (*
 		})
 	}
 
-	o, err := r.server.orderClient.PostOder(ctx, input.AcountID, products)
+	o, err := r.server.orderClient.PostOder(ctx, accountID, products, stringValue(idempotencyKey))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toOrder(o), nil
+}
+
+func (r *mutationResolver) UpdateOrderStatus(ctx context.Context, id string, status OrderStatus, reason *string) (*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if !status.IsValid() {
+		return nil, ErrInvalidParameter
+	}
+
+	o, err := r.server.orderClient.UpdateOrderStatus(ctx, id, order.Status(strings.ToLower(status.String())), caller(ctx), stringValue(reason))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toOrder(o), nil
+}
+
+// CancelOrder cancels an order of the authenticated account. Admins can
+// cancel any order.
+func (r *mutationResolver) CancelOrder(ctx context.Context, id string, reason *string) (*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if _, err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	existing, err := r.server.orderClient.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOwner(ctx, existing.AccountID); err != nil {
+		return nil, err
+	}
+
+	o, err := r.server.orderClient.CancelOrder(ctx, id, caller(ctx), stringValue(reason))
 
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 
+	return toOrder(o), nil
+}
+
+func toOrder(o *order.Order) *Order {
+	var products []*OrderedProduct
+
+	for _, p := range o.Products {
+		products = append(products, &OrderedProduct{
+			ID:          p.ID,
+			Quantity:    int(p.Quantity),
+			Name:        p.Name,
+			Description: p.Description,
+			Price:       toMoney(p.Price),
+		})
+	}
+
 	return &Order{
 		ID:         o.ID,
 		CreatedAt:  o.CreatedAt,
-		TotalPrice: o.TotalPrice,
-	}, nil
+		TotalPrice: toMoney(o.TotalPrice),
+		Status:     orderStatus(o.Status),
+		Products:   products,
+	}
+}
+
+// caller names who makes a change, such as in the status history of an
+// order: the authenticated account, if any
+func caller(ctx context.Context) string {
+	accountID, _ := authenticatedAccountID(ctx)
+	return accountID
+}
+
+func toAuthPayload(t *auth.Tokens) *AuthPayload {
+	return &AuthPayload{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		ExpiresAt:    t.ExpiresAt,
+	}
+}
+
+func toAccount(a *account.Account) *Account {
+	roles := []Role{}
+	for _, r := range a.Roles {
+		roles = append(roles, Role(strings.ToUpper(r)))
+	}
+
+	return &Account{
+		ID:        a.ID,
+		Name:      a.Name,
+		Email:     a.Email,
+		CreatedAt: a.CreatedAt,
+		UpdatedAt: a.UpdatedAt,
+		Active:    a.Active,
+		Roles:     roles,
+	}
+}
+
+func toProduct(p *catalog.Product) *Product {
+	return &Product{
+		ID:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       toMoney(p.Price),
+		Stock:       int(p.Stock),
+		Deleted:     p.Deleted,
+	}
+}
+
+func toMoney(m money.Money) *Money {
+	return &Money{Amount: m.Decimal(), Currency: m.Currency}
+}
+
+func parseMoney(input *MoneyInput) (money.Money, error) {
+	m, err := money.Parse(input.Amount, input.Currency)
+	if err != nil {
+		return money.Money{}, fmt.Errorf("%w: %v", ErrInvalidParameter, err)
+	}
+	return m, nil
+}
+
+func orderStatus(s order.Status) OrderStatus {
+	return OrderStatus(strings.ToUpper(string(s)))
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
 }
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
 	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
 )
 
 type queryResolver struct {
@@ -18,14 +19,10 @@ func (r *queryResolver) Account(ctx context.Context, pagination *PaginationInput
 		r, err := r.server.accountClient.GetAccount(ctx, *id)
 
 		if err != nil {
-			log.Print(err)
 			return nil, err
 		}
 
-		return []*Account{{
-			ID:   r.ID,
-			Name: r.Name,
-		}}, nil
+		return []*Account{toAccount(r)}, nil
 	}
 
 	skip, take := uint64(0), uint64(0)
@@ -36,18 +33,13 @@ func (r *queryResolver) Account(ctx context.Context, pagination *PaginationInput
 	accountList, err := r.server.accountClient.GetAccounts(ctx, skip, take)
 
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
 	var accounts []*Account
 
-	for _, a := range accountList {
-		account := &Account{
-			ID:   a.ID,
-			Name: a.Name,
-		}
-		accounts = append(accounts, account)
+	for i := range accountList {
+		accounts = append(accounts, toAccount(&accountList[i]))
 	}
 
 	return accounts, nil
@@ -62,7 +54,6 @@ func (r *queryResolver) Products(ctx context.Context, pagination *PaginationInpu
 		r, err := r.server.catalogClient.GetProduct(ctx, *id)
 
 		if err != nil {
-			log.Print(err)
 			return nil, err
 		}
 
@@ -70,7 +61,9 @@ func (r *queryResolver) Products(ctx context.Context, pagination *PaginationInpu
 			ID:          r.Id,
 			Name:        r.Name,
 			Description: r.Description,
-			Price:       r.Price,
+			Price:       toMoney(money.New(r.Price.GetAmount(), r.Price.GetCurrency())),
+			Stock:       int(r.Stock),
+			Deleted:     r.Deleted,
 		}}, nil
 	}
 
@@ -86,25 +79,104 @@ func (r *queryResolver) Products(ctx context.Context, pagination *PaginationInpu
 
 	productList, err := r.server.catalogClient.GetProducts(ctx, skip, take, nil, q)
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 
 	var products []*Product
 
-	for _, a := range productList {
-		product := &Product{
-			ID:          a.ID,
-			Name:        a.Name,
-			Description: a.Description,
-			Price:       a.Price,
-		}
-		products = append(products, product)
+	for i := range productList {
+		products = append(products, toProduct(&productList[i]))
 	}
 
 	return products, nil
 }
 
+func (r *queryResolver) Order(ctx context.Context, id string) (*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	o, err := r.server.orderClient.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOwner(ctx, o.AccountID); err != nil {
+		return nil, err
+	}
+
+	return toOrder(o), nil
+}
+
+func (r *queryResolver) AccountsConnection(ctx context.Context, first *int, after *string) (*AccountConnection, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	page, err := r.server.accountClient.GetAccountsPage(ctx, stringValue(after), firstValue(first))
+	if err != nil {
+		return nil, err
+	}
+
+	edges := []*AccountEdge{}
+	for i := range page.Accounts {
+		edges = append(edges, &AccountEdge{
+			Cursor: page.Cursors[i],
+			Node:   toAccount(&page.Accounts[i]),
+		})
+	}
+
+	return &AccountConnection{
+		Edges:    edges,
+		PageInfo: pageInfo(after, page.Cursors, page.HasNextPage),
+	}, nil
+}
+
+func (r *queryResolver) ProductsConnection(ctx context.Context, first *int, after *string, query *string) (*ProductConnection, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	page, err := r.server.catalogClient.GetProductsPage(ctx, stringValue(query), stringValue(after), firstValue(first))
+	if err != nil {
+		return nil, err
+	}
+
+	edges := []*ProductEdge{}
+	for i := range page.Products {
+		edges = append(edges, &ProductEdge{
+			Cursor: page.Cursors[i],
+			Node:   toProduct(&page.Products[i]),
+		})
+	}
+
+	return &ProductConnection{
+		Edges:    edges,
+		PageInfo: pageInfo(after, page.Cursors, page.HasNextPage),
+	}, nil
+}
+
+// defaultPageSize is the page size of connections queried without first
+const defaultPageSize = 20
+
+func firstValue(first *int) uint64 {
+	if first == nil || *first <= 0 {
+		return defaultPageSize
+	}
+	return uint64(*first)
+}
+
+// pageInfo builds the Relay page info of a page fetched after the given
+// cursor. Connections only paginate forward, so a previous page is assumed
+// whenever the page did not start at the beginning.
+func pageInfo(after *string, cursors []string, hasNextPage bool) *PageInfo {
+	info := &PageInfo{
+		HasNextPage:     hasNextPage,
+		HasPreviousPage: stringValue(after) != "",
+	}
+	if len(cursors) != 0 {
+		info.StartCursor = &cursors[0]
+		info.EndCursor = &cursors[len(cursors)-1]
+	}
+	return info
+}
+
 func (p PaginationInput) bounds() (uint64, uint64) {
 	skipV := uint64(0)
 	takeV := uint64(0)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/order"
+)
+
+type subscriptionResolver struct {
+	server *Server
+}
+
+// OrderUpdated follows an order of the authenticated account, or of any
+// account for admins
+func (r *subscriptionResolver) OrderUpdated(ctx context.Context, orderID string) (<-chan *Order, error) {
+	getCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	o, err := r.server.orderClient.GetOrder(getCtx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOwner(ctx, o.AccountID); err != nil {
+		return nil, err
+	}
+
+	return r.forward(ctx, r.server.orderClient.WatchOrder(ctx, orderID)), nil
+}
+
+func (r *subscriptionResolver) OrdersForAccount(ctx context.Context, accountID string) (<-chan *Order, error) {
+	if err := authorizeOwner(ctx, accountID); err != nil {
+		return nil, err
+	}
+
+	return r.forward(ctx, r.server.orderClient.WatchAccountOrders(ctx, accountID)), nil
+}
+
+// forward sends the orders of a watch to the channel the subscription is
+// served from, and closes it once the watch ends
+func (r *subscriptionResolver) forward(ctx context.Context, orders iter.Seq2[*order.Order, error]) <-chan *Order {
+	ch := make(chan *Order)
+	go func() {
+		defer close(ch)
+		for o, err := range orders {
+			if err != nil {
+				logging.Error(ctx, r.server.logger, "Order subscription failed", err)
+				return
+			}
+
+			select {
+			case ch <- toOrder(o):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ndquang191/go-graph-grpc/graphql"
+
+// withTraceContext continues the trace of the caller when the request
+// carries W3C trace context headers
+func withTraceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// tracer is a gqlgen extension starting a span for every operation and for
+// every field with a resolver. The gRPC calls made by a resolver become
+// children of its span.
+type tracer struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+	graphql.FieldInterceptor
+} = tracer{}
+
+func (tracer) ExtensionName() string {
+	return "OpenTelemetry"
+}
+
+func (tracer) Validate(graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (tracer) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	if !graphql.HasOperationContext(ctx) {
+		return next(ctx)
+	}
+
+	oc := graphql.GetOperationContext(ctx)
+	name := "graphql"
+	attrs := []attribute.KeyValue{attribute.String("graphql.request_id", logging.RequestID(ctx))}
+	if oc.Operation != nil {
+		name = "graphql." + string(oc.Operation.Operation)
+		if oc.OperationName != "" {
+			name += " " + oc.OperationName
+		}
+		attrs = append(attrs,
+			attribute.String("graphql.operation.type", string(oc.Operation.Operation)),
+			attribute.String("graphql.operation.name", oc.OperationName),
+		)
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	resp := next(ctx)
+	if resp != nil && len(resp.Errors) != 0 {
+		span.SetStatus(codes.Error, resp.Errors.Error())
+	}
+	return resp
+}
+
+func (tracer) InterceptField(ctx context.Context, next graphql.Resolver) (any, error) {
+	fc := graphql.GetFieldContext(ctx)
+	if fc == nil || !fc.IsResolver {
+		return next(ctx)
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "graphql.resolve "+fc.Object+"."+fc.Field.Name,
+		trace.WithAttributes(
+			attribute.String("graphql.field.path", fc.Path().String()),
+		),
+	)
+	defer span.End()
+
+	res, err := next(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return res, err
+}
@@ -0,0 +1,32 @@
+// Package cursor encodes the opaque cursors handed out by paginated listings.
+// A cursor is the sort key of the last item of a page, so the next page can
+// be fetched by keyset instead of by offset.
+package cursor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+)
+
+var ErrInvalid = errs.New(errs.InvalidArgument, "invalid cursor")
+
+// Encode returns the cursor for a sort key
+func Encode(key any) string {
+	data, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode reads the sort key of a cursor made by Encode into key
+func Decode(c string, key any) error {
+	data, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := json.Unmarshal(data, key); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return nil
+}
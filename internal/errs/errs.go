@@ -0,0 +1,197 @@
+// Package errs defines the kinds of domain errors shared by the services and
+// translates them to gRPC status codes on the server and back on the client.
+package errs
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain and messageKey name the ErrorInfo detail carrying the message
+// of the sentinel error a status was made from
+const (
+	errorDomain = "go-graph-grpc"
+	messageKey  = "sentinel"
+)
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	NotFound
+	InvalidArgument
+	AlreadyExists
+	FailedPrecondition
+	Unavailable
+	Unauthenticated
+	PermissionDenied
+)
+
+var kindCodes = map[Kind]codes.Code{
+	Internal:           codes.Internal,
+	NotFound:           codes.NotFound,
+	InvalidArgument:    codes.InvalidArgument,
+	AlreadyExists:      codes.AlreadyExists,
+	FailedPrecondition: codes.FailedPrecondition,
+	Unavailable:        codes.Unavailable,
+	Unauthenticated:    codes.Unauthenticated,
+	PermissionDenied:   codes.PermissionDenied,
+}
+
+// Code returns the gRPC status code errors of this kind are sent with
+func (k Kind) Code() codes.Code {
+	return kindCodes[k]
+}
+
+// Error is a domain error of a given kind. Packages declare their sentinel
+// errors with New and wrap them with fmt.Errorf("%w: ...") to add details.
+type Error struct {
+	Kind    Kind
+	Message string
+}
+
+func New(kind Kind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is matches errors of the same kind and message, so sentinel errors can
+// still be compared after a round trip through gRPC, which carries them
+// apart from the details wrapped around them.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind && t.Message == e.Message
+}
+
+func (e *Error) GRPCStatus() *status.Status {
+	return newStatus(e, e.Message)
+}
+
+// remoteError is an error received through gRPC, made of a sentinel error
+// wrapped with details, which reads as the error sent
+type remoteError struct {
+	message  string
+	sentinel *Error
+}
+
+func (e *remoteError) Error() string {
+	return e.message
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.sentinel
+}
+
+// newStatus returns a status with message, carrying the sentinel error e
+func newStatus(e *Error, message string) *status.Status {
+	s := status.New(e.Kind.Code(), message)
+	withInfo, err := s.WithDetails(&errdetails.ErrorInfo{
+		Domain:   errorDomain,
+		Metadata: map[string]string{messageKey: e.Message},
+	})
+	if err != nil {
+		return s
+	}
+	return withInfo
+}
+
+// KindOf returns the kind of the first Error in err's chain, or Internal
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Internal
+}
+
+// ToStatus converts an error returned by a handler to a gRPC status error
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return newStatus(e, err.Error()).Err()
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// FromStatus converts a gRPC status error received by a client back to an
+// Error, wrapped with the details of the message if the status names the
+// sentinel error it was made from. Codes without a matching kind are
+// returned unchanged.
+func FromStatus(err error) error {
+	s, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+
+	for kind, code := range kindCodes {
+		if code != s.Code() {
+			continue
+		}
+		for _, d := range s.Details() {
+			if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain {
+				if message, ok := info.Metadata[messageKey]; ok && message != s.Message() {
+					return &remoteError{message: s.Message(), sentinel: New(kind, message)}
+				}
+			}
+		}
+		return New(kind, s.Message())
+	}
+	return err
+}
+
+func UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	return resp, ToStatus(err)
+}
+
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return FromStatus(invoker(ctx, method, req, reply, cc, opts...))
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming calls
+func StreamServerInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return ToStatus(handler(srv, ss))
+}
+
+// StreamClientInterceptor is UnaryClientInterceptor for streaming calls. The
+// error ending the stream is translated too; io.EOF is left as it is.
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, FromStatus(err)
+	}
+	return &clientStream{ClientStream: stream}, nil
+}
+
+type clientStream struct {
+	grpc.ClientStream
+}
+
+func (s *clientStream) RecvMsg(m any) error {
+	return FromStatus(s.ClientStream.RecvMsg(m))
+}
+
+func (s *clientStream) SendMsg(m any) error {
+	return FromStatus(s.ClientStream.SendMsg(m))
+}
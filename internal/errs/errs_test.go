@@ -0,0 +1,80 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errMissing = New(NotFound, "product not found")
+
+func TestToStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{errMissing, codes.NotFound},
+		{fmt.Errorf("%w: id 42", New(InvalidArgument, "invalid id")), codes.InvalidArgument},
+		{fmt.Errorf("get product: %w", New(Unavailable, "catalog unavailable")), codes.Unavailable},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{context.Canceled, codes.Canceled},
+		{status.Error(codes.ResourceExhausted, "slow down"), codes.ResourceExhausted},
+		{errors.New("connection reset"), codes.Internal},
+	}
+	for _, tt := range tests {
+		if got := status.Code(ToStatus(tt.err)); got != tt.want {
+			t.Errorf("code of ToStatus(%q) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+	if err := ToStatus(nil); err != nil {
+		t.Errorf("ToStatus(nil) = %v, want nil", err)
+	}
+}
+
+func TestFromStatus(t *testing.T) {
+	// sentinel errors are still found by errors.Is on the client
+	err := FromStatus(ToStatus(errMissing))
+	if !errors.Is(err, errMissing) {
+		t.Errorf("FromStatus of %q = %v, want %v", errMissing, err, errMissing)
+	}
+
+	// wrapped errors keep their kind and message, and still match the
+	// sentinel they wrap
+	errInvalid := New(InvalidArgument, "invalid id")
+	wrapped := fmt.Errorf("get product: %w: id 42", errInvalid)
+	err = FromStatus(ToStatus(wrapped))
+	if KindOf(err) != InvalidArgument || err.Error() != wrapped.Error() || !errors.Is(err, errInvalid) {
+		t.Errorf("FromStatus of %q = %v of kind %d, want kind %d wrapping %v", wrapped, err, KindOf(err), InvalidArgument, errInvalid)
+	}
+	if errors.Is(err, errMissing) {
+		t.Errorf("FromStatus of %q matches %v", wrapped, errMissing)
+	}
+
+	// statuses of servers not naming the sentinel keep kind and message
+	bare := status.Error(codes.NotFound, errMissing.Error())
+	if err := FromStatus(bare); !errors.Is(err, errMissing) {
+		t.Errorf("FromStatus(%v) = %v, want %v", bare, err, errMissing)
+	}
+
+	// codes without a kind are left as they are
+	exhausted := status.Error(codes.ResourceExhausted, "slow down")
+	if err := FromStatus(exhausted); err != exhausted {
+		t.Errorf("FromStatus(%v) = %v, want it unchanged", exhausted, err)
+	}
+	if err := FromStatus(nil); err != nil {
+		t.Errorf("FromStatus(nil) = %v, want nil", err)
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	if got := KindOf(fmt.Errorf("get: %w", errMissing)); got != NotFound {
+		t.Errorf("KindOf a wrapped NotFound error = %d, want %d", got, NotFound)
+	}
+	if got := KindOf(errors.New("boom")); got != Internal {
+		t.Errorf("KindOf a plain error = %d, want %d", got, Internal)
+	}
+}
@@ -0,0 +1,141 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Handler handles an event delivered by a Broker. Returning an error gets
+// the event delivered again later.
+type Handler func(ctx context.Context, event Event) error
+
+// Publisher publishes events to their subscribers
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Broker routes events to the handlers subscribed to their type. Subjects
+// are dot separated tokens, as in NATS: a "*" token matches any one token and
+// a final ">" matches one or more, so "order.*" and ">" match "order.placed".
+type Broker interface {
+	Publisher
+	// Subscribe delivers the events matching subject to handle until the
+	// returned function is called
+	Subscribe(subject string, handle Handler) (unsubscribe func())
+}
+
+// DedupeWindow is how many event IDs a subscription of a MemoryBroker
+// remembers to drop redeliveries
+const DedupeWindow = 1024
+
+// MemoryBroker is a Broker delivering events to handlers in the same process
+type MemoryBroker struct {
+	mu   sync.RWMutex
+	subs []*subscription
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+type subscription struct {
+	subject []string
+	handle  Handler
+
+	// mu serializes deliveries, so handlers need not be safe for concurrent use
+	mu   sync.Mutex
+	seen map[string]bool
+	ids  []string // ring of the IDs in seen
+	next int
+}
+
+func (b *MemoryBroker) Subscribe(subject string, handle Handler) func() {
+	s := &subscription{
+		subject: strings.Split(subject, "."),
+		handle:  handle,
+		seen:    map[string]bool{},
+		ids:     make([]string, DedupeWindow),
+	}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.subs = slices.DeleteFunc(b.subs, func(sub *subscription) bool { return sub == s })
+	}
+}
+
+// Publish hands event to the matching handlers in turn and joins their
+// errors. Handlers run in the goroutine of the caller, so they should be
+// quick. A subscription that handled an event with the same ID before skips
+// it, so publishing a failed event again only reaches the handlers that
+// failed.
+func (b *MemoryBroker) Publish(ctx context.Context, event Event) error {
+	subject := strings.Split(event.Type, ".")
+
+	b.mu.RLock()
+	var subs []*subscription
+	for _, s := range b.subs {
+		if matches(s.subject, subject) {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, s := range subs {
+		if err := s.deliver(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("events: handle %s %s: %w", event.Type, event.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *subscription) deliver(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen[event.ID] {
+		return nil
+	}
+	if err := s.handle(ctx, event); err != nil {
+		return err
+	}
+
+	delete(s.seen, s.ids[s.next])
+	s.ids[s.next] = event.ID
+	s.seen[event.ID] = true
+	s.next = (s.next + 1) % len(s.ids)
+	return nil
+}
+
+// matches reports whether the tokens of subject match those of pattern
+func matches(pattern, subject []string) bool {
+	for i, token := range pattern {
+		switch {
+		case token == ">" && i == len(pattern)-1:
+			return len(subject) > i
+		case i >= len(subject):
+			return false
+		case token != "*" && token != subject[i]:
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+// LogHandler returns a Handler logging the events at debug level
+func LogHandler(logger *slog.Logger) Handler {
+	return func(ctx context.Context, event Event) error {
+		logger.DebugContext(ctx, "Event published", "type", event.Type, "id", event.ID, "aggregate_id", event.AggregateID)
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"order.placed", "order.placed", true},
+		{"order.placed", "order.cancelled", false},
+		{"order.*", "order.placed", true},
+		{"*.placed", "order.placed", true},
+		{"order.*", "order", false},
+		{"order.*", "order.placed.late", false},
+		{"order.>", "order.placed.late", true},
+		{"order.>", "order", false},
+		{">", "account.created", true},
+		{"order", "order.placed", false},
+	}
+	for _, test := range tests {
+		if got := matches(strings.Split(test.pattern, "."), strings.Split(test.subject, ".")); got != test.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", test.pattern, test.subject, got, test.want)
+		}
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+
+	var orders, all []string
+	unavailable := errors.New("unavailable")
+	fail := unavailable
+	b.Subscribe("order.*", func(ctx context.Context, e Event) error {
+		if fail != nil {
+			return fail
+		}
+		orders = append(orders, e.ID)
+		return nil
+	})
+	unsubscribe := b.Subscribe(">", func(ctx context.Context, e Event) error {
+		all = append(all, e.ID)
+		return nil
+	})
+
+	event, err := New(TypeOrderPlaced, "order", OrderPlaced{OrderID: "order"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish(ctx, event); !errors.Is(err, unavailable) {
+		t.Errorf("Publish error = %v, want %v", err, unavailable)
+	}
+	fail = nil
+	if err := b.Publish(ctx, event); err != nil {
+		t.Errorf("Publish again error = %v", err)
+	}
+	if len(orders) != 1 || len(all) != 1 {
+		t.Errorf("handled %d and %d times, want each once", len(orders), len(all))
+	}
+
+	unsubscribe()
+	other, _ := New(TypeAccountCreated, "account", AccountCreated{AccountID: "account"})
+	if err := b.Publish(ctx, other); err != nil || len(all) != 1 {
+		t.Errorf("Publish after unsubscribing = %v, handled %d events, want 1", err, len(all))
+	}
+}
@@ -0,0 +1,95 @@
+// Package events defines the domain events the services publish, and the
+// Broker they are published to. Events are written to an outbox with the
+// change they record and relayed to the broker afterwards (see
+// internal/outbox), so delivery is at least once: subscribers may see an
+// event again, under the same ID.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/segmentio/ksuid"
+)
+
+// The types of the events, used as their subjects
+const (
+	TypeOrderPlaced         = "order.placed"
+	TypeOrderStatusChanged  = "order.status_changed"
+	TypeAccountCreated      = "account.created"
+	TypeProductPriceChanged = "product.price_changed"
+)
+
+// Event is a change to an aggregate, such as an order, with its data as JSON
+type Event struct {
+	// ID identifies the event, so that subscribers can drop redeliveries
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	AggregateID string          `json:"aggregate_id"`
+	Data        json.RawMessage `json:"data"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+}
+
+// New returns an event with a new ID and data encoded from data, one of the
+// types below
+func New(eventType, aggregateID string, data any) (Event, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, fmt.Errorf("events: encode %s: %w", eventType, err)
+	}
+	return Event{
+		ID:          ksuid.New().String(),
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Data:        b,
+		OccurredAt:  time.Now().UTC(),
+	}, nil
+}
+
+// Decode decodes the data of e into v, the type matching e.Type
+func (e Event) Decode(v any) error {
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return fmt.Errorf("events: decode %s %s: %w", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+// OrderPlaced is the data of TypeOrderPlaced
+type OrderPlaced struct {
+	OrderID    string           `json:"order_id"`
+	AccountID  string           `json:"account_id"`
+	TotalPrice money.Money      `json:"total_price"`
+	Products   []OrderedProduct `json:"products"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+type OrderedProduct struct {
+	ProductID string      `json:"product_id"`
+	Quantity  uint32      `json:"quantity"`
+	Price     money.Money `json:"price"`
+}
+
+// OrderStatusChanged is the data of TypeOrderStatusChanged
+type OrderStatusChanged struct {
+	OrderID    string    `json:"order_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// AccountCreated is the data of TypeAccountCreated
+type AccountCreated struct {
+	AccountID string    `json:"account_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ProductPriceChanged is the data of TypeProductPriceChanged
+type ProductPriceChanged struct {
+	ProductID string      `json:"product_id"`
+	Price     money.Money `json:"price"`
+}
@@ -0,0 +1,169 @@
+// Package idempotency makes retried requests safe: a request sent with an
+// idempotency key runs once, and replays of it within the retention window
+// get the response of the first run instead of running again.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultRetention is how long keys are remembered unless configured
+const DefaultRetention = 24 * time.Hour
+
+// Lease is how long a key stays in progress. A request still running by then
+// is cancelled, and a replay of it takes the key over, so that the key of a
+// server that died mid-request is not stuck until it expires.
+const Lease = time.Minute
+
+// MaxKeyLength bounds the length of keys, such as UUIDs chosen by clients
+const MaxKeyLength = 255
+
+// KeyField is the name of the request field carrying the key. It is left out
+// of the request fingerprint.
+const KeyField = "idempotencyKey"
+
+var (
+	ErrInvalidKey = errs.New(errs.InvalidArgument, "idempotency key too long")
+	ErrKeyReused  = errs.New(errs.AlreadyExists, "idempotency key already used for a different request")
+	ErrInProgress = errs.New(errs.AlreadyExists, "a request with this idempotency key is in progress")
+)
+
+// Record is what a store keeps of a request made with a key. Key is the
+// stored form of the key, which includes its scope.
+type Record struct {
+	Key         string
+	Fingerprint string
+	// Response is nil while the request is in progress
+	Response  []byte
+	CreatedAt time.Time
+}
+
+// Store persists the records of the keys, next to the data of the service
+type Store interface {
+	// ReserveKey records key as in progress for the request with the given
+	// fingerprint and returns nil, unless a record of key created after
+	// notBefore exists, which it returns instead. Older records are expired
+	// and may be purged. A record still in progress that was created before
+	// leaseBefore is taken over, as if it had expired.
+	ReserveKey(ctx context.Context, key, fingerprint string, notBefore, leaseBefore time.Time) (*Record, error)
+	// CompleteKey stores the response of the request made with key
+	CompleteKey(ctx context.Context, key string, response []byte) error
+	// ReleaseKey forgets key, so that a request that failed can be retried
+	ReleaseKey(ctx context.Context, key string) error
+}
+
+// Keys runs requests with idempotency keys against a store
+type Keys struct {
+	store     Store
+	retention time.Duration
+	lease     time.Duration
+}
+
+func New(store Store, retention time.Duration) *Keys {
+	return &Keys{store: store, retention: retention, lease: Lease}
+}
+
+// Do runs handle for req, made with key, and stores its response. A replay of
+// req with the same key gets the stored response, while a different request
+// with that key gets ErrKeyReused. An empty key runs handle unconditionally.
+//
+// Keys are scoped, so that callers choosing the same key do not see each
+// other's requests: scope names the caller, such as the account making the
+// request.
+//
+// Once the key is reserved, handle runs to completion even if the caller gives
+// up, so that its retry finds the result rather than a half done request, but
+// no longer than the lease of the key. Failed requests release the key.
+func Do[Resp proto.Message](ctx context.Context, k *Keys, scope, key string, req proto.Message, handle func(context.Context) (Resp, error)) (Resp, error) {
+	var zero Resp
+	if key == "" {
+		return handle(ctx)
+	}
+	if len(key) > MaxKeyLength {
+		return zero, ErrInvalidKey
+	}
+
+	fingerprint, err := fingerprint(req)
+	if err != nil {
+		return zero, err
+	}
+
+	key = scopedKey(scope, key)
+	now := time.Now()
+	record, err := k.store.ReserveKey(ctx, key, fingerprint, now.Add(-k.retention), now.Add(-k.lease))
+	if err != nil {
+		return zero, err
+	}
+	if record != nil {
+		if record.Fingerprint != fingerprint {
+			return zero, ErrKeyReused
+		}
+		if record.Response == nil {
+			return zero, ErrInProgress
+		}
+		resp := zero.ProtoReflect().New().Interface().(Resp)
+		if err := proto.Unmarshal(record.Response, resp); err != nil {
+			return zero, fmt.Errorf("idempotency: decode stored response: %w", err)
+		}
+		return resp, nil
+	}
+
+	// the key is taken over once its lease ends, so handle must be done by then
+	ctx = context.WithoutCancel(ctx)
+	handleCtx, cancel := context.WithTimeout(ctx, k.lease)
+	defer cancel()
+	resp, err := handle(handleCtx)
+	if err != nil {
+		if releaseErr := k.store.ReleaseKey(ctx, key); releaseErr != nil {
+			slog.ErrorContext(ctx, "Failed to release idempotency key", "key", key, "error", releaseErr)
+		}
+		return zero, err
+	}
+
+	response, err := proto.Marshal(resp)
+	if err == nil {
+		err = k.store.CompleteKey(ctx, key, response)
+	}
+	if err != nil {
+		// the request succeeded, so its response is returned anyway; replays
+		// get ErrInProgress until the key expires
+		slog.ErrorContext(ctx, "Failed to store idempotent response", "key", key, "error", err)
+	}
+	return resp, nil
+}
+
+// scopedKey is the form under which key is stored: a hash of it and its
+// scope, which fits MaxKeyLength whatever the length of the scope
+func scopedKey(scope, key string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s", len(scope), scope)
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fingerprint hashes the request type and fields, except for the key
+func fingerprint(req proto.Message) (string, error) {
+	req = proto.Clone(req)
+	m := req.ProtoReflect()
+	if fd := m.Descriptor().Fields().ByName(KeyField); fd != nil {
+		m.Clear(fd)
+	}
+
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("idempotency: fingerprint request: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(m.Descriptor().FullName()))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
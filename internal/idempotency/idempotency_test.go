@@ -0,0 +1,142 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// counter answers each request with the number of times it ran
+type counter struct {
+	runs int
+	err  error
+}
+
+func (c *counter) handle(context.Context) (*wrapperspb.Int64Value, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.runs++
+	return wrapperspb.Int64(int64(c.runs)), nil
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	keys := New(NewMemoryStore(), time.Hour)
+	c := &counter{}
+
+	run := func(key, req string) (int64, error) {
+		resp, err := Do(ctx, keys, "account", key, wrapperspb.String(req), c.handle)
+		return resp.GetValue(), err
+	}
+
+	if got, err := run("a", "order"); got != 1 || err != nil {
+		t.Fatalf("first run = %d, %v, want 1", got, err)
+	}
+	if got, err := run("a", "order"); got != 1 || err != nil {
+		t.Errorf("replay = %d, %v, want the stored 1", got, err)
+	}
+	if _, err := run("a", "other order"); !errors.Is(err, ErrKeyReused) {
+		t.Errorf("mismatched replay error = %v, want %v", err, ErrKeyReused)
+	}
+	if got, err := run("b", "order"); got != 2 || err != nil {
+		t.Errorf("new key = %d, %v, want 2", got, err)
+	}
+	if got, err := run("", "order"); got != 3 || err != nil {
+		t.Errorf("no key = %d, %v, want 3", got, err)
+	}
+
+	// failures are not stored, so the request can be retried
+	c.err = errors.New("unavailable")
+	if _, err := run("c", "order"); !errors.Is(err, c.err) {
+		t.Errorf("failed run error = %v, want %v", err, c.err)
+	}
+	c.err = nil
+	if got, err := run("c", "order"); got != 4 || err != nil {
+		t.Errorf("retry after failure = %d, %v, want 4", got, err)
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	ctx := context.Background()
+	keys := New(NewMemoryStore(), time.Hour)
+
+	started, done := make(chan struct{}), make(chan struct{})
+	go Do(ctx, keys, "account", "a", wrapperspb.String("order"), func(context.Context) (*wrapperspb.Int64Value, error) {
+		close(started)
+		<-done
+		return wrapperspb.Int64(1), nil
+	})
+	<-started
+	defer close(done)
+
+	_, err := Do(ctx, keys, "account", "a", wrapperspb.String("order"), (&counter{}).handle)
+	if !errors.Is(err, ErrInProgress) {
+		t.Errorf("concurrent replay error = %v, want %v", err, ErrInProgress)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	keys := New(NewMemoryStore(), 0)
+	c := &counter{}
+
+	for want := int64(1); want <= 2; want++ {
+		resp, err := Do(ctx, keys, "account", "a", wrapperspb.String("order"), c.handle)
+		if resp.GetValue() != want || err != nil {
+			t.Errorf("run after the key expired = %d, %v, want %d", resp.GetValue(), err, want)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	ctx := context.Background()
+	keys := New(NewMemoryStore(), time.Hour)
+	c := &counter{}
+
+	for want, scope := range []string{"account", "other account"} {
+		resp, err := Do(ctx, keys, scope, "a", wrapperspb.String("order"), c.handle)
+		if resp.GetValue() != int64(want+1) || err != nil {
+			t.Errorf("run of %s = %d, %v, want %d", scope, resp.GetValue(), err, want+1)
+		}
+	}
+
+	// the scope and the key are told apart wherever they are split
+	resp, err := Do(ctx, keys, "accoun", "ta", wrapperspb.String("order"), c.handle)
+	if resp.GetValue() != 3 || err != nil {
+		t.Errorf("run with a shifted scope = %d, %v, want 3", resp.GetValue(), err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	keys := New(NewMemoryStore(), time.Hour)
+	keys.lease = 10 * time.Millisecond
+
+	// a request outliving its lease is cancelled, as a replay may take its
+	// key over
+	_, err := Do(ctx, keys, "account", "a", wrapperspb.String("order"), func(ctx context.Context) (*wrapperspb.Int64Value, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("run past the lease error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the key of a server that died mid-request is left in progress
+	if _, err := keys.store.ReserveKey(ctx, scopedKey("account", "b"), "stale", time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	c := &counter{}
+	if _, err := Do(ctx, keys, "account", "b", wrapperspb.String("order"), c.handle); !errors.Is(err, ErrKeyReused) {
+		t.Errorf("run within the lease error = %v, want %v", err, ErrKeyReused)
+	}
+	time.Sleep(keys.lease)
+	resp, err := Do(ctx, keys, "account", "b", wrapperspb.String("order"), c.handle)
+	if resp.GetValue() != 1 || err != nil {
+		t.Errorf("run after the lease = %d, %v, want 1", resp.GetValue(), err)
+	}
+}
@@ -0,0 +1,53 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store in process memory, for the memory repositories
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}}
+}
+
+func (s *MemoryStore) ReserveKey(ctx context.Context, key, fingerprint string, notBefore, leaseBefore time.Time) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, r := range s.records {
+		if r.CreatedAt.Before(notBefore) {
+			delete(s.records, k)
+		}
+	}
+
+	if r, ok := s.records[key]; ok && (r.Response != nil || !r.CreatedAt.Before(leaseBefore)) {
+		return &r, nil
+	}
+	s.records[key] = Record{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now()}
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteKey(ctx context.Context, key string, response []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		r.Response = response
+		s.records[key] = r
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,81 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PostgresStore is a Store in the idempotency_keys table of a service
+// database:
+//
+//	CREATE TABLE IF NOT EXISTS idempotency_keys (
+//	   key VARCHAR(255) PRIMARY KEY,
+//	   fingerprint CHAR(64) NOT NULL,
+//	   response BYTEA,
+//	   created_at TIMESTAMP WITH TIME ZONE NOT NULL
+//	);
+//	CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// ReserveKey purges the expired keys, then inserts key unless it exists. A
+// record whose lease ended is overwritten by the same statement, so only one
+// of the requests taking it over wins.
+func (s *PostgresStore) ReserveKey(ctx context.Context, key, fingerprint string, notBefore, leaseBefore time.Time) (*Record, error) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, notBefore); err != nil {
+		return nil, fmt.Errorf("idempotency: purge keys: %w", err)
+	}
+
+	// the existing record may be released, or its lease may end, between the
+	// insert and the select, in which case the insert is tried again
+	for {
+		res, err := s.db.ExecContext(ctx,
+			`INSERT INTO idempotency_keys (key, fingerprint, created_at) VALUES ($1, $2, $3)
+			ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, created_at = EXCLUDED.created_at
+			WHERE idempotency_keys.response IS NULL AND idempotency_keys.created_at < $4`,
+			key, fingerprint, time.Now().UTC(), leaseBefore,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: reserve key: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("idempotency: reserve key: %w", err)
+		} else if n == 1 {
+			return nil, nil
+		}
+
+		r := Record{Key: key}
+		err = s.db.QueryRowContext(ctx,
+			`SELECT fingerprint, response, created_at FROM idempotency_keys WHERE key = $1`, key,
+		).Scan(&r.Fingerprint, &r.Response, &r.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && r.Response == nil && r.CreatedAt.Before(leaseBefore)) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: get key: %w", err)
+		}
+		return &r, nil
+	}
+}
+
+func (s *PostgresStore) CompleteKey(ctx context.Context, key string, response []byte) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET response = $2 WHERE key = $1`, key, response); err != nil {
+		return fmt.Errorf("idempotency: complete key: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) ReleaseKey(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("idempotency: release key: %w", err)
+	}
+	return nil
+}
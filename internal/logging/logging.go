@@ -0,0 +1,189 @@
+// Package logging builds the structured loggers of the services and carries
+// the request ID from the gateway through every gRPC hop, so that each log
+// line of a request can be found by its ID.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/segmentio/ksuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDKey is the gRPC metadata key, and lower-cased HTTP header, the
+// request ID travels in
+const RequestIDKey = "x-request-id"
+
+// Config selects the level and format of the logs. The services read it with
+// envconfig under the LOG prefix: LOG_LEVEL and LOG_FORMAT.
+type Config struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string `envconfig:"LEVEL" default:"info"`
+	// Format is "text" or "json"
+	Format string `envconfig:"FORMAT" default:"text"`
+}
+
+// New returns a logger writing to w as configured, tagging every line with
+// the service name and the request ID of the context it is given
+func New(w io.Writer, config Config, service string) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, fmt.Errorf("logging: %w", err)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", config.Format)
+	}
+
+	return slog.New(contextHandler{handler}).With("service", service), nil
+}
+
+// Fatal logs msg at error level and exits, for the failures a process
+// cannot start without
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Error logs a failed operation at a level that depends on whose fault it
+// is: error for failures of the service or its dependencies, info for
+// requests the caller got wrong
+func Error(ctx context.Context, logger *slog.Logger, msg string, err error, args ...any) {
+	logger.Log(ctx, levelOf(status.Code(errs.ToStatus(err))), msg, append(args, "error", err)...)
+}
+
+func levelOf(code codes.Code) slog.Level {
+	switch code {
+	case codes.OK:
+		return slog.LevelDebug
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss, codes.DeadlineExceeded, codes.Unimplemented:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// contextHandler adds the request ID of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID generates a request ID
+func NewRequestID() string {
+	return ksuid.New().String()
+}
+
+// incomingRequestID returns the request ID sent by the caller, or a new one
+// for calls that did not come through the gateway
+func incomingRequestID(ctx context.Context) context.Context {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDKey); len(ids) != 0 && ids[0] != "" {
+			return WithRequestID(ctx, ids[0])
+		}
+	}
+	return WithRequestID(ctx, NewRequestID())
+}
+
+// outgoingRequestID forwards the request ID of ctx to the called service
+func outgoingRequestID(ctx context.Context) context.Context {
+	if id := RequestID(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, RequestIDKey, id)
+	}
+	return ctx
+}
+
+// UnaryServerInterceptor takes the request ID from the call metadata and
+// logs every call once it completed
+func UnaryServerInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx = incomingRequestID(ctx)
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logCall(ctx, logger, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming calls
+func StreamServerInterceptor(logger *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := incomingRequestID(ss.Context())
+		start := time.Now()
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		logCall(ctx, logger, info.FullMethod, start, err)
+		return err
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func logCall(ctx context.Context, logger *slog.Logger, method string, start time.Time, err error) {
+	code := status.Code(errs.ToStatus(err))
+	args := []any{"method", method, "code", code.String(), "duration", time.Since(start)}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	logger.Log(ctx, levelOf(code), "gRPC call", args...)
+}
+
+// UnaryClientInterceptor forwards the request ID of the context to the
+// called service
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingRequestID(ctx), method, req, reply, cc, opts...)
+}
+
+// StreamClientInterceptor is UnaryClientInterceptor for streaming calls
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingRequestID(ctx), desc, cc, method, opts...)
+}
@@ -0,0 +1,111 @@
+// Package metrics exposes Prometheus metrics of the services on the default
+// registry: gRPC calls per method, database pool stats and the latency of
+// outgoing HTTP requests such as those to Elasticsearch. Handler serves them
+// for scraping, together with the Go runtime and process metrics.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	grpcHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "gRPC calls completed by the server, by method and status code.",
+	}, []string{"grpc_service", "grpc_method", "grpc_code"})
+
+	grpcHandlingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Time the server took to handle gRPC calls, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_service", "grpc_method"})
+
+	httpClientSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_client_request_duration_seconds",
+		Help:    "Latency of outgoing HTTP requests, by client, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"client", "method", "code"})
+)
+
+// UnaryServerInterceptor counts and times unary calls
+func UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+// StreamServerInterceptor counts and times streaming calls, from the start
+// of the stream to its end
+func StreamServerInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observe(info.FullMethod, start, err)
+	return err
+}
+
+func observe(fullMethod string, start time.Time, err error) {
+	service, method := splitMethod(fullMethod)
+	grpcHandled.WithLabelValues(service, method, status.Code(err).String()).Inc()
+	grpcHandlingSeconds.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+}
+
+// splitMethod splits "/package.Service/Method" into its service and method
+func splitMethod(fullMethod string) (string, string) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return "unknown", fullMethod
+	}
+	return service, method
+}
+
+// RegisterDB exports the connection pool stats of db, labelled with name
+func RegisterDB(db *sql.DB, name string) {
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, name))
+	if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		slog.Warn("Failed to register database metrics", "database", name, "error", err)
+	}
+}
+
+// InstrumentRoundTripper times the requests sent through next under the
+// given client name. A nil next uses http.DefaultTransport.
+func InstrumentRoundTripper(client string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return promhttp.InstrumentRoundTripperDuration(
+		httpClientSeconds.MustCurryWith(prometheus.Labels{"client": client}),
+		next,
+	)
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// NewAdminServer returns an HTTP server for the admin port, serving the
+// metrics at /metrics
+func NewAdminServer(port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
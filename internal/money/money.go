@@ -0,0 +1,159 @@
+// Package money represents amounts of money exactly, as an integer number of
+// the minor unit of an ISO 4217 currency, such as cents for USD.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of prices stored before currencies were
+// recorded
+const DefaultCurrency = "USD"
+
+var (
+	ErrCurrencyMismatch = errors.New("money: currencies differ")
+	ErrInvalidCurrency  = errors.New("money: invalid currency")
+	ErrInvalidAmount    = errors.New("money: invalid amount")
+	ErrOverflow         = errors.New("money: amount out of range")
+)
+
+// Money is an amount in the minor unit of its currency
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// exponents lists the currencies whose minor unit is not a hundredth
+var exponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// Exponent returns the number of decimal digits of the minor unit of
+// currency: 2 for USD, 0 for JPY
+func Exponent(currency string) int {
+	if e, ok := exponents[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+// ValidCurrency reports whether currency looks like an ISO 4217 code: three
+// upper case letters
+func ValidCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse reads a decimal amount in the major unit of currency, such as
+// "49.50" for USD. Amounts more precise than the minor unit are rejected
+// rather than rounded.
+func Parse(amount, currency string) (Money, error) {
+	if !ValidCurrency(currency) {
+		return Money{}, fmt.Errorf("%w %q", ErrInvalidCurrency, currency)
+	}
+
+	sign := ""
+	if strings.HasPrefix(amount, "-") {
+		sign = "-"
+	}
+	whole, fraction, _ := strings.Cut(strings.TrimPrefix(amount, sign), ".")
+
+	exponent := Exponent(currency)
+	fraction = strings.TrimRight(fraction, "0")
+	if whole == "" || len(fraction) > exponent || strings.ContainsAny(whole+fraction, "+-") {
+		return Money{}, fmt.Errorf("%w %q for %s", ErrInvalidAmount, amount, currency)
+	}
+
+	units, err := strconv.ParseInt(sign+whole+fraction+strings.Repeat("0", exponent-len(fraction)), 10, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return Money{}, fmt.Errorf("%w: %q", ErrOverflow, amount)
+		}
+		return Money{}, fmt.Errorf("%w %q for %s", ErrInvalidAmount, amount, currency)
+	}
+	return Money{Amount: units, Currency: currency}, nil
+}
+
+// Decimal formats m in the major unit of its currency, such as "49.50"
+func (m Money) Decimal() string {
+	exponent := Exponent(m.Currency)
+	digits := strconv.FormatUint(absolute(m.Amount), 10)
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+
+	s := digits
+	if exponent > 0 {
+		s = digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+	}
+	if m.Amount < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Add returns m + o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	sum := m.Amount + o.Amount
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return Money{}, ErrOverflow
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Mul returns m times n
+func (m Money) Mul(n int64) (Money, error) {
+	if n != 0 && (m.Amount*n/n != m.Amount || (m.Amount == math.MinInt64 && n == -1)) {
+		return Money{}, ErrOverflow
+	}
+	return Money{Amount: m.Amount * n, Currency: m.Currency}, nil
+}
+
+// Float returns m in the major unit of its currency, for metrics and other
+// places where an approximation will do
+func (m Money) Float() float64 {
+	return float64(m.Amount) / math.Pow10(Exponent(m.Currency))
+}
+
+// FromFloat rounds f, in the major unit of currency, to the nearest minor
+// unit, for the float prices of old clients and documents
+func FromFloat(f float64, currency string) Money {
+	return New(int64(math.Round(f*math.Pow10(Exponent(currency)))), currency)
+}
+
+func absolute(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
@@ -0,0 +1,88 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             Money
+		err              error
+	}{
+		{"49.5", "USD", New(4950, "USD"), nil},
+		{"49.50", "USD", New(4950, "USD"), nil},
+		{"0.1", "USD", New(10, "USD"), nil},
+		{"-3", "EUR", New(-300, "EUR"), nil},
+		{"1200", "JPY", New(1200, "JPY"), nil},
+		{"1.234", "KWD", New(1234, "KWD"), nil},
+		{"0.005", "USD", Money{}, ErrInvalidAmount},
+		{"1.5", "JPY", Money{}, ErrInvalidAmount},
+		{"", "USD", Money{}, ErrInvalidAmount},
+		{".5", "USD", Money{}, ErrInvalidAmount},
+		{"1e3", "USD", Money{}, ErrInvalidAmount},
+		{"--1", "USD", Money{}, ErrInvalidAmount},
+		{"1", "usd", Money{}, ErrInvalidCurrency},
+		{"99999999999999999999", "USD", Money{}, ErrOverflow},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.amount, tt.currency)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Parse(%q, %q) = %v, %v, want %v, %v", tt.amount, tt.currency, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{New(4950, "USD"), "49.50"},
+		{New(5, "USD"), "0.05"},
+		{New(-5, "USD"), "-0.05"},
+		{New(0, "USD"), "0.00"},
+		{New(1200, "JPY"), "1200"},
+		{New(1, "KWD"), "0.001"},
+		{New(math.MinInt64, "JPY"), "-9223372036854775808"},
+	}
+	for _, tt := range tests {
+		if got := tt.money.Decimal(); got != tt.want {
+			t.Errorf("%#v.Decimal() = %q, want %q", tt.money, got, tt.want)
+		}
+		if back, err := Parse(tt.want, tt.money.Currency); err != nil || back != tt.money {
+			t.Errorf("Parse(%q) = %v, %v, want %v", tt.want, back, err, tt.money)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	// 0.1 + 0.2 is exact, unlike with floats
+	sum, err := New(10, "USD").Add(New(20, "USD"))
+	if err != nil || sum != New(30, "USD") {
+		t.Errorf("0.10 + 0.20 = %v, %v, want 0.30 USD", sum, err)
+	}
+	if _, err := New(10, "USD").Add(New(10, "EUR")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("USD + EUR error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+	if _, err := New(math.MaxInt64, "USD").Add(New(1, "USD")); !errors.Is(err, ErrOverflow) {
+		t.Errorf("max + 1 error = %v, want %v", err, ErrOverflow)
+	}
+
+	product, err := New(4950, "USD").Mul(3)
+	if err != nil || product != New(14850, "USD") {
+		t.Errorf("49.50 * 3 = %v, %v, want 148.50 USD", product, err)
+	}
+	if _, err := New(math.MaxInt64/2+1, "USD").Mul(2); !errors.Is(err, ErrOverflow) {
+		t.Errorf("overflowing Mul error = %v, want %v", err, ErrOverflow)
+	}
+
+	if m := FromFloat(49.99, "USD"); m != New(4999, "USD") {
+		t.Errorf("FromFloat(49.99) = %v, want 49.99 USD", m)
+	}
+	if m := FromFloat(1200, "JPY"); m != New(1200, "JPY") {
+		t.Errorf("FromFloat(1200) = %v, want 1200 JPY", m)
+	}
+}
@@ -0,0 +1,177 @@
+// Package mtls configures optional TLS and mutual TLS between the services.
+//
+// With no certificate configured the services keep talking plaintext. With a
+// certificate and key a server terminates TLS; adding a CA makes it require
+// client certificates signed by that CA, and AllowedClients narrows which of
+// those clients may call it. A client is identified by the common name or DNS
+// names of its certificate, e.g. "order" or "graphql".
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+var (
+	ErrUnknownClient = errs.New(errs.PermissionDenied, "client is not allowed to call this service")
+)
+
+// Config holds the certificate paths of a service. The services read it with
+// envconfig under the TLS prefix: TLS_CERT_FILE, TLS_KEY_FILE, TLS_CA_FILE
+// and TLS_ALLOWED_CLIENTS, a comma separated list.
+type Config struct {
+	CertFile string `envconfig:"CERT_FILE"`
+	KeyFile  string `envconfig:"KEY_FILE"`
+	// CAFile verifies the certificates of the other side: clients on a
+	// server, the server on a client
+	CAFile string `envconfig:"CA_FILE"`
+	// AllowedClients are the client identities a server accepts. Empty
+	// accepts any client with a certificate signed by the CA.
+	AllowedClients []string `envconfig:"ALLOWED_CLIENTS"`
+}
+
+// Enabled reports whether TLS is configured at all
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+// ServerOptions returns the options a gRPC server needs to serve with c. It
+// returns nil when TLS is disabled.
+func (c Config) ServerOptions() ([]grpc.ServerOption, error) {
+	if !c.Enabled() {
+		if len(c.AllowedClients) != 0 {
+			return nil, errors.New("mtls: allowed clients need TLS_CERT_FILE, TLS_KEY_FILE and TLS_CA_FILE")
+		}
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("mtls: a server needs both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if c.CAFile == "" && len(c.AllowedClients) != 0 {
+		return nil, errors.New("mtls: allowed clients need TLS_CA_FILE to verify client certificates")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("mtls: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		pool, err := loadCA(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	opts := []grpc.ServerOption{grpc.Creds(credentials.NewTLS(config))}
+	if len(c.AllowedClients) != 0 {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(c.unaryServerInterceptor),
+			grpc.ChainStreamInterceptor(c.streamServerInterceptor),
+		)
+	}
+	return opts, nil
+}
+
+// DialOptions returns the options a gRPC client needs to dial a server with
+// c. The client presents its certificate when one is configured and verifies
+// the server against the CA, or the system roots without one. It returns nil
+// when TLS is disabled.
+func (c Config) DialOptions() ([]grpc.DialOption, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("mtls: a client certificate needs both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mtls: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pool, err := loadCA(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(config))}, nil
+}
+
+// unaryServerInterceptor rejects calls from verified clients whose
+// certificate names none of the allowed clients
+func (c Config) unaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !c.allowed(ctx) {
+		return nil, ErrUnknownClient
+	}
+	return handler(ctx, req)
+}
+
+// streamServerInterceptor is unaryServerInterceptor for streaming calls
+func (c Config) streamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !c.allowed(ss.Context()) {
+		return ErrUnknownClient
+	}
+	return handler(srv, ss)
+}
+
+// allowed reports whether the client certificate of the call in ctx names
+// one of the allowed clients
+func (c Config) allowed(ctx context.Context) bool {
+	return slices.ContainsFunc(ClientIdentities(ctx), func(id string) bool {
+		return slices.Contains(c.AllowedClients, id)
+	})
+}
+
+// ClientIdentities returns the common name and DNS names of the verified
+// client certificate of the call in ctx, if any
+func ClientIdentities(ctx context.Context) []string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := info.State.VerifiedChains[0][0]
+	ids := []string{}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("mtls: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("mtls: no certificates found in %s", path)
+	}
+	return pool, nil
+}
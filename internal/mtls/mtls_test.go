@@ -0,0 +1,272 @@
+package mtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// authority is a self-signed CA that issues certificates into a temporary
+// directory
+type authority struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// caFile is the PEM encoded CA certificate
+	caFile string
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &authority{t: t, dir: t.TempDir(), cert: cert, key: key}
+	a.caFile = a.write(name+"-ca.pem", "CERTIFICATE", der)
+	return a
+}
+
+// issue signs a certificate for name, usable by servers on localhost and by
+// clients, and returns the paths of the certificate and its key
+func (a *authority) issue(name string) (certFile, keyFile string) {
+	a.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.write(name+".pem", "CERTIFICATE", der), a.write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func (a *authority) write(name, blockType string, der []byte) string {
+	a.t.Helper()
+
+	path := filepath.Join(a.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		a.t.Fatal(err)
+	}
+	return path
+}
+
+// serve starts a health server configured like the services, with the
+// error interceptor before the TLS options, and returns its address
+func serve(t *testing.T, config Config) string {
+	t.Helper()
+
+	opts, err := config.ServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serv := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.UnaryInterceptor(errs.UnaryServerInterceptor),
+		grpc.StreamInterceptor(errs.StreamServerInterceptor),
+	}, opts...)...)
+	healthpb.RegisterHealthServer(serv, health.NewServer())
+	go serv.Serve(lis)
+	t.Cleanup(serv.Stop)
+
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return net.JoinHostPort("localhost", port)
+}
+
+func check(t *testing.T, addr string, opts ...grpc.DialOption) error {
+	t.Helper()
+
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+// watch opens a health Watch stream, a streaming call, and returns the error
+// of its first message
+func watch(t *testing.T, addr string, opts ...grpc.DialOption) error {
+	t.Helper()
+
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	_, err = stream.Recv()
+	return err
+}
+
+func dialOptions(t *testing.T, config Config) []grpc.DialOption {
+	t.Helper()
+
+	opts, err := config.DialOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestAllowedClients(t *testing.T) {
+	ca := newAuthority(t, "services")
+	serverCert, serverKey := ca.issue("account")
+	addr := serve(t, Config{
+		CertFile:       serverCert,
+		KeyFile:        serverKey,
+		CAFile:         ca.caFile,
+		AllowedClients: []string{"order", "graphql"},
+	})
+
+	client := func(name string) Config {
+		certFile, keyFile := ca.issue(name)
+		return Config{CertFile: certFile, KeyFile: keyFile, CAFile: ca.caFile}
+	}
+
+	for _, name := range []string{"order", "graphql"} {
+		if err := check(t, addr, dialOptions(t, client(name))...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := watch(t, addr, dialOptions(t, client(name))...); err != nil {
+			t.Errorf("%s stream: %v", name, err)
+		}
+	}
+
+	err := check(t, addr, dialOptions(t, client("catalog"))...)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("catalog: want PermissionDenied, got %v", err)
+	}
+	err = watch(t, addr, dialOptions(t, client("catalog"))...)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("catalog stream: want PermissionDenied, got %v", err)
+	}
+}
+
+func TestRejectsUnverifiedClients(t *testing.T) {
+	ca := newAuthority(t, "services")
+	serverCert, serverKey := ca.issue("account")
+	addr := serve(t, Config{
+		CertFile:       serverCert,
+		KeyFile:        serverKey,
+		CAFile:         ca.caFile,
+		AllowedClients: []string{"order"},
+	})
+
+	rogue := newAuthority(t, "rogue")
+	rogueCert, rogueKey := rogue.issue("order")
+
+	tests := map[string][]grpc.DialOption{
+		"no certificate":            dialOptions(t, Config{CAFile: ca.caFile}),
+		"certificate of another CA": dialOptions(t, Config{CertFile: rogueCert, KeyFile: rogueKey, CAFile: ca.caFile}),
+		"plaintext":                 {grpc.WithInsecure()},
+	}
+	for name, opts := range tests {
+		if err := check(t, addr, opts...); err == nil {
+			t.Errorf("%s: call succeeded", name)
+		}
+	}
+}
+
+func TestServerOnlyTLS(t *testing.T) {
+	ca := newAuthority(t, "services")
+	serverCert, serverKey := ca.issue("catalog")
+	addr := serve(t, Config{CertFile: serverCert, KeyFile: serverKey})
+
+	if err := check(t, addr, dialOptions(t, Config{CAFile: ca.caFile})...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	ca := newAuthority(t, "services")
+	certFile, keyFile := ca.issue("account")
+
+	opts, err := Config{}.ServerOptions()
+	if err != nil || opts != nil {
+		t.Errorf("disabled: got %v, %v", opts, err)
+	}
+
+	invalid := map[string]Config{
+		"allowed clients without TLS": {AllowedClients: []string{"order"}},
+		"allowed clients without CA":  {CertFile: certFile, KeyFile: keyFile, AllowedClients: []string{"order"}},
+		"certificate without key":     {CertFile: certFile, CAFile: ca.caFile},
+		"missing CA file":             {CertFile: certFile, KeyFile: keyFile, CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	}
+	for name, config := range invalid {
+		if _, err := config.ServerOptions(); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
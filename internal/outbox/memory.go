@@ -0,0 +1,46 @@
+package outbox
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+)
+
+// MemoryStore is a Store in process memory, for the memory repositories.
+// They Add the events of a change while holding the lock guarding it.
+type MemoryStore struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Add(added ...events.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, added...)
+}
+
+func (s *MemoryStore) PendingEvents(ctx context.Context, limit int) ([]events.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.events[:min(limit, len(s.events))]), nil
+}
+
+func (s *MemoryStore) MarkPublished(ctx context.Context, published []events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := map[string]bool{}
+	for _, e := range published {
+		ids[e.ID] = true
+	}
+	s.events = slices.DeleteFunc(s.events, func(e events.Event) bool { return ids[e.ID] })
+	return nil
+}
@@ -0,0 +1,108 @@
+// Package outbox publishes the events of the services reliably: a repository
+// stores the events of a change in the same transaction as the change, and a
+// Relay publishes the stored events to a broker, then removes them. Events
+// are removed only once published, so each is published at least once, and
+// again if the relay stops in between or several relays share a store.
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+)
+
+// Store holds the events of committed changes until they are published
+type Store interface {
+	// PendingEvents returns up to limit events not published yet, in the
+	// order they were stored
+	PendingEvents(ctx context.Context, limit int) ([]events.Event, error)
+	// MarkPublished removes published events from the store
+	MarkPublished(ctx context.Context, published []events.Event) error
+}
+
+// DefaultInterval is how often a relay looks for events unless configured
+const DefaultInterval = time.Second
+
+// batchSize is the number of events a relay reads at once
+const batchSize = 100
+
+// Relay moves the events of a store to a publisher
+type Relay struct {
+	store     Store
+	publisher events.Publisher
+	interval  time.Duration
+	logger    *slog.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewRelay(store Store, publisher events.Publisher, interval time.Duration, logger *slog.Logger) *Relay {
+	return &Relay{
+		store:     store,
+		publisher: publisher,
+		interval:  interval,
+		logger:    logger,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start flushes the store every interval in the background, until Stop
+func (r *Relay) Start() {
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if _, err := r.Flush(context.Background()); err != nil {
+					r.logger.Error("Failed to relay events", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops a started relay, waiting for the flush in progress
+func (r *Relay) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// Flush publishes the pending events and returns how many it published.
+// Events are published in the order they were stored; the first one failing
+// stops the flush, so it and the events after it are tried again next time.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	published := 0
+	for {
+		pending, err := r.store.PendingEvents(ctx, batchSize)
+		if err != nil {
+			return published, err
+		}
+
+		n := 0
+		for _, event := range pending {
+			if err = r.publisher.Publish(ctx, event); err != nil {
+				break
+			}
+			n++
+		}
+
+		if n > 0 {
+			if markErr := r.store.MarkPublished(ctx, pending[:n]); markErr != nil {
+				return published, markErr
+			}
+			published += n
+		}
+		if err != nil || len(pending) < batchSize {
+			return published, err
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+)
+
+// publisherFunc publishes events with a function
+type publisherFunc func(ctx context.Context, event events.Event) error
+
+func (f publisherFunc) Publish(ctx context.Context, event events.Event) error {
+	return f(ctx, event)
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, id := range []string{"a", "b", "c"} {
+		event, err := events.New(events.TypeAccountCreated, id, events.AccountCreated{AccountID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Add(event)
+	}
+
+	var published []string
+	failing := errors.New("unavailable")
+	relay := NewRelay(store, publisherFunc(func(ctx context.Context, e events.Event) error {
+		if e.AggregateID == "b" && failing != nil {
+			return failing
+		}
+		published = append(published, e.AggregateID)
+		return nil
+	}), DefaultInterval, slog.Default())
+
+	// the failing event stops the flush, so events stay in order
+	if n, err := relay.Flush(ctx); n != 1 || !errors.Is(err, failing) {
+		t.Errorf("Flush = %d, %v, want 1, %v", n, err, failing)
+	}
+
+	failing = nil
+	if n, err := relay.Flush(ctx); n != 2 || err != nil {
+		t.Errorf("Flush after recovering = %d, %v, want 2", n, err)
+	}
+	if n, err := relay.Flush(ctx); n != 0 || err != nil {
+		t.Errorf("Flush of an empty store = %d, %v, want 0", n, err)
+	}
+
+	if len(published) != 3 || published[0] != "a" || published[1] != "b" || published[2] != "c" {
+		t.Errorf("published %v, want [a b c]", published)
+	}
+}
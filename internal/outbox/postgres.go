@@ -0,0 +1,79 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+)
+
+// PostgresStore is a Store in the outbox table of a service database:
+//
+//	CREATE TABLE IF NOT EXISTS outbox (
+//	   id CHAR(27) PRIMARY KEY,
+//	   type VARCHAR(64) NOT NULL,
+//	   aggregate_id VARCHAR(255) NOT NULL,
+//	   data JSONB NOT NULL,
+//	   occurred_at TIMESTAMP WITH TIME ZONE NOT NULL
+//	);
+//	CREATE INDEX IF NOT EXISTS outbox_occurred_at ON outbox (occurred_at);
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Insert stores events in tx, so that they are committed with the change
+// they record, or not at all
+func Insert(ctx context.Context, tx *sql.Tx, added ...events.Event) error {
+	for _, e := range added {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO outbox (id, type, aggregate_id, data, occurred_at) VALUES ($1, $2, $3, $4, $5)`,
+			e.ID, e.Type, e.AggregateID, []byte(e.Data), e.OccurredAt,
+		); err != nil {
+			return fmt.Errorf("outbox: insert %s: %w", e.Type, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) PendingEvents(ctx context.Context, limit int) ([]events.Event, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, type, aggregate_id, data, occurred_at FROM outbox ORDER BY occurred_at, id LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: list events: %w", err)
+	}
+	defer rows.Close()
+
+	pending := []events.Event{}
+	for rows.Next() {
+		var e events.Event
+		var data []byte
+		if err := rows.Scan(&e.ID, &e.Type, &e.AggregateID, &data, &e.OccurredAt); err != nil {
+			return nil, fmt.Errorf("outbox: list events: %w", err)
+		}
+		e.Data = data
+		pending = append(pending, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("outbox: list events: %w", err)
+	}
+	return pending, nil
+}
+
+func (s *PostgresStore) MarkPublished(ctx context.Context, published []events.Event) error {
+	ids := make([]string, len(published))
+	for i, e := range published {
+		ids[i] = e.ID
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE id = ANY($1)`, pq.Array(ids)); err != nil {
+		return fmt.Errorf("outbox: mark events published: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Package pgcursor reads large Postgres results through a server-side
+// cursor, a batch of rows at a time, so that neither the database nor the
+// reader holds the whole result in memory.
+package pgcursor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iter"
+)
+
+// Row is a row of the result, valid until the next one is read
+type Row interface {
+	Scan(dest ...any) error
+}
+
+// Query yields the rows of query, fetching batchSize of them at a time. The
+// cursor lives in a read-only repeatable read transaction, so the rows come
+// from a single snapshot however long the reader takes. The next batch is
+// fetched only once the reader has consumed the previous one.
+func Query(ctx context.Context, db *sql.DB, batchSize int, query string, args ...any) iter.Seq2[Row, error] {
+	return func(yield func(Row, error) bool) {
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			yield(nil, fmt.Errorf("pgcursor: begin: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, `DECLARE export NO SCROLL CURSOR FOR `+query, args...); err != nil {
+			yield(nil, fmt.Errorf("pgcursor: declare: %w", err))
+			return
+		}
+
+		fetch := fmt.Sprintf(`FETCH FORWARD %d FROM export`, batchSize)
+		for {
+			n, more, err := fetchBatch(ctx, tx, fetch, yield)
+			if err != nil {
+				yield(nil, fmt.Errorf("pgcursor: fetch: %w", err))
+				return
+			}
+			if !more || n < batchSize {
+				return
+			}
+		}
+	}
+}
+
+// fetchBatch yields the rows of a FETCH and returns how many it read, and
+// whether the reader wants more
+func fetchBatch(ctx context.Context, tx *sql.Tx, fetch string, yield func(Row, error) bool) (int, bool, error) {
+	rows, err := tx.QueryContext(ctx, fetch)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		n++
+		if !yield(rows, nil) {
+			return n, false, nil
+		}
+	}
+	return n, true, rows.Err()
+}
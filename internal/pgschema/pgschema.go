@@ -0,0 +1,36 @@
+// Package pgschema applies the schema of a service to its Postgres database
+// when the service starts. A schema is written to be applied over and over:
+// it creates what is missing and migrates what older versions of it created,
+// so a new database and an existing one end up the same.
+package pgschema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// lockKey is the advisory lock held while a schema is applied
+const lockKey = "pgschema"
+
+// Apply runs the statements of schema in a single transaction, so a failing
+// migration leaves the database as it was. Replicas starting together take
+// turns, as they wait for the lock of the one applying it.
+func Apply(ctx context.Context, db *sql.DB, schema string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("pgschema: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, lockKey); err != nil {
+		return fmt.Errorf("pgschema: lock: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("pgschema: apply: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("pgschema: commit: %w", err)
+	}
+	return nil
+}
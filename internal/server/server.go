@@ -0,0 +1,299 @@
+// Package server runs the gRPC services: it registers them next to the
+// standard grpc.health.v1 health service and reflection, translates errors
+// with the errs interceptor, logs and traces calls with their request ID,
+// counts them in Prometheus metrics served on an admin port, and stops
+// gracefully on SIGINT or SIGTERM.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/metrics"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+const (
+	DefaultPort          = 8080
+	DefaultDrainTimeout  = 10 * time.Second
+	DefaultCheckInterval = 5 * time.Second
+)
+
+// Check reports whether a dependency of the service, such as its database,
+// is usable
+type Check func(ctx context.Context) error
+
+type options struct {
+	logger             *slog.Logger
+	port               int
+	adminPort          int
+	serverOptions      []grpc.ServerOption
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	checks             []Check
+	checkInterval      time.Duration
+	drainTimeout       time.Duration
+	cleanups           []func()
+}
+
+type Option func(*options)
+
+// WithLogger sets the logger of the server, also used by the services
+// registered on it. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithPort sets the port ListenAndServe and Run listen on
+func WithPort(port int) Option {
+	return func(o *options) { o.port = port }
+}
+
+// WithAdminPort sets the port Run serves /metrics on. Zero disables it.
+func WithAdminPort(port int) Option {
+	return func(o *options) { o.adminPort = port }
+}
+
+// WithServerOptions adds options to the gRPC server, such as TLS credentials
+func WithServerOptions(opts ...grpc.ServerOption) Option {
+	return func(o *options) { o.serverOptions = append(o.serverOptions, opts...) }
+}
+
+// WithUnaryInterceptors chains interceptors after the errs interceptor, so
+// the errors they return are translated too
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(o *options) { o.unaryInterceptors = append(o.unaryInterceptors, interceptors...) }
+}
+
+// WithStreamInterceptors is WithUnaryInterceptors for streaming calls
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(o *options) { o.streamInterceptors = append(o.streamInterceptors, interceptors...) }
+}
+
+// WithHealthCheck adds a check run every check interval. The server reports
+// NOT_SERVING while any check fails.
+func WithHealthCheck(check Check) Option {
+	return func(o *options) { o.checks = append(o.checks, check) }
+}
+
+// WithCheckInterval sets how often the health checks run
+func WithCheckInterval(d time.Duration) Option {
+	return func(o *options) { o.checkInterval = d }
+}
+
+// WithDrainTimeout bounds how long Shutdown waits for in-flight calls before
+// cancelling them
+func WithDrainTimeout(d time.Duration) Option {
+	return func(o *options) { o.drainTimeout = d }
+}
+
+// OnShutdown registers cleanup, such as closing a repository or downstream
+// clients, to run once the server stopped. Cleanups run in reverse order.
+func OnShutdown(cleanup func()) Option {
+	return func(o *options) { o.cleanups = append(o.cleanups, cleanup) }
+}
+
+// Server is a gRPC server. It implements grpc.ServiceRegistrar, so the
+// generated Register functions register services on it directly.
+type Server struct {
+	options
+	grpc     *grpc.Server
+	health   *health.Server
+	admin    *http.Server
+	services []string
+
+	stop     chan struct{}
+	shutdown sync.Once
+}
+
+func New(opts ...Option) *Server {
+	o := options{
+		logger:        slog.Default(),
+		port:          DefaultPort,
+		checkInterval: DefaultCheckInterval,
+		drainTimeout:  DefaultDrainTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	serverOptions := append([]grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
+		grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{
+			logging.UnaryServerInterceptor(o.logger),
+			metrics.UnaryServerInterceptor,
+			errs.UnaryServerInterceptor,
+		}, o.unaryInterceptors...)...),
+		grpc.ChainStreamInterceptor(append([]grpc.StreamServerInterceptor{
+			logging.StreamServerInterceptor(o.logger),
+			metrics.StreamServerInterceptor,
+			errs.StreamServerInterceptor,
+		}, o.streamInterceptors...)...),
+	}, o.serverOptions...)
+
+	s := &Server{
+		options: o,
+		grpc:    grpc.NewServer(serverOptions...),
+		health:  health.NewServer(),
+		stop:    make(chan struct{}),
+	}
+	if o.adminPort != 0 {
+		s.admin = metrics.NewAdminServer(o.adminPort)
+	}
+	healthpb.RegisterHealthServer(s.grpc, s.health)
+	reflection.Register(s.grpc)
+	s.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	return s
+}
+
+// Logger returns the logger of the server
+func (s *Server) Logger() *slog.Logger {
+	return s.logger
+}
+
+func (s *Server) RegisterService(desc *grpc.ServiceDesc, impl any) {
+	s.grpc.RegisterService(desc, impl)
+	s.services = append(s.services, desc.ServiceName)
+	s.health.SetServingStatus(desc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// Serve serves on lis until Shutdown, running the health checks meanwhile.
+// It returns nil once the server stopped by Shutdown.
+func (s *Server) Serve(lis net.Listener) error {
+	go s.watchHealth()
+
+	err := s.grpc.Serve(lis)
+	if errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+// ListenAndServe listens on the configured port and serves
+func (s *Server) ListenAndServe() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+// Run serves on the configured port, and the metrics on the admin port, until
+// ctx is done or the process gets SIGINT or SIGTERM, then shuts down
+func (s *Server) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if s.admin != nil {
+		go func() {
+			if err := s.admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Error("Admin server failed", "error", err)
+			}
+		}()
+	}
+
+	s.logger.Info("Serving", "port", s.port, "admin_port", s.adminPort)
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+
+	select {
+	case err := <-served:
+		s.Shutdown()
+		return err
+	case <-ctx.Done():
+		s.logger.Info("Shutting down")
+		s.Shutdown()
+		return <-served
+	}
+}
+
+// Shutdown reports NOT_SERVING so that clients move away, waits up to the
+// drain timeout for in-flight calls, stops the server and the admin server,
+// and runs the cleanups. Only the first call has an effect.
+func (s *Server) Shutdown() {
+	s.shutdown.Do(func() {
+		close(s.stop)
+		s.health.Shutdown()
+
+		stopped := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(s.drainTimeout):
+			s.logger.Warn("Drain timeout reached, cancelling in-flight calls", "timeout", s.drainTimeout)
+			s.grpc.Stop()
+			<-stopped
+		}
+
+		if s.admin != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+			defer cancel()
+			if err := s.admin.Shutdown(ctx); err != nil {
+				s.logger.Error("Failed to shut down the admin server", "error", err)
+			}
+		}
+
+		for i := len(s.cleanups) - 1; i >= 0; i-- {
+			s.cleanups[i]()
+		}
+	})
+}
+
+// watchHealth runs the health checks every check interval until Shutdown
+func (s *Server) watchHealth() {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		s.checkHealth()
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.checkInterval)
+	defer cancel()
+
+	status := healthpb.HealthCheckResponse_SERVING
+	for _, check := range s.checks {
+		if err := check(ctx); err != nil {
+			s.logger.Warn("Health check failed", "error", err)
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			break
+		}
+	}
+	s.setStatus(status)
+}
+
+// setStatus sets the status of the server as a whole, named "", and of each
+// registered service
+func (s *Server) setStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	s.health.SetServingStatus("", status)
+	for _, service := range s.services {
+		s.health.SetServingStatus(service, status)
+	}
+}
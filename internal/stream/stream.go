@@ -0,0 +1,46 @@
+// Package stream turns the server streams of the gRPC clients into Go
+// iterators
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+
+	"google.golang.org/grpc"
+)
+
+// Recv opens a stream with open and yields its messages decoded by decode.
+// Messages are received as the loop asks for them, so a slow loop slows the
+// server down through gRPC flow control rather than buffering the stream.
+// Breaking out of the loop cancels the call. The iteration ends without an
+// error only when the server ends the stream, so a cut-short stream is never
+// mistaken for a complete one.
+func Recv[Res, T any](ctx context.Context, open func(context.Context) (grpc.ServerStreamingClient[Res], error), decode func(*Res) T) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var zero T
+		s, err := open(ctx)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+
+		for {
+			res, err := s.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(decode(res), nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package tracing sets up OpenTelemetry tracing for a service. Spans are
+// exported to stdout, to an OTLP collector, or nowhere, and trace context is
+// propagated with W3C trace context headers, which the gRPC instrumentation
+// carries in metadata from the gateway through every hop.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config selects the exporter. The services read it with envconfig under
+// the TRACING prefix, so TRACING_EXPORTER picks the exporter. The OTLP
+// exporter is configured with the standard OTEL_EXPORTER_OTLP_* variables,
+// e.g. OTEL_EXPORTER_OTLP_ENDPOINT.
+type Config struct {
+	// Exporter is "none", "stdout" or "otlp"
+	Exporter string `envconfig:"EXPORTER" default:"none"`
+}
+
+// Setup installs the global tracer provider and propagator for service. The
+// returned shutdown flushes the spans still buffered and must be called
+// before the process exits.
+func Setup(ctx context.Context, service string, config Config) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterOTLP:
+		exporter, err = otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(service)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
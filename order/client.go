@@ -2,9 +2,17 @@ package order
 
 import (
 	"context"
+	"errors"
+	"io"
+	"iter"
 	"time"
 
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/stream"
 	"github.com/ndquang191/go-graph-grpc/order/pb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 )
 
@@ -13,8 +21,18 @@ type Client struct {
 	service pb.OrderServiceClient
 }
 
-func NewClient(url string) (*Client, error) {
-	conn, err := grpc.Dial(url, grpc.WithInsecure())
+// NewClient dials the service at url. Extra dial options are applied after
+// the default insecure transport, so they can override it. Status errors
+// returned by the service are translated back to errs.Error values, and
+// calls carry the OpenTelemetry trace context and request ID of ctx.
+func NewClient(url string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(errs.UnaryClientInterceptor, logging.UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(errs.StreamClientInterceptor, logging.StreamClientInterceptor),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}, opts...)
+	conn, err := grpc.Dial(url, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -30,7 +48,9 @@ func (c *Client) Close() {
 	c.conn.Close()
 }
 
-func (c *Client) PostOder(ctx context.Context, accountID string, products []OrderedProduct) (*Order, error) {
+// PostOder places an order. Retries with the same non-empty idempotencyKey
+// return the order placed by the first request instead of placing another.
+func (c *Client) PostOder(ctx context.Context, accountID string, products []OrderedProduct, idempotencyKey string) (*Order, error) {
 	protoProducts := []*pb.PostOrderRequest_OrderedProduct{}
 
 	for _, p := range products {
@@ -40,27 +60,30 @@ func (c *Client) PostOder(ctx context.Context, accountID string, products []Orde
 		})
 	}
 	res, err := c.service.PostOrder(ctx, &pb.PostOrderRequest{
-		AccountId: accountID,
-		Products:  protoProducts,
+		AccountId:      accountID,
+		Products:       protoProducts,
+		IdempotencyKey: idempotencyKey,
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	newOrder := res.Order
+	newOrder := decodeOrder(res.Order)
+	return &newOrder, nil
+}
 
-	newOrderCreatedAt := time.Time{}
+func (c *Client) GetOrder(ctx context.Context, id string) (*Order, error) {
+	res, err := c.service.GetOrder(ctx, &pb.GetOrderRequest{
+		Id: id,
+	})
 
-	newOrderCreatedAt.UnmarshalBinary([]byte(newOrder.CreatedAt))
+	if err != nil {
+		return nil, err
+	}
 
-	return &Order{
-		ID:         newOrder.Id,
-		CreatedAt:  newOrderCreatedAt,
-		TotalPrice: newOrder.TotalPrice,
-		AccountID:  newOrder.AccountId,
-		Products:   products,
-	}, nil
+	newOrder := decodeOrder(res.Order)
+	return &newOrder, nil
 }
 
 func (c *Client) GetOrdersForAccount(ctx context.Context, accountID string) ([]Order, error) {
@@ -75,31 +98,187 @@ func (c *Client) GetOrdersForAccount(ctx context.Context, accountID string) ([]O
 	orders := []Order{}
 
 	for _, orderProto := range res.Orders {
-		newOrder := Order{
-			ID:         orderProto.Id,
-			TotalPrice: orderProto.TotalPrice,
-			AccountID:  orderProto.AccountId,
-		}
+		orders = append(orders, decodeOrder(orderProto))
+	}
+
+	return orders, nil
+}
 
-		newOrder.CreatedAt = time.Time{}
-		newOrder.CreatedAt.UnmarshalBinary([]byte(orderProto.CreatedAt))
+func (c *Client) GetOrdersForAccountPage(ctx context.Context, accountID string, after string, first uint64) (*OrderPage, error) {
+	res, err := c.service.GetOrdersForAccount(ctx, &pb.GetOrdersForAccountRequest{
+		AccountId: accountID,
+		After:     after,
+		Take:      first,
+	})
 
-		products := []OrderedProduct{}
+	if err != nil {
+		return nil, err
+	}
 
-		for _, p := range orderProto.Products {
-			products = append(products, OrderedProduct{
-				ID:          p.Id,
-				Quantity:    p.Quantity,
-				Name:        p.Name,
-				Description: p.Description,
-				Price:       p.Price,
-			})
-		}
+	page := &OrderPage{
+		Orders:      []Order{},
+		Cursors:     res.Cursors,
+		HasNextPage: res.HasNextPage,
+	}
+	for _, orderProto := range res.Orders {
+		page.Orders = append(page.Orders, decodeOrder(orderProto))
+	}
+
+	return page, nil
+}
+
+// GetOrdersForAccounts returns the orders of several accounts in one call,
+// keyed by account ID
+func (c *Client) GetOrdersForAccounts(ctx context.Context, accountIDs []string) (map[string][]Order, error) {
+	res, err := c.service.GetOrdersForAccounts(ctx, &pb.GetOrdersForAccountsRequest{
+		AccountIds: accountIDs,
+	})
+
+	if err != nil {
+		return nil, err
+	}
 
-		newOrder.Products = products
-		orders = append(orders, newOrder)
+	orders := map[string][]Order{}
 
+	for _, orderProto := range res.Orders {
+		o := decodeOrder(orderProto)
+		orders[o.AccountID] = append(orders[o.AccountID], o)
 	}
 
 	return orders, nil
 }
+
+func (c *Client) UpdateOrderStatus(ctx context.Context, id string, status Status, changedBy string, reason string) (*Order, error) {
+	res, err := c.service.UpdateOrderStatus(ctx, &pb.UpdateOrderStatusRequest{
+		Id:        id,
+		Status:    string(status),
+		ChangedBy: changedBy,
+		Reason:    reason,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	newOrder := decodeOrder(res.Order)
+	return &newOrder, nil
+}
+
+func (c *Client) CancelOrder(ctx context.Context, id string, changedBy string, reason string) (*Order, error) {
+	res, err := c.service.CancelOrder(ctx, &pb.CancelOrderRequest{
+		Id:        id,
+		ChangedBy: changedBy,
+		Reason:    reason,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	newOrder := decodeOrder(res.Order)
+	return &newOrder, nil
+}
+
+// WatchOrder yields the order right away, then again each time its status
+// changes, until the loop stops, ctx is done or the stream fails
+func (c *Client) WatchOrder(ctx context.Context, id string) iter.Seq2[*Order, error] {
+	return c.watchOrders(ctx, &pb.WatchOrdersRequest{
+		Target: &pb.WatchOrdersRequest_OrderId{OrderId: id},
+	})
+}
+
+// WatchAccountOrders yields each order the account places from now on, until
+// the loop stops, ctx is done or the stream fails
+func (c *Client) WatchAccountOrders(ctx context.Context, accountID string) iter.Seq2[*Order, error] {
+	return c.watchOrders(ctx, &pb.WatchOrdersRequest{
+		Target: &pb.WatchOrdersRequest_AccountId{AccountId: accountID},
+	})
+}
+
+func (c *Client) watchOrders(ctx context.Context, req *pb.WatchOrdersRequest) iter.Seq2[*Order, error] {
+	return func(yield func(*Order, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stream, err := c.service.WatchOrders(ctx, req)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		for {
+			res, err := stream.Recv()
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			o := decodeOrder(res.Order)
+			if !yield(&o, nil) {
+				return
+			}
+		}
+	}
+}
+
+// StreamOrders yields every order in ID order, receiving them as the loop
+// asks for them. It ends with an error if the stream is cut short.
+func (c *Client) StreamOrders(ctx context.Context) iter.Seq2[Order, error] {
+	return stream.Recv(ctx,
+		func(ctx context.Context) (pb.OrderService_StreamOrdersClient, error) {
+			return c.service.StreamOrders(ctx, &pb.StreamOrdersRequest{})
+		},
+		func(res *pb.StreamOrdersResponse) Order { return decodeOrder(res.Order) },
+	)
+}
+
+func decodeOrder(orderProto *pb.Order) Order {
+	newOrder := Order{
+		ID:         orderProto.Id,
+		TotalPrice: decodePrice(orderProto.TotalPrice, orderProto.TotalPriceFloat),
+		AccountID:  orderProto.AccountId,
+		Status:     Status(orderProto.Status),
+		CreatedAt:  decodeCreatedAt(orderProto),
+	}
+
+	products := []OrderedProduct{}
+
+	for _, p := range orderProto.Products {
+		products = append(products, OrderedProduct{
+			ID:          p.Id,
+			Quantity:    p.Quantity,
+			Name:        p.Name,
+			Description: p.Description,
+			Price:       decodePrice(p.Price, p.PriceFloat),
+		})
+	}
+
+	newOrder.Products = products
+	return newOrder
+}
+
+// decodeCreatedAt reads createdAt, falling back to the deprecated
+// createdAtText of servers that do not fill it yet
+func decodeCreatedAt(o *pb.Order) time.Time {
+	if o.CreatedAt != nil {
+		return o.CreatedAt.AsTime()
+	}
+	createdAt, _ := time.Parse(time.RFC3339Nano, o.CreatedAtText)
+	return createdAt
+}
+
+func decodeMoney(m *pb.Money) money.Money {
+	return money.New(m.GetAmount(), m.GetCurrency())
+}
+
+// decodePrice reads price, falling back to the deprecated float price of
+// servers built before Money, which priced in USD
+func decodePrice(price *pb.Money, priceFloat float64) money.Money {
+	if price == nil && priceFloat != 0 {
+		return money.FromFloat(priceFloat, money.DefaultCurrency)
+	}
+	return decodeMoney(price)
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/ndquang191/go-graph-grpc/account"
+	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/mtls"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
+	"github.com/ndquang191/go-graph-grpc/internal/tracing"
 	"github.com/ndquang191/go-graph-grpc/order"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tinrab/retry"
 )
 
@@ -13,29 +25,116 @@ type Config struct {
 	DatabaseURL string `envconfig:"DATABASE_URL"`
 	AccountURL  string `envconfig:"ACCOUNT_SERVICE_URL"`
 	CatalogURL  string `envconfig:"CATALOG_SERVICE_URL"`
+	// Storage selects the repository: "postgres" or "memory"
+	Storage string `envconfig:"STORAGE" default:"postgres"`
+	// TLS secures both the order server and its calls to account and
+	// catalog, with the same certificate
+	TLS mtls.Config `envconfig:"TLS"`
+	// Port is the port the gRPC server listens on
+	Port int `envconfig:"PORT" default:"8080"`
+	// DrainTimeout bounds how long in-flight calls may take to finish on
+	// shutdown
+	DrainTimeout time.Duration  `envconfig:"DRAIN_TIMEOUT" default:"10s"`
+	Tracing      tracing.Config `envconfig:"TRACING"`
+	Log          logging.Config `envconfig:"LOG"`
+	// AdminPort serves the metrics at /metrics, apart from the gRPC port
+	AdminPort int `envconfig:"ADMIN_PORT" default:"9090"`
+	// IdempotencyRetention is how long idempotency keys of Post requests are
+	// remembered
+	IdempotencyRetention time.Duration `envconfig:"IDEMPOTENCY_RETENTION" default:"24h"`
+	// OutboxInterval is how often stored events are relayed to the broker
+	OutboxInterval time.Duration `envconfig:"OUTBOX_INTERVAL" default:"1s"`
 }
 
 func main() {
-
 	var cfg Config
 	err := envconfig.Process("", &cfg)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatal(slog.Default(), "Failed to read the config", "error", err)
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.Log, "order")
+	if err != nil {
+		logging.Fatal(slog.Default(), "Failed to set up logging", "error", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "order", cfg.Tracing)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up tracing", "error", err)
 	}
 
 	var r order.Repository
 
-	retry.ForeverSleep(2*time.Second, func(_ int) (err error) {
-		r, err = order.NewPostgresRepository(cfg.DatabaseURL)
-		if err != nil {
-			log.Println(err)
-		}
-		return
-	})
+	if cfg.Storage == "memory" {
+		r = order.NewMemoryRepository()
+		logger.Info("Using in-memory storage")
+	} else {
+		retry.ForeverSleep(2*time.Second, func(_ int) (err error) {
+			r, err = order.NewPostgresRepository(cfg.DatabaseURL)
+			if err != nil {
+				logger.Warn("Failed to connect to the database, retrying", "error", err)
+			}
+			return
+		})
+		logger.Info("Connected to the database")
+	}
 
-	defer r.Close()
-	log.Println("Connected to database")
+	// events go through a broker in memory, so a second server would miss
+	// those of the first
+	if err := r.LockServer(context.Background()); err != nil {
+		logging.Fatal(logger, "Failed to become the only order server", "error", err)
+	}
+
+	serverOpts, err := cfg.TLS.ServerOptions()
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS credentials", "error", err)
+	}
+	dialOpts, err := cfg.TLS.DialOptions()
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS credentials", "error", err)
+	}
+
+	accountClient, err := account.NewClient(cfg.AccountURL, dialOpts...)
+	if err != nil {
+		logging.Fatal(logger, "Failed to connect to the account service", "error", err)
+	}
+
+	catalogClient, err := catalog.NewClient(cfg.CatalogURL, dialOpts...)
+	if err != nil {
+		logging.Fatal(logger, "Failed to connect to the catalog service", "error", err)
+	}
+
+	prometheus.MustRegister(order.Collectors()...)
 
 	s := order.NewService(r)
-	log.Fatal(order.ListenGRPC(s, cfg.AccountURL, cfg.CatalogURL, 8080))
+	// events reach subscribers in this process only, such as WatchOrders,
+	// until a networked events.Broker is plugged in here, hence the single
+	// server
+	broker := events.NewMemoryBroker()
+	broker.Subscribe(">", events.LogHandler(logger))
+	relay := outbox.NewRelay(r.Outbox(), broker, cfg.OutboxInterval, logger)
+	relay.Start()
+
+	srv := order.NewGRPCServer(s, idempotency.New(r, cfg.IdempotencyRetention), broker, accountClient, catalogClient,
+		// cleanups run in reverse order, so spans are flushed last
+		server.OnShutdown(func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.Error("Failed to flush spans", "error", err)
+			}
+		}),
+		server.WithLogger(logger),
+		server.WithPort(cfg.Port),
+		server.WithAdminPort(cfg.AdminPort),
+		server.WithServerOptions(serverOpts...),
+		server.WithDrainTimeout(cfg.DrainTimeout),
+		server.WithHealthCheck(r.Ping),
+		server.OnShutdown(r.Close),
+		server.OnShutdown(relay.Stop),
+		server.OnShutdown(accountClient.Close),
+		server.OnShutdown(catalogClient.Close),
+	)
+	if err := srv.Run(context.Background()); err != nil {
+		logging.Fatal(logger, "Server failed", "error", err)
+	}
 }
@@ -0,0 +1,30 @@
+package order
+
+import "github.com/ndquang191/go-graph-grpc/internal/events"
+
+// orderPlaced returns the event recording that order was placed
+func orderPlaced(order *Order) (events.Event, error) {
+	products := make([]events.OrderedProduct, len(order.Products))
+	for i, p := range order.Products {
+		products[i] = events.OrderedProduct{ProductID: p.ID, Quantity: p.Quantity, Price: p.Price}
+	}
+
+	return events.New(events.TypeOrderPlaced, order.ID, events.OrderPlaced{
+		OrderID:    order.ID,
+		AccountID:  order.AccountID,
+		TotalPrice: order.TotalPrice,
+		Products:   products,
+		CreatedAt:  order.CreatedAt,
+	})
+}
+
+// orderStatusChanged returns the event recording change
+func orderStatusChanged(change *StatusChange) (events.Event, error) {
+	return events.New(events.TypeOrderStatusChanged, change.OrderID, events.OrderStatusChanged{
+		OrderID:    change.OrderID,
+		FromStatus: string(change.FromStatus),
+		ToStatus:   string(change.ToStatus),
+		Reason:     change.Reason,
+		ChangedAt:  change.ChangedAt,
+	})
+}
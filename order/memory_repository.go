@@ -0,0 +1,173 @@
+package order
+
+import (
+	"context"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"iter"
+	"sort"
+	"sync"
+)
+
+type memoryRepository struct {
+	*idempotency.MemoryStore
+	mu      sync.RWMutex
+	orders  map[string]Order
+	history []StatusChange
+	events  *outbox.MemoryStore
+}
+
+// NewMemoryRepository returns a thread-safe Repository backed by process
+// memory, for running the service without Postgres
+func NewMemoryRepository() Repository {
+	return &memoryRepository{
+		MemoryStore: idempotency.NewMemoryStore(),
+		orders:      map[string]Order{},
+		events:      outbox.NewMemoryStore(),
+	}
+}
+
+func (r *memoryRepository) Close() {
+}
+
+// LockServer has nothing to do, as the storage is the memory of the server
+func (r *memoryRepository) LockServer(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRepository) Outbox() outbox.Store {
+	return r.events
+}
+
+func (r *memoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRepository) PutOrder(ctx context.Context, order *Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orders[order.ID]; ok {
+		return ErrAlreadyExists
+	}
+
+	event, err := orderPlaced(order)
+	if err != nil {
+		return err
+	}
+
+	r.orders[order.ID] = copyOrder(*order)
+	r.events.Add(event)
+	return nil
+}
+
+func (r *memoryRepository) GetOrderByID(ctx context.Context, id string) (*Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	o, ok := r.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	o = copyOrder(o)
+	return &o, nil
+}
+
+func (r *memoryRepository) GetOrdersForAccount(ctx context.Context, accountId string) ([]Order, error) {
+	return r.GetOrdersForAccounts(ctx, []string{accountId})
+}
+
+func (r *memoryRepository) GetOrdersForAccounts(ctx context.Context, accountIDs []string) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	wanted := map[string]bool{}
+	for _, id := range accountIDs {
+		wanted[id] = true
+	}
+
+	orders := []Order{}
+	for _, o := range r.orders {
+		if wanted[o.AccountID] {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].ID < orders[j].ID
+	})
+
+	return orders, nil
+}
+
+func (r *memoryRepository) GetOrdersForAccountAfter(ctx context.Context, accountID string, afterID string, take uint64) ([]Order, error) {
+	orders, err := r.GetOrdersForAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	page := []Order{}
+	for _, o := range orders {
+		if o.ID <= afterID {
+			continue
+		}
+		if uint64(len(page)) == take {
+			break
+		}
+		page = append(page, o)
+	}
+	return page, nil
+}
+
+func (r *memoryRepository) UpdateOrderStatus(ctx context.Context, change *StatusChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[change.OrderID]
+	if !ok || o.Status != change.FromStatus {
+		return ErrInvalidTransition
+	}
+
+	event, err := orderStatusChanged(change)
+	if err != nil {
+		return err
+	}
+
+	o.Status = change.ToStatus
+	r.orders[o.ID] = o
+	r.history = append(r.history, *change)
+	r.events.Add(event)
+	return nil
+}
+
+// StreamOrders yields a snapshot of the orders taken when it starts
+func (r *memoryRepository) StreamOrders(ctx context.Context) iter.Seq2[Order, error] {
+	return func(yield func(Order, error) bool) {
+		r.mu.RLock()
+		orders := make([]Order, 0, len(r.orders))
+		for _, o := range r.orders {
+			orders = append(orders, copyOrder(o))
+		}
+		r.mu.RUnlock()
+
+		sort.Slice(orders, func(i, j int) bool {
+			return orders[i].ID < orders[j].ID
+		})
+		for _, o := range orders {
+			if err := ctx.Err(); err != nil {
+				yield(Order{}, err)
+				return
+			}
+			if !yield(o, nil) {
+				return
+			}
+		}
+	}
+}
+
+// copyOrder detaches the products slice so callers cannot mutate stored orders
+func copyOrder(o Order) Order {
+	o.Products = append([]OrderedProduct(nil), o.Products...)
+	return o
+}
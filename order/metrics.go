@@ -0,0 +1,28 @@
+package order
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// business metrics of the order service. They are not registered on import,
+// so that the gateway, which only uses the client, does not export them; the
+// order server registers Collectors.
+var (
+	ordersCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "orders_created_total",
+		Help: "Orders placed.",
+	})
+
+	orderValue = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_value_total",
+		Help: "Sum of the total price of the orders placed, by currency, in its major unit.",
+	}, []string{"currency"})
+
+	orderStatusChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_status_changes_total",
+		Help: "Order status changes, by the status changed to.",
+	}, []string{"status"})
+)
+
+// Collectors returns the business metrics of the order service
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{ordersCreated, orderValue, orderStatusChanges}
+}
@@ -3,22 +3,78 @@ package order
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"errors"
+	"fmt"
+	"iter"
+	"net"
 
+	"github.com/XSAM/otelsql"
 	"github.com/lib/pq"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/metrics"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/outbox"
+	"github.com/ndquang191/go-graph-grpc/internal/pgcursor"
+	"github.com/ndquang191/go-graph-grpc/internal/pgschema"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 type Repository interface {
 	Close()
+	// Ping reports whether the storage is reachable
+	Ping(ctx context.Context) error
+	// Store keeps the idempotency keys of Post requests next to the data
+	// they created
+	idempotency.Store
+	// Outbox holds the events of the changes made through the repository
+	// until they are published
+	Outbox() outbox.Store
+	// PutOrder stores order along with its OrderPlaced event
 	PutOrder(ctx context.Context, order *Order) error
+	GetOrderByID(ctx context.Context, id string) (*Order, error)
 	GetOrdersForAccount(ctx context.Context, accountId string) ([]Order, error)
+	GetOrdersForAccounts(ctx context.Context, accountIDs []string) ([]Order, error)
+	GetOrdersForAccountAfter(ctx context.Context, accountID string, afterID string, take uint64) ([]Order, error)
+	// UpdateOrderStatus applies change along with its OrderStatusChanged
+	// event
+	UpdateOrderStatus(ctx context.Context, change *StatusChange) error
+	// StreamOrders yields every order in ID order, reading them in batches
+	// as the caller consumes them
+	StreamOrders(ctx context.Context) iter.Seq2[Order, error]
+	// LockServer makes the caller the only order server of the storage until
+	// Close, or fails with ErrServerRunning. Events reach the subscribers of
+	// the server publishing them only, so a second server would miss them.
+	LockServer(ctx context.Context) error
 }
 
+// schema creates the tables of the repository, or migrates those of an older
+// version, when it connects
+//
+//go:embed up.sql
+var schema string
+
+// streamBatchSize is the number of rows StreamOrders reads at once, one per
+// ordered product
+const streamBatchSize = 500
+
+// serverLock is the advisory lock held by the order server
+const serverLock = "order-server"
+
 type postgresRepository struct {
-	db *sql.DB
+	*idempotency.PostgresStore
+	db     *sql.DB
+	events *outbox.PostgresStore
+	// lock is the session holding serverLock, if taken
+	lock *sql.Conn
 }
 
 func NewPostgresRepository(url string) (Repository, error) {
-	db, err := sql.Open("postgres", url)
+	db, err := otelsql.Open("postgres", url,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -28,131 +84,390 @@ func NewPostgresRepository(url string) (Repository, error) {
 		return nil, err
 	}
 
-	return &postgresRepository{db}, nil
+	if err := pgschema.Apply(context.Background(), db, schema); err != nil {
+		return nil, err
+	}
+
+	metrics.RegisterDB(db, "order")
+
+	return &postgresRepository{
+		PostgresStore: idempotency.NewPostgresStore(db),
+		db:            db,
+		events:        outbox.NewPostgresStore(db),
+	}, nil
 }
 
 func (r *postgresRepository) Close() {
+	if r.lock != nil {
+		r.lock.Close()
+	}
 	r.db.Close()
 }
 
-func (r *postgresRepository) PutOrder(ctx context.Context, order *Order) error {
+// LockServer takes serverLock in a session of its own, which holds it until
+// the repository is closed or the connection is lost
+func (r *postgresRepository) LockServer(ctx context.Context) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, serverLock).Scan(&locked); err != nil {
+		conn.Close()
+		return wrapError(err)
+	}
+	if !locked {
+		conn.Close()
+		return ErrServerRunning
+	}
+	r.lock = conn
+	return nil
+}
+
+func (r *postgresRepository) Outbox() outbox.Store {
+	return r.events
+}
+
+// Ping also checks the session holding the server lock, which is gone with
+// the connection
+func (r *postgresRepository) Ping(ctx context.Context) error {
+	if r.lock != nil {
+		if err := r.lock.PingContext(ctx); err != nil {
+			return wrapError(err)
+		}
+	}
+	return wrapError(r.db.PingContext(ctx))
+}
+
+func (r *postgresRepository) PutOrder(ctx context.Context, order *Order) (err error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return wrapError(err)
 	}
 
 	defer func() {
 		if err != nil {
 			tx.Rollback()
+			err = wrapError(err)
 			return
 		}
 
-		err = tx.Commit()
+		err = wrapError(tx.Commit())
 	}()
-	tx.ExecContext(ctx,
-		`INSERT INTO order (id, created_at, account_id, total_price) VALUES ($1, $2, $3, $4)`,
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO orders (id, created_at, account_id, total_price, currency, status) VALUES ($1, $2, $3, $4, $5, $6)`,
 		order.ID,
 		order.CreatedAt,
 		order.AccountID,
-		order.TotalPrice,
+		order.TotalPrice.Decimal(),
+		order.TotalPrice.Currency,
+		order.Status,
 	)
 
 	if err != nil {
 		return err
 	}
 
-	stmt, _ := tx.PrepareContext(ctx, pq.CopyIn("order_products", "order_id", "product_id", "quantity"))
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("order_products", "order_id", "product_id", "quantity", "price", "currency"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 
 	for _, p := range order.Products {
-		stmt.ExecContext(ctx, order.ID, p.ID, p.Quantity)
+		_, err = stmt.ExecContext(ctx, order.ID, p.ID, p.Quantity, p.Price.Decimal(), p.Price.Currency)
 
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err = stmt.ExecContext(ctx)
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return err
+	}
 
+	event, err := orderPlaced(order)
 	if err != nil {
 		return err
 	}
+	return outbox.Insert(ctx, tx, event)
+}
 
-	stmt.Close()
-	return nil
+func (r *postgresRepository) GetOrderByID(ctx context.Context, id string) (*Order, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT o.id, o.created_at, o.account_id, o.total_price, o.currency, o.status,
+		op.product_id, op.quantity, op.price, op.currency
+		FROM orders o JOIN order_products op ON(o.id = op.order_id)
+		WHERE o.id = $1`,
+		id,
+	)
+
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	var order *Order
+	for rows.Next() {
+		o, p, err := scanOrderRow(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if order == nil {
+			order = &o
+		}
+		order.Products = append(order.Products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, wrapError(err)
+	}
 
+	if order == nil {
+		return nil, ErrNotFound
+	}
+
+	return order, nil
 }
 
 func (r *postgresRepository) GetOrdersForAccount(ctx context.Context, accountId string) ([]Order, error) {
+	return r.GetOrdersForAccounts(ctx, []string{accountId})
+}
+
+func (r *postgresRepository) GetOrdersForAccounts(ctx context.Context, accountIDs []string) ([]Order, error) {
 
 	rows, err := r.db.QueryContext(
 		ctx,
-		`SELECT o.id, o.created_at, o.account_id,o.total_price::money::numeric::float8,
-		op.product_id,
-		op.quantity
+		`SELECT o.id, o.created_at, o.account_id, o.total_price, o.currency, o.status,
+		op.product_id, op.quantity, op.price, op.currency
 		FROM orders o JOIN order_products op ON(o.id = op.order_id)
-		WHERE o.account_id = $1
+		WHERE o.account_id = ANY($1)
 		ORDER BY o.id`,
-		accountId,
+		pq.Array(accountIDs),
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	defer rows.Close()
 
-	orders := []Order{}
-	lastOrder := &Order{}
+	return scanOrders(rows)
+}
 
-	orderedProduct := &OrderedProduct{}
-	products := []OrderedProduct{}
-	order := Order{}
-	for rows.Next() {
-		if err = rows.Scan(
-			&order.ID,
-			&order.CreatedAt,
-			&order.AccountID,
-			&order.TotalPrice,
-			&orderedProduct.ID,
-			&orderedProduct.Quantity,
-		); err != nil {
-			return nil, err
+// GetOrdersForAccountAfter returns up to take orders of an account with IDs
+// greater than afterID, in ID order
+func (r *postgresRepository) GetOrdersForAccountAfter(ctx context.Context, accountID string, afterID string, take uint64) ([]Order, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT o.id, o.created_at, o.account_id, o.total_price, o.currency, o.status,
+		op.product_id, op.quantity, op.price, op.currency
+		FROM orders o JOIN order_products op ON(o.id = op.order_id)
+		WHERE o.id IN (
+			SELECT id FROM orders WHERE account_id = $1 AND id > $2 ORDER BY id LIMIT $3
+		)
+		ORDER BY o.id`,
+		accountID,
+		afterID,
+		take,
+	)
+
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	return scanOrders(rows)
+}
+
+func (r *postgresRepository) UpdateOrderStatus(ctx context.Context, change *StatusChange) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = wrapError(err)
+			return
 		}
-		if lastOrder.ID != "" && lastOrder.ID != order.ID {
-			newOrder := Order{
-				ID:         lastOrder.ID,
-				AccountID:  lastOrder.AccountID,
-				CreatedAt:  lastOrder.CreatedAt,
-				TotalPrice: lastOrder.TotalPrice,
-				Products:   products,
+
+		err = wrapError(tx.Commit())
+	}()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE orders SET status = $1 WHERE id = $2 AND status = $3`,
+		change.ToStatus,
+		change.OrderID,
+		change.FromStatus,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// the order moved on since it was read, so the transition is no longer valid
+	if affected == 0 {
+		return ErrInvalidTransition
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, reason, changed_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		change.OrderID,
+		change.FromStatus,
+		change.ToStatus,
+		change.ChangedBy,
+		change.Reason,
+		change.ChangedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	event, err := orderStatusChanged(change)
+	if err != nil {
+		return err
+	}
+	return outbox.Insert(ctx, tx, event)
+}
+
+// StreamOrders reads the orders joined with their products through a
+// server-side cursor, so they come from one snapshot however long the caller
+// takes. The rows of an order may span two batches, so an order is yielded
+// once the row of the next one is read.
+func (r *postgresRepository) StreamOrders(ctx context.Context) iter.Seq2[Order, error] {
+	return func(yield func(Order, error) bool) {
+		var order *Order
+		for row, err := range pgcursor.Query(ctx, r.db, streamBatchSize,
+			`SELECT o.id, o.created_at, o.account_id, o.total_price, o.currency, o.status,
+			op.product_id, op.quantity, op.price, op.currency
+			FROM orders o JOIN order_products op ON(o.id = op.order_id)
+			ORDER BY o.id`,
+		) {
+			if err != nil {
+				yield(Order{}, wrapError(err))
+				return
 			}
 
-			orders = append(orders, newOrder)
-			products = []OrderedProduct{}
+			o, p, err := scanOrderRow(row)
+			if err != nil {
+				yield(Order{}, err)
+				return
+			}
+
+			if order != nil && order.ID != o.ID {
+				if !yield(*order, nil) {
+					return
+				}
+				order = nil
+			}
+			if order == nil {
+				order = &o
+			}
+			order.Products = append(order.Products, p)
 		}
 
-		products = append(products, OrderedProduct{
-			ID:       orderedProduct.ID,
-			Quantity: orderedProduct.Quantity,
-		})
+		if order != nil {
+			yield(*order, nil)
+		}
+	}
+}
 
-		*lastOrder = *&order
+// scanOrderRow reads a row of an order joined with one of its products
+func scanOrderRow(row interface{ Scan(...any) error }) (Order, OrderedProduct, error) {
+	o := Order{}
+	p := OrderedProduct{}
+	var total priceColumns
+	var price, currency sql.NullString
+	if err := row.Scan(
+		&o.ID,
+		&o.CreatedAt,
+		&o.AccountID,
+		&total.amount,
+		&total.currency,
+		&o.Status,
+		&p.ID,
+		&p.Quantity,
+		&price,
+		&currency,
+	); err != nil {
+		return Order{}, OrderedProduct{}, wrapError(err)
 	}
 
-	if lastOrder != nil {
-		newOrder := Order{
-			ID:         lastOrder.ID,
-			AccountID:  lastOrder.AccountID,
-			CreatedAt:  lastOrder.CreatedAt,
-			TotalPrice: lastOrder.TotalPrice,
-			Products:   products,
+	var err error
+	if o.TotalPrice, err = total.money("total price of order"); err != nil {
+		return Order{}, OrderedProduct{}, err
+	}
+	// products ordered before their price was stored have none
+	if price.Valid {
+		line := priceColumns{amount: price.String, currency: currency.String}
+		if p.Price, err = line.money("price of ordered product"); err != nil {
+			return Order{}, OrderedProduct{}, err
 		}
-		orders = append(orders, newOrder)
 	}
+	return o, p, nil
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, err
+// priceColumns holds an amount column and its currency column
+type priceColumns struct {
+	amount   string
+	currency string
+}
+
+func (p priceColumns) money(name string) (money.Money, error) {
+	m, err := money.Parse(p.amount, p.currency)
+	if err != nil {
+		return money.Money{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return m, nil
+}
+
+// scanOrders groups rows of orders joined with their products, sorted by
+// order ID, into orders
+func scanOrders(rows *sql.Rows) ([]Order, error) {
+	orders := []Order{}
+	for rows.Next() {
+		o, p, err := scanOrderRow(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if last := len(orders) - 1; last >= 0 && orders[last].ID == o.ID {
+			orders[last].Products = append(orders[last].Products, p)
+			continue
+		}
+		o.Products = []OrderedProduct{p}
+		orders = append(orders, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(err)
 	}
 
 	return orders, nil
+}
 
+// wrapError translates database errors to the order domain errors
+func wrapError(err error) error {
+	var pqErr *pq.Error
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation":
+		return ErrAlreadyExists
+	case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
 }
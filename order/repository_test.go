@@ -0,0 +1,212 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/pgschema"
+	"github.com/segmentio/ksuid"
+)
+
+// history reads the status changes of an order, oldest first
+type history func(t *testing.T, orderID string) []StatusChange
+
+func TestMemoryRepository(t *testing.T) {
+	r := NewMemoryRepository().(*memoryRepository)
+	testRepository(t, r, func(t *testing.T, orderID string) []StatusChange {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		changes := []StatusChange{}
+		for _, c := range r.history {
+			if c.OrderID == orderID {
+				changes = append(changes, c)
+			}
+		}
+		return changes
+	})
+}
+
+// TestPostgresRepository runs against the database at TEST_DATABASE_URL, to
+// which the repository applies up.sql
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	repository, err := NewPostgresRepository(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+	r := repository.(*postgresRepository)
+
+	// the schema migrates a database it created before, which it leaves as is
+	if err := pgschema.Apply(context.Background(), r.db, schema); err != nil {
+		t.Fatalf("apply up.sql again: %v", err)
+	}
+
+	testRepository(t, r, func(t *testing.T, orderID string) []StatusChange {
+		rows, err := r.db.Query(
+			`SELECT order_id, from_status, to_status, changed_by, reason, changed_at
+			FROM order_status_history WHERE order_id = $1 ORDER BY id`,
+			orderID,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		changes := []StatusChange{}
+		for rows.Next() {
+			c := StatusChange{}
+			if err := rows.Scan(&c.OrderID, &c.FromStatus, &c.ToStatus, &c.ChangedBy, &c.Reason, &c.ChangedAt); err != nil {
+				t.Fatal(err)
+			}
+			changes = append(changes, c)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	})
+
+	t.Run("LockServer", func(t *testing.T) {
+		if err := r.LockServer(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		second, err := NewPostgresRepository(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer second.Close()
+		if err := second.LockServer(context.Background()); !errors.Is(err, ErrServerRunning) {
+			t.Errorf("LockServer of a second server = %v, want %v", err, ErrServerRunning)
+		}
+	})
+}
+
+func testRepository(t *testing.T, r Repository, history history) {
+	ctx := context.Background()
+	accountID := ksuid.New().String()
+
+	newOrder := func() *Order {
+		return &Order{
+			ID:         ksuid.New().String(),
+			CreatedAt:  time.Now().UTC().Truncate(time.Microsecond),
+			TotalPrice: money.New(2500, "EUR"),
+			AccountID:  accountID,
+			Status:     StatusPending,
+			Products: []OrderedProduct{
+				{ID: ksuid.New().String(), Quantity: 1, Price: money.New(1000, "EUR")},
+				{ID: ksuid.New().String(), Quantity: 3, Price: money.New(500, "EUR")},
+			},
+		}
+	}
+
+	t.Run("PutOrder", func(t *testing.T) {
+		order := newOrder()
+		if err := r.PutOrder(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.PutOrder(ctx, order); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("PutOrder of an existing order = %v, want %v", err, ErrAlreadyExists)
+		}
+
+		got, err := r.GetOrderByID(ctx, order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkOrder(t, got, order)
+
+		if _, err := r.GetOrderByID(ctx, ksuid.New().String()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetOrderByID of a missing order = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("UpdateOrderStatus", func(t *testing.T) {
+		order := newOrder()
+		if err := r.PutOrder(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+
+		paid := StatusChange{
+			OrderID:    order.ID,
+			FromStatus: StatusPending,
+			ToStatus:   StatusPaid,
+			ChangedBy:  "admin",
+			Reason:     "payment received",
+			ChangedAt:  time.Now().UTC().Truncate(time.Microsecond),
+		}
+		if err := r.UpdateOrderStatus(ctx, &paid); err != nil {
+			t.Fatal(err)
+		}
+
+		// a change read before the order was paid no longer applies
+		stale := paid
+		stale.ToStatus = StatusCancelled
+		if err := r.UpdateOrderStatus(ctx, &stale); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("UpdateOrderStatus from a stale status = %v, want %v", err, ErrInvalidTransition)
+		}
+
+		got, err := r.GetOrderByID(ctx, order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != StatusPaid {
+			t.Errorf("status = %s, want %s", got.Status, StatusPaid)
+		}
+
+		changes := history(t, order.ID)
+		if len(changes) != 1 {
+			t.Fatalf("history = %+v, want only the change to paid", changes)
+		}
+		c := changes[0]
+		if c.FromStatus != paid.FromStatus || c.ToStatus != paid.ToStatus || c.ChangedBy != paid.ChangedBy ||
+			c.Reason != paid.Reason || !c.ChangedAt.Equal(paid.ChangedAt) {
+			t.Errorf("history = %+v, want %+v", c, paid)
+		}
+	})
+
+	t.Run("GetOrdersForAccountAfter", func(t *testing.T) {
+		orders, err := r.GetOrdersForAccount(ctx, accountID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) < 2 {
+			t.Fatalf("got %d orders of the account, want the 2 stored by the previous tests", len(orders))
+		}
+
+		page, err := r.GetOrdersForAccountAfter(ctx, accountID, orders[0].ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 1 || page[0].ID != orders[1].ID {
+			t.Errorf("page after %s = %v, want only %s", orders[0].ID, page, orders[1].ID)
+		}
+		checkOrder(t, &page[0], &orders[1])
+	})
+}
+
+func checkOrder(t *testing.T, got, want *Order) {
+	t.Helper()
+	if got.ID != want.ID || got.AccountID != want.AccountID || got.Status != want.Status ||
+		got.TotalPrice != want.TotalPrice || !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Errorf("order = %+v, want %+v", got, want)
+	}
+
+	byID := func(a, b OrderedProduct) int { return strings.Compare(a.ID, b.ID) }
+	gotProducts := slices.SortedFunc(slices.Values(got.Products), byID)
+	wantProducts := slices.SortedFunc(slices.Values(want.Products), byID)
+	if !slices.EqualFunc(gotProducts, wantProducts, func(a, b OrderedProduct) bool {
+		return a.ID == b.ID && a.Quantity == b.Quantity && a.Price == b.Price
+	}) {
+		t.Errorf("products = %+v, want %+v", got.Products, want.Products)
+	}
+}
@@ -5,11 +5,18 @@ import (
 	"fmt"
 	"github.com/ndquang191/go-graph-grpc/account"
 	"github.com/ndquang191/go-graph-grpc/catalog"
+	"github.com/ndquang191/go-graph-grpc/internal/events"
+	"github.com/ndquang191/go-graph-grpc/internal/idempotency"
+	"github.com/ndquang191/go-graph-grpc/internal/logging"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/internal/server"
 	"github.com/ndquang191/go-graph-grpc/order/pb"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
-	"log"
-	"net"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 )
 
 type grpcServer struct {
@@ -17,183 +24,563 @@ type grpcServer struct {
 	service       Service
 	accountClient *account.Client
 	catalogClient *catalog.Client
+	keys          *idempotency.Keys
+	broker        events.Broker
+	logger        *slog.Logger
 }
 
-func ListenGRPC(s Service, accountURL, catalogURL string, port int) error {
-	accountClient, err := account.NewClient(accountURL)
-	if err != nil {
-		return err
-	}
-	catalogClient, err := catalog.NewClient(catalogURL)
-	if err != nil {
-		accountClient.Close()
-		return err
-	}
-
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-
-	if err != nil {
-		accountClient.Close()
-		catalogClient.Close()
-		return err
-	}
-
-	serv := grpc.NewServer()
+// NewGRPCServer returns a server for the order service, ready to Run, that
+// calls the account and catalog services through the given clients. The
+// clients are not closed by the server; pass their Close to
+// server.OnShutdown to tie them to it. Keys deduplicates PostOrder requests
+// carrying an idempotency key. WatchOrders follows the order events
+// published to broker.
+func NewGRPCServer(s Service, keys *idempotency.Keys, broker events.Broker, accountClient *account.Client, catalogClient *catalog.Client, opts ...server.Option) *server.Server {
+	serv := server.New(opts...)
 	pb.RegisterOrderServiceServer(serv, &grpcServer{
 		UnimplementedOrderServiceServer: pb.UnimplementedOrderServiceServer{},
 		service:                         s,
 		accountClient:                   accountClient,
 		catalogClient:                   catalogClient,
+		keys:                            keys,
+		broker:                          broker,
+		logger:                          serv.Logger(),
 	})
-
-	reflection.Register(serv)
-	return serv.Serve(lis)
+	return serv
 }
 
 func (s *grpcServer) PostOrder(ctx context.Context, req *pb.PostOrderRequest) (*pb.PostOrderResponse, error) {
+	return idempotency.Do(ctx, s.keys, req.AccountId, req.IdempotencyKey, req, func(ctx context.Context) (*pb.PostOrderResponse, error) {
+		return s.postOrder(ctx, req)
+	})
+}
 
-	_, err := s.accountClient.GetAccount(ctx, req.AccountId)
+func (s *grpcServer) postOrder(ctx context.Context, req *pb.PostOrderRequest) (*pb.PostOrderResponse, error) {
+	a, err := s.accountClient.GetAccount(ctx, req.AccountId)
 	if err != nil {
-		log.Print("Error getting account: ", err)
+		logging.Error(ctx, s.logger, "Failed to get account", err)
 		return nil, err
 	}
+	if !a.Active {
+		return nil, account.ErrDeactivated
+	}
 
+	// a product listed more than once is ordered in the sum of its quantities
 	productIDs := []string{}
-	orderedProducts, err := s.catalogClient.GetProducts(ctx, 0, 0, productIDs, "")
+	quantities := map[string]uint32{}
+	for _, rp := range req.Products {
+		if rp.Quantity == 0 {
+			return nil, fmt.Errorf("%w: quantity of product %s must be positive", ErrInvalidArgument, rp.ProductId)
+		}
+		q, listed := quantities[rp.ProductId]
+		if !listed {
+			productIDs = append(productIDs, rp.ProductId)
+		}
+		if q+rp.Quantity < q {
+			return nil, fmt.Errorf("%w: quantity of product %s is too large", ErrInvalidArgument, rp.ProductId)
+		}
+		quantities[rp.ProductId] = q + rp.Quantity
+	}
+
+	found, err := s.catalogClient.GetProducts(ctx, 0, 0, productIDs, "")
 
 	if err != nil {
-		log.Print("Error getting products: ", err)
+		logging.Error(ctx, s.logger, "Failed to get products", err)
 		return nil, err
 	}
 
+	catalogProducts := map[string]catalog.Product{}
+	for _, p := range found {
+		catalogProducts[p.ID] = p
+	}
+
 	products := []OrderedProduct{}
 
-	for _, p := range orderedProducts {
-		product := OrderedProduct{
+	for _, id := range productIDs {
+		p, ok := catalogProducts[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: product %s not found", ErrInvalidArgument, id)
+		}
+		if p.Deleted {
+			return nil, fmt.Errorf("%w: product %s is no longer sold", ErrInvalidArgument, p.ID)
+		}
+
+		products = append(products, OrderedProduct{
 			ID:          p.ID,
 			Name:        p.Name,
 			Price:       p.Price,
-			Quantity:    0,
+			Quantity:    quantities[id],
 			Description: p.Description,
-		}
+		})
+	}
 
-		for _, rp := range req.Products {
-			if rp.ProductId == p.ID {
-				product.Quantity = rp.Quantity
-				break
-			}
-		}
+	items := stockItems(products)
 
-		if product.Quantity != 0 {
-			products = append(products, product)
-		}
+	if err := s.catalogClient.ReserveStock(ctx, items); err != nil {
+		logging.Error(ctx, s.logger, "Failed to reserve stock", err)
+		return nil, err
+	}
+
+	if err := s.commitStock(ctx, items); err != nil {
+		logging.Error(ctx, s.logger, "Failed to commit stock", err)
+		return nil, err
 	}
 
 	order, err := s.service.PostOrder(ctx, req.AccountId, products)
 
 	if err != nil {
-		log.Print("Error posting order: ", err)
+		logging.Error(ctx, s.logger, "Failed to store order", err)
+		if err := s.catalogClient.ReturnStock(ctx, items); err != nil {
+			s.logger.ErrorContext(ctx, "Failed to return stock of a failed order", "error", err)
+		}
 		return nil, err
 	}
 
-	orderProto := &pb.Order{
-		Id:         order.ID,
-		AccountId:  order.AccountID,
-		TotalPrice: order.TotalPrice,
-		Products:   []*pb.Order_OrderedProduct{},
+	return &pb.PostOrderResponse{
+		Order: orderProto(order),
+	}, nil
+
+}
+
+func (s *grpcServer) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.GetOrderResponse, error) {
+
+	o, err := s.service.GetOrder(ctx, req.Id)
+
+	if err != nil {
+		return nil, err
 	}
 
-	binaryData, err := order.CreatedAt.MarshalBinary()
+	orderProto, err := s.enrichOrder(ctx, o)
 	if err != nil {
-		log.Fatalf("Failed to marshal CreatedAt: %v", err)
+		return nil, err
 	}
-	orderProto.CreatedAt = string(binaryData)
 
-	for _, p := range order.Products {
+	return &pb.GetOrderResponse{
+		Order: orderProto,
+	}, nil
+}
 
-		orderProto.Products = append(orderProto.Products, &pb.Order_OrderedProduct{
-			Id:          p.ID,
-			Name:        p.Name,
-			Description: p.Description,
-			Quantity:    p.Quantity,
-			Price:       p.Price,
-		})
+func (s *grpcServer) GetOrdersForAccount(ctx context.Context, req *pb.GetOrdersForAccountRequest) (*pb.GetOrdersForAccountResponse, error) {
+	if req.After != "" || req.Take != 0 {
+		return s.getOrdersForAccountAfter(ctx, req)
 	}
 
-	return &pb.PostOrderResponse{
+	accountOrders, err := s.service.GetOrdersForAccount(ctx, req.AccountId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := s.enrichOrders(ctx, accountOrders)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetOrdersForAccountResponse{
+		Orders: orders,
+	}, nil
+}
+
+func (s *grpcServer) getOrdersForAccountAfter(ctx context.Context, req *pb.GetOrdersForAccountRequest) (*pb.GetOrdersForAccountResponse, error) {
+	page, err := s.service.GetOrdersForAccountAfter(ctx, req.AccountId, req.After, req.Take)
+
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := s.enrichOrders(ctx, page.Orders)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetOrdersForAccountResponse{
+		Orders:      orders,
+		Cursors:     page.Cursors,
+		HasNextPage: page.HasNextPage,
+	}, nil
+}
+
+func (s *grpcServer) GetOrdersForAccounts(ctx context.Context, req *pb.GetOrdersForAccountsRequest) (*pb.GetOrdersForAccountsResponse, error) {
+
+	accountOrders, err := s.service.GetOrdersForAccounts(ctx, req.AccountIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := s.enrichOrders(ctx, accountOrders)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetOrdersForAccountsResponse{
+		Orders: orders,
+	}, nil
+}
+
+func (s *grpcServer) UpdateOrderStatus(ctx context.Context, req *pb.UpdateOrderStatusRequest) (*pb.UpdateOrderStatusResponse, error) {
+
+	status, err := ParseStatus(req.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := s.changeStatus(ctx, req.Id, status, func(ctx context.Context) (*Order, error) {
+		return s.service.UpdateOrderStatus(ctx, req.Id, status, req.ChangedBy, req.Reason)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	orderProto, err := s.enrichOrder(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateOrderStatusResponse{
 		Order: orderProto,
 	}, nil
+}
+
+func (s *grpcServer) CancelOrder(ctx context.Context, req *pb.CancelOrderRequest) (*pb.CancelOrderResponse, error) {
+
+	o, err := s.changeStatus(ctx, req.Id, StatusCancelled, func(ctx context.Context) (*Order, error) {
+		return s.service.CancelOrder(ctx, req.Id, req.ChangedBy, req.Reason)
+	})
 
+	if err != nil {
+		return nil, err
+	}
+
+	orderProto, err := s.enrichOrder(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CancelOrderResponse{
+		Order: orderProto,
+	}, nil
 }
 
-func (s *grpcServer) GetOrdersForAccount(ctx context.Context, req *pb.GetOrdersForAccountRequest) (*pb.GetOrdersForAccountResponse, error) {
+// changeStatus moves an order to status with update. An order that is
+// cancelled or refunded gives its stock back to the catalog first, and takes
+// it out again if it cannot move after all, so the stock is returned once
+// however many calls race to cancel the order.
+func (s *grpcServer) changeStatus(ctx context.Context, id string, status Status, update func(context.Context) (*Order, error)) (*Order, error) {
+	if !status.ReturnsStock() {
+		return update(ctx)
+	}
 
-	accountOrders, err := s.service.GetOrdersForAccount(ctx, req.AccountId)
+	o, err := s.service.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !o.Status.CanTransitionTo(status) {
+		return nil, ErrInvalidTransition
+	}
+
+	items := stockItems(o.Products)
+	if err := s.catalogClient.ReturnStock(ctx, items); err != nil {
+		logging.Error(ctx, s.logger, "Failed to return stock", err, "order", id)
+		return nil, err
+	}
 
+	o, err = update(ctx)
 	if err != nil {
-		log.Print("Error getting orders: ", err)
+		if err := s.takeStock(ctx, items); err != nil {
+			s.logger.ErrorContext(ctx, "Failed to take back the stock returned for an unchanged order", "order", id, "error", err)
+		}
 		return nil, err
 	}
+	return o, nil
+}
 
-	productIDMap := map[string]bool{}
+// commitStock commits reserved items one at a time, so that when one fails
+// the stock of the items committed before it is returned, and the others are
+// released
+func (s *grpcServer) commitStock(ctx context.Context, items []catalog.StockItem) error {
+	for i, item := range items {
+		err := s.catalogClient.CommitStock(ctx, []catalog.StockItem{item})
+		if err == nil {
+			continue
+		}
 
-	for _, o := range accountOrders {
-		for _, p := range o.Products {
-			productIDMap[p.ID] = true
+		if returnErr := s.catalogClient.ReturnStock(ctx, items[:i]); returnErr != nil {
+			s.logger.ErrorContext(ctx, "Failed to return stock of a failed order", "error", returnErr)
+		}
+		if releaseErr := s.catalogClient.ReleaseStock(ctx, items[i:]); releaseErr != nil {
+			s.logger.ErrorContext(ctx, "Failed to release stock of a failed order", "error", releaseErr)
 		}
+		return err
 	}
+	return nil
+}
 
-	productIDs := []string{}
-	for id := range productIDMap {
-		productIDs = append(productIDs, id)
+// takeStock removes items from the stock of the catalog
+func (s *grpcServer) takeStock(ctx context.Context, items []catalog.StockItem) error {
+	if err := s.catalogClient.ReserveStock(ctx, items); err != nil {
+		return err
+	}
+	return s.catalogClient.CommitStock(ctx, items)
+}
+
+func stockItems(products []OrderedProduct) []catalog.StockItem {
+	items := []catalog.StockItem{}
+	for _, p := range products {
+		items = append(items, catalog.StockItem{
+			ProductID: p.ID,
+			Quantity:  p.Quantity,
+		})
+	}
+	return items
+}
+
+// WatchOrders streams the orders picked by req as their events reach the
+// broker. Events are relayed from the outbox, so orders are streamed a relay
+// interval or so after they change. With a broker in memory, the orders are
+// those changed through this server, so there must be a single one, which
+// Repository.LockServer makes sure of.
+func (s *grpcServer) WatchOrders(req *pb.WatchOrdersRequest, stream pb.OrderService_WatchOrdersServer) error {
+	ctx := stream.Context()
+	w := newWatch()
+
+	// subscribe before reading the order, so no change goes unnoticed
+	var unsubscribe func()
+	switch target := req.Target.(type) {
+	case *pb.WatchOrdersRequest_OrderId:
+		unsubscribe = s.broker.Subscribe(events.TypeOrderStatusChanged, func(ctx context.Context, e events.Event) error {
+			if e.AggregateID == target.OrderId {
+				w.notify(e.AggregateID)
+			}
+			return nil
+		})
+		w.notify(target.OrderId)
+	case *pb.WatchOrdersRequest_AccountId:
+		unsubscribe = s.broker.Subscribe(events.TypeOrderPlaced, func(ctx context.Context, e events.Event) error {
+			var placed events.OrderPlaced
+			if err := e.Decode(&placed); err != nil {
+				// delivering it again would not help
+				logging.Error(ctx, s.logger, "Failed to decode event", err)
+				return nil
+			}
+			if placed.AccountID == target.AccountId {
+				w.notify(e.AggregateID)
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("%w: an order or an account to watch is required", ErrInvalidArgument)
+	}
+	defer unsubscribe()
+
+	for {
+		ids, ok := w.wait(ctx)
+		if !ok {
+			return nil
+		}
+
+		orders := []Order{}
+		for _, id := range ids {
+			o, err := s.service.GetOrder(ctx, id)
+			if err != nil {
+				return err
+			}
+			orders = append(orders, *o)
+		}
+
+		orderProtos, err := s.enrichOrders(ctx, orders)
+		if err != nil {
+			return err
+		}
+		for _, o := range orderProtos {
+			if err := stream.Send(&pb.WatchOrdersResponse{Order: o}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamEnrichSize is the number of orders StreamOrders enriches with a
+// single catalog call
+const streamEnrichSize = 100
+
+// StreamOrders sends an order per message, enriching them with the catalog a
+// batch at a time. Send blocks while the client is behind, which pauses the
+// read of the orders.
+func (s *grpcServer) StreamOrders(req *pb.StreamOrdersRequest, stream pb.OrderService_StreamOrdersServer) error {
+	ctx := stream.Context()
+
+	send := func(orders []Order) error {
+		orderProtos, err := s.enrichOrders(ctx, orders)
+		if err != nil {
+			return err
+		}
+		for _, o := range orderProtos {
+			if err := stream.Send(&pb.StreamOrdersResponse{Order: o}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	batch := make([]Order, 0, streamEnrichSize)
+	for o, err := range s.service.StreamOrders(ctx) {
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, o)
+		if len(batch) == streamEnrichSize {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return send(batch)
+}
+
+// watch collects the IDs of the orders a WatchOrders stream is to send next.
+// An order changing several times before it is sent is sent once, in its
+// latest state, so slow streams do not hold up the broker.
+type watch struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	ready   chan struct{}
+}
+
+func newWatch() *watch {
+	return &watch{pending: map[string]bool{}, ready: make(chan struct{}, 1)}
+}
+
+func (w *watch) notify(orderID string) {
+	w.mu.Lock()
+	w.pending[orderID] = true
+	w.mu.Unlock()
+
+	select {
+	case w.ready <- struct{}{}:
+	default:
 	}
+}
 
-	products, err := s.catalogClient.GetProducts(ctx, 0, 0, productIDs, "")
+// wait returns the pending order IDs in ID order, once there are any, or
+// false once ctx is done
+func (w *watch) wait(ctx context.Context) ([]string, bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case <-w.ready:
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := slices.Sorted(maps.Keys(w.pending))
+	clear(w.pending)
+	return ids, true
+}
 
+// enrichOrder converts a stored order to its proto form, filling in product
+// names, descriptions and prices from the catalog
+func (s *grpcServer) enrichOrder(ctx context.Context, o *Order) (*pb.Order, error) {
+	orders, err := s.enrichOrders(ctx, []Order{*o})
 	if err != nil {
-		log.Print("Error getting products: ", err)
 		return nil, err
 	}
+	return orders[0], nil
+}
 
-	orders := []*pb.Order{}
-	for _, o := range accountOrders {
-		op := &pb.Order{
-			Id:         o.ID,
-			AccountId:  o.AccountID,
-			TotalPrice: o.TotalPrice,
-			Products:   []*pb.Order_OrderedProduct{},
+// enrichOrders is enrichOrder for many orders, looking up all of their
+// products with a single catalog call
+func (s *grpcServer) enrichOrders(ctx context.Context, storedOrders []Order) ([]*pb.Order, error) {
+	productIDMap := map[string]bool{}
+
+	for _, o := range storedOrders {
+		for _, p := range o.Products {
+			productIDMap[p.ID] = true
 		}
+	}
+
+	productIDs := []string{}
+	for id := range productIDMap {
+		productIDs = append(productIDs, id)
+	}
+
+	products := []catalog.Product{}
+	if len(productIDs) != 0 {
+		var err error
+		products, err = s.catalogClient.GetProducts(ctx, 0, 0, productIDs, "")
 
-		binaryData, err := o.CreatedAt.MarshalBinary()
 		if err != nil {
-			log.Fatalf("Failed to marshal CreatedAt: %v", err)
+			logging.Error(ctx, s.logger, "Failed to get products", err)
+			return nil, err
 		}
-		op.CreatedAt = string(binaryData)
+	}
 
-		for _, product := range o.Products {
-			for _, p := range products {
+	productMap := map[string]catalog.Product{}
+	for _, p := range products {
+		productMap[p.ID] = p
+	}
 
-				if p.ID == product.ID {
-					product.Name = p.Name
-					product.Description = p.Description
+	orders := []*pb.Order{}
+	for _, o := range storedOrders {
+		products := make([]OrderedProduct, len(o.Products))
+		for i, product := range o.Products {
+			// the price is the one stored with the order, except for orders
+			// stored without one
+			if p, ok := productMap[product.ID]; ok {
+				product.Name = p.Name
+				product.Description = p.Description
+				if product.Price.Currency == "" {
 					product.Price = p.Price
-					break
 				}
 			}
+			products[i] = product
+		}
+		o.Products = products
+		orders = append(orders, orderProto(&o))
+	}
 
-			op.Products = append(op.Products, &pb.Order_OrderedProduct{
-				Id:          product.ID,
-				Name:        product.Name,
-				Description: product.Description,
-				Quantity:    product.Quantity,
-				Price:       product.Price,
-			})
+	return orders, nil
+}
 
-		}
-		orders = append(orders, op)
+// orderProto converts an order, filling the deprecated fields along with
+// those replacing them
+func orderProto(o *Order) *pb.Order {
+	op := &pb.Order{
+		Id:              o.ID,
+		AccountId:       o.AccountID,
+		TotalPrice:      moneyProto(o.TotalPrice),
+		TotalPriceFloat: o.TotalPrice.Float(),
+		Status:          string(o.Status),
+		Products:        []*pb.Order_OrderedProduct{},
 	}
+	setCreatedAt(op, o.CreatedAt)
 
-	return &pb.GetOrdersForAccountResponse{
-		Orders: orders,
-	}, nil
+	for _, p := range o.Products {
+		op.Products = append(op.Products, &pb.Order_OrderedProduct{
+			Id:          p.ID,
+			Name:        p.Name,
+			Description: p.Description,
+			Quantity:    p.Quantity,
+			Price:       moneyProto(p.Price),
+			PriceFloat:  p.Price.Float(),
+		})
+	}
+	return op
+}
+
+// setCreatedAt fills both createdAt and the deprecated createdAtText, which
+// clients built before createdAt was added still read
+func setCreatedAt(o *pb.Order, createdAt time.Time) {
+	o.CreatedAt = timestamppb.New(createdAt)
+	o.CreatedAtText = createdAt.Format(time.RFC3339Nano)
+}
+
+func moneyProto(m money.Money) *pb.Money {
+	return &pb.Money{Amount: m.Amount, Currency: m.Currency}
 }
@@ -0,0 +1,36 @@
+package order
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/ndquang191/go-graph-grpc/order/pb"
+)
+
+func TestDeprecatedPrices(t *testing.T) {
+	o := &Order{
+		ID:         "order",
+		CreatedAt:  time.Now().UTC(),
+		TotalPrice: money.New(1500, "EUR"),
+		Status:     StatusPending,
+		Products:   []OrderedProduct{{ID: "product", Quantity: 3, Price: money.New(500, "EUR")}},
+	}
+
+	// servers fill the float prices for old clients
+	op := orderProto(o)
+	if op.TotalPriceFloat != 15 || op.Products[0].PriceFloat != 5 {
+		t.Errorf("float prices = %v and %v, want 15 and 5", op.TotalPriceFloat, op.Products[0].PriceFloat)
+	}
+
+	// clients read the float prices of old servers as USD
+	old := &pb.Order{
+		Id:              "order",
+		TotalPriceFloat: 14.97,
+		Products:        []*pb.Order_OrderedProduct{{Id: "product", Quantity: 3, PriceFloat: 4.99}},
+	}
+	decoded := decodeOrder(old)
+	if decoded.TotalPrice != money.New(1497, "USD") || decoded.Products[0].Price != money.New(499, "USD") {
+		t.Errorf("prices = %v and %v, want 14.97 USD and 4.99 USD", decoded.TotalPrice, decoded.Products[0].Price)
+	}
+}
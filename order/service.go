@@ -2,28 +2,117 @@ package order
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/ndquang191/go-graph-grpc/internal/cursor"
+	"github.com/ndquang191/go-graph-grpc/internal/errs"
+	"github.com/ndquang191/go-graph-grpc/internal/money"
 	"github.com/segmentio/ksuid"
+	"iter"
 	"time"
 )
 
+var (
+	ErrNotFound          = errs.New(errs.NotFound, "order not found")
+	ErrInvalidArgument   = errs.New(errs.InvalidArgument, "invalid order")
+	ErrAlreadyExists     = errs.New(errs.AlreadyExists, "order already exists")
+	ErrUnavailable       = errs.New(errs.Unavailable, "order storage unavailable")
+	ErrInvalidStatus     = errs.New(errs.InvalidArgument, "invalid order status")
+	ErrInvalidTransition = errs.New(errs.FailedPrecondition, "invalid order status transition")
+	ErrServerRunning     = errs.New(errs.FailedPrecondition, "another order server uses the storage")
+)
+
 type Service interface {
 	PostOrder(ctx context.Context, accountID string, products []OrderedProduct) (*Order, error)
+	GetOrder(ctx context.Context, id string) (*Order, error)
 	GetOrdersForAccount(ctx context.Context, accountID string) ([]Order, error)
+	GetOrdersForAccounts(ctx context.Context, accountIDs []string) ([]Order, error)
+	GetOrdersForAccountAfter(ctx context.Context, accountID string, after string, first uint64) (*OrderPage, error)
+	UpdateOrderStatus(ctx context.Context, id string, status Status, changedBy string, reason string) (*Order, error)
+	CancelOrder(ctx context.Context, id string, changedBy string, reason string) (*Order, error)
+	// StreamOrders yields every order in ID order, for exports
+	StreamOrders(ctx context.Context) iter.Seq2[Order, error]
+}
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusPaid      Status = "paid"
+	StatusShipped   Status = "shipped"
+	StatusDelivered Status = "delivered"
+	StatusCancelled Status = "cancelled"
+	StatusRefunded  Status = "refunded"
+)
+
+// transitions lists, for every status, the statuses an order may move to next.
+var transitions = map[Status][]Status{
+	StatusPending:   {StatusPaid, StatusCancelled},
+	StatusPaid:      {StatusShipped, StatusCancelled, StatusRefunded},
+	StatusShipped:   {StatusDelivered},
+	StatusDelivered: {StatusRefunded},
+	StatusCancelled: {},
+	StatusRefunded:  {},
+}
+
+func ParseStatus(s string) (Status, error) {
+	status := Status(s)
+	if _, ok := transitions[status]; !ok {
+		return "", ErrInvalidStatus
+	}
+	return status, nil
 }
+
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, t := range transitions[s] {
+		if t == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ReturnsStock reports whether an order moving to s gives its products back
+// to the catalog
+func (s Status) ReturnsStock() bool {
+	return s == StatusCancelled || s == StatusRefunded
+}
+
 type Order struct {
 	ID         string
 	CreatedAt  time.Time
-	TotalPrice float64
+	TotalPrice money.Money
 	AccountID  string
+	Status     Status
 	Products   []OrderedProduct
 }
 
+// OrderPage is one page of a cursor paginated order listing
+type OrderPage struct {
+	Orders []Order
+	// Cursors[i] is the cursor to resume the listing after Orders[i]
+	Cursors     []string
+	HasNextPage bool
+}
+
+// StatusChange is a single entry of an order's status history.
+type StatusChange struct {
+	OrderID    string
+	FromStatus Status
+	ToStatus   Status
+	ChangedBy  string
+	Reason     string
+	ChangedAt  time.Time
+}
+
 type OrderedProduct struct {
 	ID          string
 	Name        string
 	Description string
 	Quantity    uint32
-	Price       float64
+	// Price is the unit price the product was ordered at. Orders stored
+	// before it was kept have none, with an empty currency.
+	Price money.Money
 }
 
 type orderService struct {
@@ -36,26 +125,136 @@ func NewService(r Repository) Service {
 }
 
 func (s *orderService) PostOrder(ctx context.Context, accountID string, products []OrderedProduct) (*Order, error) {
+	if len(products) == 0 {
+		return nil, fmt.Errorf("%w: an order needs at least one product", ErrInvalidArgument)
+	}
+
+	total, err := totalPrice(products)
+	if err != nil {
+		return nil, err
+	}
+
 	order := &Order{
-		ID:        ksuid.New().String(),
-		CreatedAt: time.Now().UTC(),
-		AccountID: accountID,
-		Products:  products,
+		ID:         ksuid.New().String(),
+		CreatedAt:  time.Now().UTC(),
+		TotalPrice: total,
+		AccountID:  accountID,
+		Status:     StatusPending,
+		Products:   products,
 	}
 
-	order.TotalPrice = 0.0
+	if err := s.repository.PutOrder(ctx, order); err != nil {
+		return nil, err
+	}
+
+	ordersCreated.Inc()
+	orderValue.WithLabelValues(order.TotalPrice.Currency).Add(order.TotalPrice.Float())
+
+	return order, nil
+}
+
+// totalPrice sums the prices of the products times their quantities. The
+// products of an order must all be priced in the same currency.
+func totalPrice(products []OrderedProduct) (money.Money, error) {
+	total := money.New(0, products[0].Price.Currency)
 	for _, p := range products {
-		order.TotalPrice += p.Price * float64(p.Quantity)
+		line, err := p.Price.Mul(int64(p.Quantity))
+		if err == nil {
+			total, err = line.Add(total)
+		}
+		if errors.Is(err, money.ErrCurrencyMismatch) {
+			return money.Money{}, fmt.Errorf("%w: the products of an order must have the same currency", ErrInvalidArgument)
+		}
+		if err != nil {
+			return money.Money{}, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+	}
+	return total, nil
+}
+
+func (s *orderService) GetOrder(ctx context.Context, id string) (*Order, error) {
+	return s.repository.GetOrderByID(ctx, id)
+}
+
+func (s *orderService) StreamOrders(ctx context.Context) iter.Seq2[Order, error] {
+	return s.repository.StreamOrders(ctx)
+}
+
+func (s *orderService) GetOrdersForAccount(ctx context.Context, accountID string) ([]Order, error) {
+	return s.repository.GetOrdersForAccount(ctx, accountID)
+}
+
+func (s *orderService) GetOrdersForAccounts(ctx context.Context, accountIDs []string) ([]Order, error) {
+	return s.repository.GetOrdersForAccounts(ctx, accountIDs)
+}
+
+func (s *orderService) GetOrdersForAccountAfter(ctx context.Context, accountID string, after string, first uint64) (*OrderPage, error) {
+	if first > 100 || first == 0 {
+		first = 100
 	}
 
-	err := s.repository.PutOrder(ctx, order)
+	afterID := ""
+	if after != "" {
+		if err := cursor.Decode(after, &afterID); err != nil {
+			return nil, err
+		}
+	}
+
+	// one extra order tells whether there is a next page
+	orders, err := s.repository.GetOrdersForAccountAfter(ctx, accountID, afterID, first+1)
 	if err != nil {
 		return nil, err
 	}
 
+	page := &OrderPage{Cursors: []string{}}
+	if uint64(len(orders)) > first {
+		orders = orders[:first]
+		page.HasNextPage = true
+	}
+
+	page.Orders = orders
+	for _, o := range orders {
+		page.Cursors = append(page.Cursors, cursor.Encode(o.ID))
+	}
+	return page, nil
+}
+
+func (s *orderService) UpdateOrderStatus(ctx context.Context, id string, status Status, changedBy string, reason string) (*Order, error) {
+	if _, ok := transitions[status]; !ok {
+		return nil, ErrInvalidStatus
+	}
+
+	order, err := s.repository.GetOrderByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !order.Status.CanTransitionTo(status) {
+		return nil, ErrInvalidTransition
+	}
+
+	if changedBy == "" {
+		changedBy = "system"
+	}
+
+	change := StatusChange{
+		OrderID:    order.ID,
+		FromStatus: order.Status,
+		ToStatus:   status,
+		ChangedBy:  changedBy,
+		Reason:     reason,
+		ChangedAt:  time.Now().UTC(),
+	}
+
+	if err := s.repository.UpdateOrderStatus(ctx, &change); err != nil {
+		return nil, err
+	}
+	orderStatusChanges.WithLabelValues(string(status)).Inc()
+
+	order.Status = status
 	return order, nil
 }
 
-func (s *orderService) GetOrdersForAccount(ctx context.Context, accountID string) ([]Order, error) {
-	return s.repository.GetOrdersForAccount(ctx, accountID)
+func (s *orderService) CancelOrder(ctx context.Context, id string, changedBy string, reason string) (*Order, error) {
+	return s.UpdateOrderStatus(ctx, id, StatusCancelled, changedBy, reason)
 }
@@ -0,0 +1,154 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/ndquang191/go-graph-grpc/internal/money"
+	"github.com/segmentio/ksuid"
+)
+
+func TestCanTransitionTo(t *testing.T) {
+	allowed := map[[2]Status]bool{
+		{StatusPending, StatusPaid}:       true,
+		{StatusPending, StatusCancelled}:  true,
+		{StatusPaid, StatusShipped}:       true,
+		{StatusPaid, StatusCancelled}:     true,
+		{StatusPaid, StatusRefunded}:      true,
+		{StatusShipped, StatusDelivered}:  true,
+		{StatusDelivered, StatusRefunded}: true,
+	}
+	statuses := []Status{StatusPending, StatusPaid, StatusShipped, StatusDelivered, StatusCancelled, StatusRefunded, "lost"}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got := from.CanTransitionTo(to); got != allowed[[2]Status{from, to}] {
+				t.Errorf("%s.CanTransitionTo(%s) = %t, want %t", from, to, got, !got)
+			}
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Status
+		err  error
+	}{
+		{"pending", StatusPending, nil},
+		{"refunded", StatusRefunded, nil},
+		{"PAID", "", ErrInvalidStatus},
+		{"", "", ErrInvalidStatus},
+		{"lost", "", ErrInvalidStatus},
+	}
+	for _, tt := range tests {
+		got, err := ParseStatus(tt.s)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("ParseStatus(%q) = %q, %v, want %q, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestPostOrderTotal(t *testing.T) {
+	product := func(quantity uint32, price money.Money) OrderedProduct {
+		return OrderedProduct{ID: ksuid.New().String(), Quantity: quantity, Price: price}
+	}
+	tests := []struct {
+		name     string
+		products []OrderedProduct
+		want     money.Money
+		err      error
+	}{
+		{
+			name:     "quantities times unit prices",
+			products: []OrderedProduct{product(1, money.New(1000, "EUR")), product(3, money.New(250, "EUR"))},
+			want:     money.New(1750, "EUR"),
+		},
+		{
+			name:     "currency without minor unit",
+			products: []OrderedProduct{product(2, money.New(1500, "JPY"))},
+			want:     money.New(3000, "JPY"),
+		},
+		{
+			name:     "no products",
+			products: nil,
+			err:      ErrInvalidArgument,
+		},
+		{
+			name:     "mixed currencies",
+			products: []OrderedProduct{product(1, money.New(1000, "EUR")), product(1, money.New(1000, "USD"))},
+			err:      ErrInvalidArgument,
+		},
+		{
+			name:     "overflow",
+			products: []OrderedProduct{product(2, money.New(math.MaxInt64/2+1, "USD"))},
+			err:      ErrInvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewService(NewMemoryRepository()).PostOrder(context.Background(), ksuid.New().String(), tt.products)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("PostOrder error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if o.TotalPrice != tt.want || o.Status != StatusPending {
+				t.Errorf("order = %s, %s, want %s, %s", o.TotalPrice, o.Status, tt.want, StatusPending)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewMemoryRepository())
+	o, err := s.PostOrder(ctx, ksuid.New().String(), []OrderedProduct{
+		{ID: ksuid.New().String(), Quantity: 1, Price: money.New(1000, "USD")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		status Status
+		err    error
+	}{
+		{"lost", ErrInvalidStatus},
+		{StatusShipped, ErrInvalidTransition},
+		{StatusPaid, nil},
+		{StatusPending, ErrInvalidTransition},
+		{StatusShipped, nil},
+		{StatusCancelled, ErrInvalidTransition},
+		{StatusDelivered, nil},
+		{StatusRefunded, nil},
+		{StatusPaid, ErrInvalidTransition},
+	}
+	want := StatusPending
+	for _, step := range steps {
+		got, err := s.UpdateOrderStatus(ctx, o.ID, step.status, "", "")
+		if !errors.Is(err, step.err) {
+			t.Fatalf("move from %s to %s: error = %v, want %v", want, step.status, err, step.err)
+		}
+		if err == nil {
+			want = step.status
+			if got.Status != want {
+				t.Errorf("status = %s, want %s", got.Status, want)
+			}
+		}
+	}
+
+	got, err := s.GetOrder(ctx, o.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusRefunded {
+		t.Errorf("stored status = %s, want %s", got.Status, StatusRefunded)
+	}
+
+	if _, err := s.CancelOrder(ctx, ksuid.New().String(), "", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("CancelOrder of a missing order = %v, want %v", err, ErrNotFound)
+	}
+}
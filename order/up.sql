@@ -1,14 +1,70 @@
-CREATE TABLE IF NOT EXISTS `order` (
+CREATE TABLE IF NOT EXISTS orders (
    id char(27) PRIMARY KEY,
    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
    account_id char(27) NOT NULL,
-   total_price MONEY NOT NULL,
+   total_price NUMERIC(19, 4) NOT NULL,
+   currency CHAR(3) NOT NULL DEFAULT 'USD',
+   status VARCHAR(16) NOT NULL DEFAULT 'pending'
 );
 
-CREATE TABLE IF NOT EXISTS `order_products` (
-   order_id char(27) REFERENCES `order`(id) ON DELETE CASCADE,
+CREATE TABLE IF NOT EXISTS order_products (
+   order_id char(27) REFERENCES orders(id) ON DELETE CASCADE,
    product_id char(27),
    quantity INT NOT NULL,
+   -- unit price the product was ordered at, missing for older orders
+   price NUMERIC(19, 4),
+   currency CHAR(3),
    PRIMARY KEY (order_id, product_id)
 );
 
+CREATE TABLE IF NOT EXISTS order_status_history (
+   id SERIAL PRIMARY KEY,
+   order_id char(27) REFERENCES orders(id) ON DELETE CASCADE,
+   from_status VARCHAR(16) NOT NULL,
+   to_status VARCHAR(16) NOT NULL,
+   changed_by VARCHAR(255) NOT NULL,
+   reason TEXT NOT NULL DEFAULT '',
+   changed_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_id ON order_status_history (order_id);
+
+-- the statements below migrate the tables created by older versions of this
+-- file, and do nothing to up to date ones
+
+-- total_price was MONEY, whose precision depends on the locale of the server
+DO $$
+BEGIN
+   IF (SELECT data_type FROM information_schema.columns
+         WHERE table_name = 'orders' AND column_name = 'total_price') = 'money' THEN
+      ALTER TABLE orders ALTER COLUMN total_price TYPE NUMERIC(19, 4) USING total_price::numeric;
+   END IF;
+END
+$$;
+
+-- orders placed before currencies were stored were in USD
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'pending';
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS price NUMERIC(19, 4);
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS currency CHAR(3);
+
+-- idempotency keys of Post requests, see internal/idempotency
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+   key VARCHAR(255) PRIMARY KEY,
+   fingerprint CHAR(64) NOT NULL,
+   response BYTEA,
+   created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+
+-- events waiting to be published, see internal/outbox
+CREATE TABLE IF NOT EXISTS outbox (
+   id CHAR(27) PRIMARY KEY,
+   type VARCHAR(64) NOT NULL,
+   aggregate_id VARCHAR(255) NOT NULL,
+   data JSONB NOT NULL,
+   occurred_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_occurred_at ON outbox (occurred_at);